@@ -0,0 +1,394 @@
+package vobsub
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BDNVideoFormat is the video format of a BDN XML document
+type BDNVideoFormat int
+
+const (
+	// BDNVideoFormatFromCanvas uses the video format matching the subtitles canvas
+	BDNVideoFormatFromCanvas BDNVideoFormat = iota
+	BDNVideoFormat480i
+	BDNVideoFormat576i
+	BDNVideoFormat720p
+	BDNVideoFormat1080p
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (vf BDNVideoFormat) String() string {
+	switch vf {
+	case BDNVideoFormatFromCanvas:
+		return "from canvas"
+	case BDNVideoFormat480i:
+		return "480i"
+	case BDNVideoFormat576i:
+		return "576i"
+	case BDNVideoFormat720p:
+		return "720p"
+	case BDNVideoFormat1080p:
+		return "1080p"
+	default:
+		return "Unknown"
+	}
+}
+
+// Size returns the video frame size of the format.
+func (vf BDNVideoFormat) Size() image.Point {
+	switch vf {
+	case BDNVideoFormat480i:
+		return image.Point{X: 720, Y: 480}
+	case BDNVideoFormat576i:
+		return image.Point{X: 720, Y: 576}
+	case BDNVideoFormat720p:
+		return image.Point{X: 1280, Y: 720}
+	case BDNVideoFormat1080p:
+		return image.Point{X: 1920, Y: 1080}
+	default:
+		return image.Point{}
+	}
+}
+
+// bdnVideoFormatFromHeight returns the video format of a video frame height
+func bdnVideoFormatFromHeight(height int) (vf BDNVideoFormat, err error) {
+	for vf = BDNVideoFormat480i; vf <= BDNVideoFormat1080p; vf++ {
+		if vf.Size().Y == height {
+			return
+		}
+	}
+	err = fmt.Errorf("no BDN video format has %d lines", height)
+	return
+}
+
+const (
+	bdnVersion         = "0.93"
+	bdnXSINamespace    = "http://www.w3.org/2001/XMLSchema-instance"
+	bdnSchemaLocation  = "BD-03-006-0093b BDN File Format.xsd"
+	bdnEventsType      = "Graphic"
+	bdnTrue            = "True"
+	bdnFalse           = "False"
+	bdnDefaultLanguage = "eng"
+)
+
+// BDN XML document, as written by the authoring tools
+type bdnDocument struct {
+	XMLName        xml.Name       `xml:"BDN"`
+	Version        string         `xml:"Version,attr"`
+	XSI            string         `xml:"xmlns:xsi,attr,omitempty"`
+	SchemaLocation string         `xml:"xsi:noNamespaceSchemaLocation,attr,omitempty"`
+	Description    bdnDescription `xml:"Description"`
+	Events         []bdnEvent     `xml:"Events>Event"`
+}
+
+type bdnDescription struct {
+	Name struct {
+		Title   string `xml:"Title,attr"`
+		Content string `xml:"Content,attr"`
+	} `xml:"Name"`
+	Language struct {
+		Code string `xml:"Code,attr"`
+	} `xml:"Language"`
+	Format struct {
+		VideoFormat string `xml:"VideoFormat,attr"`
+		FrameRate   string `xml:"FrameRate,attr"`
+		DropFrame   string `xml:"DropFrame,attr"`
+	} `xml:"Format"`
+	Events struct {
+		Type           string `xml:"Type,attr"`
+		FirstEventInTC string `xml:"FirstEventInTC,attr"`
+		LastEventOutTC string `xml:"LastEventOutTC,attr"`
+		NumberofEvents int    `xml:"NumberofEvents,attr"`
+	} `xml:"Events"`
+}
+
+type bdnEvent struct {
+	Forced   string       `xml:"Forced,attr"`
+	InTC     string       `xml:"InTC,attr"`
+	OutTC    string       `xml:"OutTC,attr"`
+	Graphics []bdnGraphic `xml:"Graphic"`
+}
+
+type bdnGraphic struct {
+	Width  int    `xml:"Width,attr"`
+	Height int    `xml:"Height,attr"`
+	X      int    `xml:"X,attr"`
+	Y      int    `xml:"Y,attr"`
+	File   string `xml:",chardata"`
+}
+
+// BDNOptions defines how subtitles are written as a BDN XML document and its PNG images
+type BDNOptions struct {
+	// VideoFormat of the document. If it does not match the subtitles canvas, subtitles are scaled using ScaleFilter and
+	// the pixel aspect ratio of the source video (see ScaleOptions). It must be set to write a document without subtitles.
+	VideoFormat      BDNVideoFormat
+	ScaleFilter      ScaleFilter
+	PixelAspectRatio PixelAspectRatio
+	// FrameRate of the video, used to compute the timecodes
+	FrameRate FrameRate
+	// Title of the document (the XML file name if empty)
+	Title string
+	// Language is the 3 letters language code of the subtitles ("eng" if empty)
+	Language string
+}
+
+// WriteBDN writes the subtitles of a stream as a BDN XML document at xmlFile, along with one PNG image per subtitle
+// written next to it (named after the XML file and numbered from 1). Subtitles must share the same canvas.
+// Images are placed using their Placement and cropped to their visible pixels, their position on the video becoming
+// the graphic position. Timecodes are non drop frame timecodes of the frame rate. Subtitles without stop time are
+// displayed until the next one (5 seconds at most), and overlapping subtitles are cut at the start of the next one.
+// It returns the number of events written.
+func WriteBDN(xmlFile string, subtitles []Subtitle, opts BDNOptions) (nbEvents int, err error) {
+	// Get the video format
+	canvas, err := commonCanvas(subtitles)
+	if err != nil {
+		return
+	}
+	videoFormat := opts.VideoFormat
+	if videoFormat == BDNVideoFormatFromCanvas {
+		if len(subtitles) == 0 {
+			err = errors.New("no subtitles to guess the video format from: set the video format")
+			return
+		}
+		if videoFormat, err = bdnVideoFormatFromHeight(canvas.Dy()); err != nil {
+			err = fmt.Errorf("failed to guess the video format of the %v canvas: %w", canvas.Size(), err)
+			return
+		}
+	}
+	videoSize := videoFormat.Size()
+	if videoSize == (image.Point{}) {
+		err = fmt.Errorf("unknown video format: %d", videoFormat)
+		return
+	}
+	var scaler *Scaler
+	if len(subtitles) > 0 && canvas.Size() != videoSize {
+		if scaler, err = NewScaler(canvas.Size(), ScaleOptions{
+			Size:             videoSize,
+			PixelAspectRatio: opts.PixelAspectRatio,
+			Filter:           opts.ScaleFilter,
+		}); err != nil {
+			err = fmt.Errorf("invalid scale options: %w", err)
+			return
+		}
+	}
+	frameRate := opts.FrameRate.resolve(videoSize.Y)
+	if frameRate.nominal() == 0 {
+		err = fmt.Errorf("unsupported frame rate: %s", frameRate)
+		return
+	}
+	// Prepare the document
+	base := strings.TrimSuffix(filepath.Base(xmlFile), filepath.Ext(xmlFile))
+	document := bdnDocument{
+		Version:        bdnVersion,
+		XSI:            bdnXSINamespace,
+		SchemaLocation: bdnSchemaLocation,
+	}
+	document.Description.Name.Title = opts.Title
+	if document.Description.Name.Title == "" {
+		document.Description.Name.Title = base
+	}
+	document.Description.Language.Code = opts.Language
+	if document.Description.Language.Code == "" {
+		document.Description.Language.Code = bdnDefaultLanguage
+	}
+	document.Description.Format.VideoFormat = videoFormat.String()
+	document.Description.Format.FrameRate = frameRate.String()
+	document.Description.Format.DropFrame = bdnFalse
+	document.Description.Events.Type = bdnEventsType
+	// Write the images (errors report the subtitles by their index within subtitles)
+	order := startOrder(subtitles)
+	ordered := make([]Subtitle, len(order))
+	for position, index := range order {
+		ordered[position] = subtitles[index]
+	}
+	var (
+		img          image.Image
+		lastOutFrame int64
+		inFrame      int64
+		outFrame     int64
+		imageFile    string
+		imagesPath   = filepath.Dir(xmlFile)
+	)
+	for position, sub := range ordered {
+		if img, err = placedImage(sub, scaler); err != nil {
+			err = fmt.Errorf("failed to place subtitle #%d: %w", order[position]+1, err)
+			return
+		}
+		if img.Bounds().Empty() {
+			continue // nothing visible
+		}
+		// Timecodes
+		inFrame = max(frameRate.Frames(sub.Start), lastOutFrame)
+		outFrame = frameRate.Frames(displayStop(ordered, position))
+		if position+1 < len(ordered) {
+			outFrame = min(outFrame, frameRate.Frames(ordered[position+1].Start))
+		}
+		if outFrame <= inFrame {
+			continue // not displayed for a whole frame
+		}
+		lastOutFrame = outFrame
+		// Image
+		nbEvents++
+		imageFile = numberedImageFile(base, nbEvents)
+		if err = writePNG(filepath.Join(imagesPath, imageFile), img); err != nil {
+			err = fmt.Errorf("failed to write subtitle #%d image: %w", order[position]+1, err)
+			return
+		}
+		bounds := img.Bounds()
+		event := bdnEvent{
+			Forced: bdnFalse,
+			InTC:   frameRate.Timecode(frameRate.Timestamp(inFrame)),
+			OutTC:  frameRate.Timecode(frameRate.Timestamp(outFrame)),
+			Graphics: []bdnGraphic{{
+				Width:  bounds.Dx(),
+				Height: bounds.Dy(),
+				X:      bounds.Min.X,
+				Y:      bounds.Min.Y,
+				File:   imageFile,
+			}},
+		}
+		if sub.Forced {
+			event.Forced = bdnTrue
+		}
+		document.Events = append(document.Events, event)
+	}
+	if nbEvents > 0 {
+		document.Description.Events.FirstEventInTC = document.Events[0].InTC
+		document.Description.Events.LastEventOutTC = document.Events[nbEvents-1].OutTC
+	}
+	document.Description.Events.NumberofEvents = nbEvents
+	// Write the document
+	fd, err := os.Create(xmlFile)
+	if err != nil {
+		err = fmt.Errorf("failed to create XML file: %w", err)
+		return
+	}
+	defer fd.Close()
+	if _, err = fd.WriteString(xml.Header); err != nil {
+		err = fmt.Errorf("failed to write XML file: %w", err)
+		return
+	}
+	encoder := xml.NewEncoder(fd)
+	encoder.Indent("", "  ")
+	if err = encoder.Encode(document); err != nil {
+		err = fmt.Errorf("failed to write XML file: %w", err)
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close XML file: %w", err)
+	}
+	return
+}
+
+/*
+	Reading
+*/
+
+// parseBDNVideoFormat returns the video frame size of a BDN video format ("1080p", "1080i", "576i"...)
+func parseBDNVideoFormat(value string) (size image.Point, err error) {
+	lines, err := strconv.Atoi(strings.TrimRight(strings.TrimSpace(value), "ip"))
+	if err == nil {
+		var videoFormat BDNVideoFormat
+		if videoFormat, err = bdnVideoFormatFromHeight(lines); err == nil {
+			return videoFormat.Size(), nil
+		}
+	}
+	err = fmt.Errorf("unsupported video format: %q", value)
+	return
+}
+
+// ReadBDN reads a BDN XML document and its PNG images (relative to the XML file directory) and returns its subtitles
+// in presentation order. The images of each event graphics are composed within one image whose bounds are the graphics
+// position on the video, which becomes the canvas of the subtitles.
+func ReadBDN(xmlFile string) (subtitles []Subtitle, err error) {
+	data, err := os.ReadFile(xmlFile)
+	if err != nil {
+		err = fmt.Errorf("failed to read XML file: %w", err)
+		return
+	}
+	var document bdnDocument
+	if err = xml.Unmarshal(data, &document); err != nil {
+		err = fmt.Errorf("failed to parse XML file: %w", err)
+		return
+	}
+	videoSize, err := parseBDNVideoFormat(document.Description.Format.VideoFormat)
+	if err != nil {
+		return
+	}
+	frameRate, err := parseFrameRate(document.Description.Format.FrameRate)
+	if err != nil {
+		return
+	}
+	dropFrame := strings.EqualFold(document.Description.Format.DropFrame, bdnTrue)
+	imagesPath := filepath.Dir(xmlFile)
+	subtitles = make([]Subtitle, 0, len(document.Events))
+	for index, event := range document.Events {
+		if len(event.Graphics) == 0 {
+			continue
+		}
+		sub := Subtitle{
+			Forced: strings.EqualFold(event.Forced, bdnTrue),
+			Placement: Placement{
+				Canvas: image.Rectangle{Max: videoSize},
+			},
+		}
+		if sub.Start, err = frameRate.ParseTimecode(event.InTC, dropFrame); err != nil {
+			err = fmt.Errorf("event #%d: invalid InTC: %w", index+1, err)
+			return
+		}
+		if sub.Stop, err = frameRate.ParseTimecode(event.OutTC, dropFrame); err != nil {
+			err = fmt.Errorf("event #%d: invalid OutTC: %w", index+1, err)
+			return
+		}
+		if sub.Stop <= sub.Start {
+			err = fmt.Errorf("event #%d: OutTC %s is not after InTC %s", index+1, event.OutTC, event.InTC)
+			return
+		}
+		// Compose the graphics
+		graphics := make([]image.Image, len(event.Graphics))
+		for graphicIndex, graphic := range event.Graphics {
+			if graphics[graphicIndex], err = readPNG(filepath.Join(imagesPath, strings.TrimSpace(graphic.File))); err != nil {
+				err = fmt.Errorf("event #%d: failed to read graphic %q: %w", index+1, graphic.File, err)
+				return
+			}
+			sub.Placement.Area = sub.Placement.Area.Union(bdnGraphicRect(graphics[graphicIndex], graphic))
+		}
+		img := image.NewNRGBA(sub.Placement.Area)
+		for graphicIndex, graphic := range event.Graphics {
+			source := graphics[graphicIndex]
+			draw.Draw(img, bdnGraphicRect(source, graphic), source, source.Bounds().Min, draw.Over)
+		}
+		sub.Image = img
+		subtitles = append(subtitles, sub)
+	}
+	return sortedByStart(subtitles), nil
+}
+
+// bdnGraphicRect returns the rectangle covered by the image of a graphic on the video
+func bdnGraphicRect(img image.Image, graphic bdnGraphic) image.Rectangle {
+	return image.Rectangle{Max: img.Bounds().Size()}.Add(image.Point{X: graphic.X, Y: graphic.Y})
+}
+
+// ConvertBDN reads a BDN XML document and its PNG images and writes its subtitles as a new sub/idx pair at subFile
+// (see Encode()). Set opts.Scale to fit HD subtitles within a DVD video frame. It returns the number of subtitles read.
+func ConvertBDN(xmlFile, subFile string, opts EncodeOptions) (nbSubtitles int, err error) {
+	subtitles, err := ReadBDN(xmlFile)
+	if err != nil {
+		err = fmt.Errorf("failed to read BDN XML: %w", err)
+		return
+	}
+	if err = Encode(subFile, subtitles, opts); err != nil {
+		return
+	}
+	return len(subtitles), nil
+}
@@ -0,0 +1,109 @@
+package vobsub
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteBDNEmpty(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subs.xml")
+	if _, err := WriteBDN(file, nil, BDNOptions{}); err == nil || !strings.Contains(err.Error(), "set the video format") {
+		t.Errorf("expected an error asking for the video format, got: %v", err)
+	}
+	nbEvents, err := WriteBDN(file, nil, BDNOptions{VideoFormat: BDNVideoFormat1080p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbEvents != 0 {
+		t.Errorf("expected no events, got %d", nbEvents)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`VideoFormat="1080p"`, `NumberofEvents="0"`} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s in the document:\n%s", expected, data)
+		}
+	}
+	subtitles, err := ReadBDN(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subtitles) != 0 {
+		t.Errorf("expected no subtitles, got %d", len(subtitles))
+	}
+}
+
+func TestWriteBDNErrorIndex(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	subtitles := []Subtitle{
+		{Start: 2 * time.Second, Placement: Placement{Canvas: canvas}}, // no image
+		{Start: time.Second, Image: image.NewNRGBA(image.Rect(0, 0, 8, 8)), Placement: Placement{Canvas: canvas}},
+	}
+	_, err := WriteBDN(filepath.Join(t.TempDir(), "subs.xml"), subtitles, BDNOptions{})
+	if err == nil || !strings.Contains(err.Error(), "subtitle #1") {
+		t.Errorf("expected an error about subtitle #1, got: %v", err)
+	}
+}
+
+func TestBDNRoundTrip(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	img := testSubtitleImage(image.Rect(100, 480, 300, 510), 4)
+	placement := Placement{Area: img.Rect, Canvas: canvas}
+	subtitles := []Subtitle{
+		{Start: 3 * time.Second, Stop: 4600 * time.Millisecond, Forced: true, Image: img, Placement: placement},
+		{Start: time.Second, Stop: 2 * time.Second, Image: img, Placement: placement},
+	}
+	file := filepath.Join(t.TempDir(), "subs.xml")
+	nbEvents, err := WriteBDN(file, subtitles, BDNOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbEvents != 2 {
+		t.Fatalf("expected 2 events, got %d", nbEvents)
+	}
+	read, err := ReadBDN(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("expected 2 subtitles, got %d", len(read))
+	}
+	for index, expected := range []Subtitle{subtitles[1], subtitles[0]} {
+		sub := read[index]
+		if sub.Start != expected.Start || sub.Stop != expected.Stop || sub.Forced != expected.Forced {
+			t.Errorf("subtitle #%d: expected %v-%v forced %v, got %v-%v forced %v", index+1,
+				expected.Start, expected.Stop, expected.Forced, sub.Start, sub.Stop, sub.Forced)
+		}
+		if sub.Placement.Canvas != canvas || sub.Placement.Area != img.Rect {
+			t.Errorf("subtitle #%d: expected area %v in %v, got %v in %v", index+1,
+				img.Rect, canvas, sub.Placement.Area, sub.Placement.Canvas)
+			continue
+		}
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if got := color.NRGBAModel.Convert(sub.Image.At(x, y)); got != img.NRGBAAt(x, y) {
+					t.Fatalf("subtitle #%d: expected %v at (%d,%d), got %v", index+1, img.NRGBAAt(x, y), x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestReadBDNInvalidEvent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subs.xml")
+	document := `<BDN Version="0.93"><Description><Format VideoFormat="1080p" FrameRate="23.976" DropFrame="False"/></Description>
+<Events><Event InTC="00:00:02:00" OutTC="00:00:02:00" Forced="False"><Graphic Width="1" Height="1" X="0" Y="0">subs_0001.png</Graphic></Event></Events></BDN>`
+	if err := os.WriteFile(file, []byte(document), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBDN(file); err == nil || !strings.Contains(err.Error(), "is not after InTC") {
+		t.Errorf("expected an OutTC error, got: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package vobsub
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// binarizeMinAlpha is the minimum alpha (out of 0xffff) of a visible color: fainter ones are background
+	binarizeMinAlpha = 0xffff / 2
+	// binarizeMinContrast is the minimum luminance difference (out of 0xffff) between the visible colors
+	// for them to be split between text and outline. Otherwise they all are text.
+	binarizeMinContrast = 0xffff / 8
+)
+
+// BinarizeOptions defines the OCR friendly images generated from the subtitles.
+// Each color is classified using its alpha and luminance: faint colors are background, then the visible ones are split
+// between text and outline around the middle of their luminance range (anti-aliasing colors go to the closest one).
+type BinarizeOptions struct {
+	// DarkText must be set if the text is darker than its outline (the text is the brightest by default)
+	DarkText bool
+	// Inverse generates white text on a black background instead of black text on a white background
+	Inverse bool
+	// OneBit generates 2 colors *image.Paletted images instead of *image.Gray images
+	OneBit bool
+	// Padding is the number of background pixels added around the image (after upscaling)
+	Padding int
+	// Upscale is the integer factor used to magnify the image, 0 or 1 keeps its size
+	Upscale int
+}
+
+// Rect returns the bounds of the binarized image of an image with bounds r.
+func (opts BinarizeOptions) Rect(r image.Rectangle) image.Rectangle {
+	factor := max(1, opts.Upscale)
+	return image.Rectangle{Min: r.Min.Mul(factor), Max: r.Max.Mul(factor)}.Inset(-max(0, opts.Padding))
+}
+
+// Binarize returns the OCR friendly version of img (see BinarizeOptions).
+func Binarize(img image.Image, opts BinarizeOptions) image.Image {
+	if paletted, ok := img.(*image.Paletted); ok {
+		return binarizePaletted(paletted, nil, opts)
+	}
+	// Classify the colors present in the image
+	bounds := img.Bounds()
+	var (
+		colors  []color.Color
+		indexes = make(map[color.Color]int)
+	)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := img.At(x, y)
+			if _, found := indexes[pixel]; !found {
+				indexes[pixel] = len(colors)
+				colors = append(colors, pixel)
+			}
+		}
+	}
+	text := classifyText(colors, opts.DarkText)
+	return binarize(bounds, func(x, y int) bool { return text[indexes[img.At(x, y)]] }, opts)
+}
+
+// binarizePaletted binarizes a paletted image (a rasterized subtitle): its palette colors (the subtitle color slots)
+// are classified and its pixels mapped by index. If scaler is not nil, the text mask is scaled then thresholded.
+func binarizePaletted(img *image.Paletted, scaler *Scaler, opts BinarizeOptions) image.Image {
+	text := make([]bool, 256)
+	copy(text, classifyText(img.Palette, opts.DarkText))
+	if scaler == nil {
+		return binarize(img.Rect, func(x, y int) bool { return text[img.Pix[img.PixOffset(x, y)]] }, opts)
+	}
+	mask := image.NewPaletted(img.Rect, color.Palette{color.Transparent, color.White})
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if text[img.Pix[img.PixOffset(x, y)]] {
+				mask.Pix[mask.PixOffset(x, y)] = 1
+			}
+		}
+	}
+	scaled := toRGBA(scaler.Scale(mask))
+	return binarize(scaled.Rect, func(x, y int) bool {
+		return uint32(scaled.Pix[scaled.PixOffset(x, y)+3])*0x101 >= binarizeMinAlpha
+	}, opts)
+}
+
+// binarize draws the binarized image of bounds, isText telling which pixels are ink
+func binarize(bounds image.Rectangle, isText func(x, y int) bool, opts BinarizeOptions) image.Image {
+	factor := max(1, opts.Upscale)
+	// Prepare the output
+	ink, paper := uint8(0x00), uint8(0xff)
+	if opts.Inverse {
+		ink, paper = paper, ink
+	}
+	output := opts.Rect(bounds)
+	var (
+		pix    []uint8
+		stride int
+		result image.Image
+	)
+	if opts.OneBit {
+		inkIndex, paperIndex := uint8(0), uint8(1)
+		paletted := image.NewPaletted(output, color.Palette{color.Gray{Y: ink}, color.Gray{Y: paper}})
+		pix, stride, result = paletted.Pix, paletted.Stride, paletted
+		ink, paper = inkIndex, paperIndex
+	} else {
+		gray := image.NewGray(output)
+		pix, stride, result = gray.Pix, gray.Stride, gray
+	}
+	for i := range pix {
+		pix[i] = paper
+	}
+	// Draw the text pixels
+	originX, originY := bounds.Min.X*factor-output.Min.X, bounds.Min.Y*factor-output.Min.Y
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !isText(x, y) {
+				continue
+			}
+			for dy := range factor {
+				offset := (originY+(y-bounds.Min.Y)*factor+dy)*stride + originX + (x-bounds.Min.X)*factor
+				for dx := range factor {
+					pix[offset+dx] = ink
+				}
+			}
+		}
+	}
+	return result
+}
+
+// classifyText returns which colors (by index) are considered as text
+func classifyText(colors []color.Color, darkText bool) (text []bool) {
+	text = make([]bool, len(colors))
+	lumas := make([]uint32, len(colors))
+	var (
+		minLuma, maxLuma uint32 = 0xffff, 0
+		visible          bool
+	)
+	for index, c := range colors {
+		if _, _, _, a := c.RGBA(); a < binarizeMinAlpha {
+			continue
+		}
+		lumas[index] = luminance(c)
+		minLuma, maxLuma = min(minLuma, lumas[index]), max(maxLuma, lumas[index])
+		visible = true
+	}
+	if !visible {
+		return
+	}
+	threshold := (minLuma + maxLuma) / 2
+	for index, c := range colors {
+		if _, _, _, a := c.RGBA(); a < binarizeMinAlpha {
+			continue
+		}
+		switch {
+		case maxLuma-minLuma < binarizeMinContrast:
+			text[index] = true
+		case darkText:
+			text[index] = lumas[index] <= threshold
+		default:
+			text[index] = lumas[index] > threshold
+		}
+	}
+	return
+}
+
+// luminance returns the BT.601 luma (0 to 0xffff) of the non alpha premultiplied color
+func luminance(c color.Color) uint32 {
+	nrgba := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	return (299*uint32(nrgba.R) + 587*uint32(nrgba.G) + 114*uint32(nrgba.B)) / 1000
+}
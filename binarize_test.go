@@ -0,0 +1,59 @@
+package vobsub
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBinarizeScaled(t *testing.T) {
+	palette := testPalette()
+	palette[1] = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	palette[2] = color.NRGBA{A: 0xff}
+	metadata := testMetadata(palette)
+	// White text inside a black outline
+	img := image.NewPaletted(image.Rect(100, 480, 140, 500), color.Palette{color.Transparent, color.White, color.Black})
+	for y := 482; y < 498; y++ {
+		for x := 102; x < 138; x++ {
+			img.SetColorIndex(x, y, 2)
+			if y >= 486 && y < 494 && x >= 106 && x < 134 {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	raw, err := NewSubtitleRaw(img, palette, EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{0, 15, 15, 15},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []ScaleFilter{ScaleFilterNearest, ScaleFilterBilinear, ScaleFilterLanczos, ScaleFilterScale2x} {
+		binarized, _, _, err := raw.DecodeWithOptions(metadata, RenderOptions{
+			Scale:    &ScaleOptions{Size: image.Pt(1440, 1152), Filter: filter},
+			Binarize: &BinarizeOptions{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gray, ok := binarized.(*image.Gray)
+		if !ok {
+			t.Fatalf("%s filter: got a %T image", filter, binarized)
+		}
+		if gray.Rect != image.Rect(200, 960, 280, 1000) {
+			t.Errorf("%s filter: unexpected bounds %v", filter, gray.Rect)
+		}
+		for _, check := range []struct {
+			point image.Point
+			ink   bool
+		}{
+			{image.Pt(240, 980), true},  // text
+			{image.Pt(208, 980), false}, // outline
+			{image.Pt(201, 961), false}, // background
+		} {
+			if ink := gray.GrayAt(check.point.X, check.point.Y).Y == 0; ink != check.ink {
+				t.Errorf("%s filter: pixel %v is ink: %v, expected %v", filter, check.point, ink, check.ink)
+			}
+		}
+	}
+}
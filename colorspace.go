@@ -0,0 +1,243 @@
+package vobsub
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// ColorMatrix selects the coefficients used to convert between RGB and YCbCr
+type ColorMatrix int
+
+const (
+	// ColorMatrixBT601 is used by standard definition video (DVD, DVB SD)
+	ColorMatrixBT601 ColorMatrix = iota
+	// ColorMatrixBT709 is used by high definition video (Blu-ray, DVB HD)
+	ColorMatrixBT709
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (cm ColorMatrix) String() string {
+	switch cm {
+	case ColorMatrixBT601:
+		return "BT.601"
+	case ColorMatrixBT709:
+		return "BT.709"
+	default:
+		return "Unknown"
+	}
+}
+
+// coefficients returns the red and blue luma coefficients of the matrix
+func (cm ColorMatrix) coefficients() (kr, kb float64) {
+	if cm == ColorMatrixBT709 {
+		return 0.2126, 0.0722
+	}
+	return 0.299, 0.114
+}
+
+// ColorRange selects the range of the YCbCr values
+type ColorRange int
+
+const (
+	// ColorRangeLimited uses 16-235 for luma and 16-240 for chroma (video range)
+	ColorRangeLimited ColorRange = iota
+	// ColorRangeFull uses 0-255 for all components (PC range)
+	ColorRangeFull
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (cr ColorRange) String() string {
+	switch cr {
+	case ColorRangeLimited:
+		return "Limited"
+	case ColorRangeFull:
+		return "Full"
+	default:
+		return "Unknown"
+	}
+}
+
+// YCbCrSpace defines how YCbCr values map to RGB ones
+type YCbCrSpace struct {
+	Matrix ColorMatrix
+	Range  ColorRange
+}
+
+// Color spaces of the palettes found in common subtitles formats
+var (
+	// YCbCrSpaceDVD is used by DVD palettes (IFO files, MP4 esds)
+	YCbCrSpaceDVD = YCbCrSpace{Matrix: ColorMatrixBT601, Range: ColorRangeLimited}
+	// YCbCrSpaceBluRay is used by Blu-ray palettes (PGS) of high definition subtitles
+	YCbCrSpaceBluRay = YCbCrSpace{Matrix: ColorMatrixBT709, Range: ColorRangeLimited}
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (space YCbCrSpace) String() string {
+	return fmt.Sprintf("%s %s range", space.Matrix, space.Range)
+}
+
+// YCbCrColor is a YCbCr color with an alpha channel (not premultiplied). Unlike the color.YCbCr types
+// of the standard library, its meaning depends on the YCbCrSpace it is used with.
+type YCbCrColor struct {
+	Y, Cb, Cr, A uint8
+}
+
+// scales returns the luma scale, chroma scale and luma offset of the range
+func (space YCbCrSpace) scales() (lumaScale, chromaScale, lumaOffset float64) {
+	if space.Range == ColorRangeFull {
+		return 1, 1, 0
+	}
+	return 219.0 / 255, 224.0 / 255, 16
+}
+
+// FromRGB converts a color to YCbCr. Colors are taken as not alpha premultiplied.
+func (space YCbCrSpace) FromRGB(c color.Color) YCbCrColor {
+	rgb := color.NRGBAModel.Convert(c).(color.NRGBA)
+	kr, kb := space.Matrix.coefficients()
+	lumaScale, chromaScale, lumaOffset := space.scales()
+	r, g, b := float64(rgb.R), float64(rgb.G), float64(rgb.B)
+	y := kr*r + (1-kr-kb)*g + kb*b
+	return YCbCrColor{
+		Y:  clampComponent(lumaOffset + lumaScale*y),
+		Cb: clampComponent(128 + chromaScale*(b-y)/(2*(1-kb))),
+		Cr: clampComponent(128 + chromaScale*(r-y)/(2*(1-kr))),
+		A:  rgb.A,
+	}
+}
+
+// ToRGB converts a YCbCr color to RGB. Out of range values are clamped.
+func (space YCbCrSpace) ToRGB(c YCbCrColor) color.NRGBA {
+	kr, kb := space.Matrix.coefficients()
+	lumaScale, chromaScale, lumaOffset := space.scales()
+	y := (float64(c.Y) - lumaOffset) / lumaScale
+	cb := (float64(c.Cb) - 128) / chromaScale
+	cr := (float64(c.Cr) - 128) / chromaScale
+	r := y + 2*(1-kr)*cr
+	b := y + 2*(1-kb)*cb
+	g := (y - kr*r - kb*b) / (1 - kr - kb)
+	return color.NRGBA{
+		R: clampComponent(r),
+		G: clampComponent(g),
+		B: clampComponent(b),
+		A: c.A,
+	}
+}
+
+func clampComponent(value float64) uint8 {
+	return uint8(min(max(math.Round(value), 0), 0xff))
+}
+
+// Palette is a palette natively stored either as RGB or as YCbCr colors: converting it to its native representation
+// is lossless, allowing colors to survive round trips between formats using different representations.
+type Palette struct {
+	// Space is the color space used for the YCbCr representation
+	Space YCbCrSpace
+	rgb   []color.NRGBA
+	ycbcr []YCbCrColor
+}
+
+// NewRGBPalette returns a palette natively stored as RGB colors, converted to YCbCr using space.
+func NewRGBPalette(palette color.Palette, space YCbCrSpace) Palette {
+	colors := make([]color.NRGBA, len(palette))
+	for index, paletteColor := range palette {
+		colors[index] = color.NRGBAModel.Convert(paletteColor).(color.NRGBA)
+	}
+	return Palette{
+		Space: space,
+		rgb:   colors,
+	}
+}
+
+// NewYCbCrPalette returns a palette natively stored as YCbCr colors of the space color space.
+func NewYCbCrPalette(colors []YCbCrColor, space YCbCrSpace) Palette {
+	return Palette{
+		Space: space,
+		ycbcr: append([]YCbCrColor(nil), colors...),
+	}
+}
+
+// NewDVDPalette returns the palette of a DVD from its 16 entries as stored in IFO files and MP4 esds: 0x00YYCrCb.
+// DVD palettes do not carry transparency (set by the subtitles themselves): colors are opaque.
+func NewDVDPalette(entries []uint32) Palette {
+	colors := make([]YCbCrColor, len(entries))
+	for index, entry := range entries {
+		colors[index] = YCbCrColor{
+			Y:  uint8(entry >> 16),
+			Cr: uint8(entry >> 8),
+			Cb: uint8(entry),
+			A:  0xff,
+		}
+	}
+	return Palette{
+		Space: YCbCrSpaceDVD,
+		ycbcr: colors,
+	}
+}
+
+// Len returns the number of colors of the palette.
+func (p Palette) Len() int {
+	if p.ycbcr != nil {
+		return len(p.ycbcr)
+	}
+	return len(p.rgb)
+}
+
+// IsYCbCr returns true if the palette is natively stored as YCbCr colors.
+func (p Palette) IsYCbCr() bool {
+	return p.ycbcr != nil
+}
+
+// RGB returns the palette as RGB colors (color.NRGBA entries), ready to be used as IdxMetadata.Palette.
+func (p Palette) RGB() (palette color.Palette) {
+	palette = make(color.Palette, p.Len())
+	for index := range palette {
+		palette[index] = p.RGBAt(index)
+	}
+	return
+}
+
+// RGBAt returns the color at index as RGB.
+func (p Palette) RGBAt(index int) color.NRGBA {
+	if p.ycbcr != nil {
+		return p.Space.ToRGB(p.ycbcr[index])
+	}
+	return p.rgb[index]
+}
+
+// YCbCr returns the palette as YCbCr colors of its color space.
+func (p Palette) YCbCr() (colors []YCbCrColor) {
+	colors = make([]YCbCrColor, p.Len())
+	for index := range colors {
+		colors[index] = p.YCbCrAt(index)
+	}
+	return
+}
+
+// YCbCrAt returns the color at index as YCbCr.
+func (p Palette) YCbCrAt(index int) YCbCrColor {
+	if p.ycbcr != nil {
+		return p.ycbcr[index]
+	}
+	return p.Space.FromRGB(p.rgb[index])
+}
+
+// DVD returns the palette entries as stored in IFO files and MP4 esds (0x00YYCrCb), using the DVD color space.
+func (p Palette) DVD() (entries []uint32) {
+	converted := p
+	if p.ycbcr == nil || p.Space != YCbCrSpaceDVD {
+		converted = NewRGBPalette(p.RGB(), YCbCrSpaceDVD)
+	}
+	entries = make([]uint32, converted.Len())
+	for index := range entries {
+		c := converted.YCbCrAt(index)
+		entries[index] = uint32(c.Y)<<16 | uint32(c.Cr)<<8 | uint32(c.Cb)
+	}
+	return
+}
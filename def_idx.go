@@ -8,6 +8,7 @@ import (
 	"image"
 	"image/color"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +28,10 @@ const (
 	idxLangIdxPrefix    = "langidx: "
 	idxPalettePrefix    = "palette: "
 	idxPaletteLen       = 16
+	idxIDPrefix         = "id: "
+	idxIDIndexSeparator = ", index: "
+	idxHeader           = "# VobSub index file, v7 (do not modify this line!)"
+	idxDefaultAlign     = "OFF at LEFT TOP"
 )
 
 // IdxMetadata contains the index metadata of a sub file (.idx file)
@@ -38,9 +43,10 @@ type IdxMetadata struct {
 	FadeIn, FadeOut time.Duration
 	Align           string // not supported yet
 	TimeOffset      time.Duration
-	ForcedSubs      bool
+	ForcedSubs      bool // players should only display the forced subtitles
 	LangIdx         int
-	Palette         color.Palette
+	Palette         color.Palette  // ParseIdx() entries are color.NRGBA: the idx RGB values with the alpha ratio
+	Languages       map[int]string // language code of each stream, by stream ID
 }
 
 // ParseIdx scans a reader to extract the index metadata of a sub file (.idx file)
@@ -190,13 +196,29 @@ func ParseIdx(reader io.Reader) (metadata IdxMetadata, err error) {
 					err = fmt.Errorf("failed to decode the palette hex color at index #%d: %w", index, err)
 					return
 				}
-				metadata.Palette[index] = color.RGBA{
+				metadata.Palette[index] = color.NRGBA{
 					R: colorValues[0],
 					G: colorValues[1],
 					B: colorValues[2],
 					A: mainAlpha,
 				}
 			}
+		// Stream language
+		case strings.HasPrefix(line, idxIDPrefix):
+			values := strings.Split(line[len(idxIDPrefix):], idxIDIndexSeparator)
+			if len(values) != 2 {
+				err = fmt.Errorf("expecting stream id line to have a language and an index: %q", line)
+				return
+			}
+			var streamID int
+			if streamID, err = strconv.Atoi(values[1]); err != nil {
+				err = fmt.Errorf("failed to convert stream index to integer: %w", err)
+				return
+			}
+			if metadata.Languages == nil {
+				metadata.Languages = make(map[int]string, 1)
+			}
+			metadata.Languages[streamID] = values[0]
 		default:
 			// skip line
 		}
@@ -207,3 +229,92 @@ func ParseIdx(reader io.Reader) (metadata IdxMetadata, err error) {
 	}
 	return
 }
+
+// IdxStream describes a subtitle stream of a .sub file and the position of each of its subtitles
+type IdxStream struct {
+	Language string // 2 letters language code
+	ID       int    // subtitle stream ID
+	Entries  []IdxEntry
+}
+
+// IdxEntry references a subtitle within the .sub file
+type IdxEntry struct {
+	Timestamp time.Duration // subtitle PTS
+	FilePos   int64         // position of the subtitle first pack within the .sub file (as returned by SubWriter.WriteSubtitle())
+}
+
+// WriteIdx writes the index metadata and the streams entries of a sub file (.idx file).
+// An unset (0) alpha ratio is written as 100%.
+func WriteIdx(writer io.Writer, metadata IdxMetadata, streams []IdxStream) (err error) {
+	if len(metadata.Palette) != idxPaletteLen {
+		return fmt.Errorf("palette should have %d colors, currently %d", idxPaletteLen, len(metadata.Palette))
+	}
+	buffer := bufio.NewWriter(writer)
+	// Metadata
+	fmt.Fprintln(buffer, idxHeader)
+	fmt.Fprintln(buffer)
+	fmt.Fprintf(buffer, "%s%dx%d\n", idxSizePrefix, metadata.Width, metadata.Height)
+	fmt.Fprintf(buffer, "%s%d, %d\n", idxOriginPrefix, metadata.Origin.X, metadata.Origin.Y)
+	alphaRatio := metadata.AlphaRatio
+	if alphaRatio == 0 {
+		alphaRatio = 1 // unset, a 0% alpha ratio is invalid anyway
+	}
+	fmt.Fprintf(buffer, "%s%d%%\n", idxAlphaRatioPrefix, int(math.Round(alphaRatio*100)))
+	fmt.Fprintf(buffer, "%s%s\n", idxSmoothPrefix, idxOnOff(metadata.Smooth))
+	fmt.Fprintf(buffer, "%s%d, %d\n", idxFadePrefix, metadata.FadeIn/idxFadeUnit, metadata.FadeOut/idxFadeUnit)
+	align := metadata.Align
+	if align == "" {
+		align = idxDefaultAlign
+	}
+	fmt.Fprintf(buffer, "%s%s\n", idxAlignPrefix, align)
+	fmt.Fprintf(buffer, "%s%d\n", idxTimeOffsetPrefix, metadata.TimeOffset/idxTimeOffsetUnit)
+	fmt.Fprintf(buffer, "%s%s\n", idxForcedSubsPrefix, idxOnOff(metadata.ForcedSubs))
+	colors := make([]string, len(metadata.Palette))
+	for index, paletteColor := range metadata.Palette {
+		nrgba := color.NRGBAModel.Convert(paletteColor).(color.NRGBA)
+		colors[index] = hex.EncodeToString([]byte{nrgba.R, nrgba.G, nrgba.B})
+	}
+	fmt.Fprintf(buffer, "%s%s\n", idxPalettePrefix, strings.Join(colors, ", "))
+	fmt.Fprintln(buffer)
+	fmt.Fprintf(buffer, "%s%d\n", idxLangIdxPrefix, metadata.LangIdx)
+	// Streams
+	for _, stream := range streams {
+		fmt.Fprintln(buffer)
+		fmt.Fprintf(buffer, "%s%s%s%d\n", idxIDPrefix, stream.Language, idxIDIndexSeparator, stream.ID)
+		for _, entry := range stream.Entries {
+			fmt.Fprintf(buffer, "timestamp: %s, filepos: %09x\n", formatIdxTimestamp(entry.Timestamp), entry.FilePos)
+		}
+	}
+	if err = buffer.Flush(); err != nil {
+		return fmt.Errorf("failed to write Idx content: %w", err)
+	}
+	return
+}
+
+func idxOnOff(value bool) string {
+	if value {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// formatIdxTimestamp formats a timestamp as expected by .idx files: hh:mm:ss:mmm
+func formatIdxTimestamp(timestamp time.Duration) string {
+	return formatTimestamp(timestamp, 2, ':', 3)
+}
+
+// formatTimestamp formats a timestamp as hh:mm:ss followed by separator and precision digits of fractional seconds
+// (truncated). Hours are padded to hourDigits. Negative timestamps are formatted as 0.
+func formatTimestamp(timestamp time.Duration, hourDigits int, separator byte, precision int) string {
+	timestamp = max(timestamp, 0)
+	unit := time.Second
+	for range precision {
+		unit /= 10
+	}
+	return fmt.Sprintf("%0*d:%02d:%02d%c%0*d",
+		hourDigits, timestamp/time.Hour,
+		timestamp%time.Hour/time.Minute,
+		timestamp%time.Minute/time.Second,
+		separator, precision, timestamp%time.Second/unit,
+	)
+}
@@ -0,0 +1,44 @@
+package vobsub
+
+import (
+	"bytes"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestIdxPaletteRoundTrip(t *testing.T) {
+	palette := testPalette()
+	palette[1] = color.RGBA{R: 0x40, A: 0x80} // alpha premultiplied: idx RGB is 7f0000
+	metadata := testMetadata(palette)
+	metadata.AlphaRatio = 0.5
+	var written bytes.Buffer
+	if err := WriteIdx(&written, metadata, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(written.String(), "palette: 00ff00, 7f0000,") {
+		t.Fatalf("unexpected palette line:\n%s", written.String())
+	}
+	parsed, err := ParseIdx(bytes.NewReader(written.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, paletteColor := range parsed.Palette {
+		nrgba, ok := paletteColor.(color.NRGBA)
+		if !ok {
+			t.Fatalf("palette entry #%d is a %T", index, paletteColor)
+		}
+		expected := color.NRGBAModel.Convert(palette[index]).(color.NRGBA)
+		if nrgba.R != expected.R || nrgba.G != expected.G || nrgba.B != expected.B || nrgba.A != 127 {
+			t.Errorf("palette entry #%d: got %v, expected the %v RGB values with the alpha ratio", index, nrgba, expected)
+		}
+	}
+	// Rewriting the parsed palette keeps its RGB values
+	var rewritten bytes.Buffer
+	if err = WriteIdx(&rewritten, parsed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rewritten.String() != written.String() {
+		t.Errorf("rewritten idx differs:\n%s\nexpected:\n%s", rewritten.String(), written.String())
+	}
+}
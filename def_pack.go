@@ -10,6 +10,10 @@ const (
 	SCRFrequency = 27_000_000 // 27 MHz
 	// PTSDTSClockFrequency is the Presentation TimeStamp and Decoding TimeStamp clock base frequency
 	PTSDTSClockFrequency = 90_000 // 90 kHz
+	// ProgramMuxRateDVD is the program mux rate (in units of 50 bytes/second) commonly used by DVD subtitles streams: 10.08 Mbps
+	ProgramMuxRateDVD = 25_200
+	// PackSize is the fixed size of a DVD pack (including its pack header)
+	PackSize = 2048
 )
 
 // PackHeader contains the data of the MPEG pack header. It itselfs contains a new MPEG header.
@@ -19,6 +23,28 @@ type PackHeader struct {
 	Remaining [10]byte
 }
 
+// NewPackHeader creates a pack header (without stuffing bytes) with the given System Clock Reference and program mux rate
+func NewPackHeader(scr time.Duration, programMuxRate uint64) (ph PackHeader) {
+	ph.MPH = MPEGHeader{0x00, 0x00, 0x01, StreamIDPackHeader}
+	ticks := uint64(scr/time.Second)*SCRFrequency + uint64(scr%time.Second)*SCRFrequency/uint64(time.Second) // avoid overflow
+	quotient := ticks / (SCRFrequency / PTSDTSClockFrequency)
+	remainder := ticks % (SCRFrequency / PTSDTSClockFrequency)
+	// SCR
+	ph.Remaining[0] = 0b01000100 | byte(quotient>>27)&0b00111000 | byte(quotient>>28)&0b00000011
+	ph.Remaining[1] = byte(quotient >> 20)
+	ph.Remaining[2] = 0b00000100 | byte(quotient>>12)&0b11111000 | byte(quotient>>13)&0b00000011
+	ph.Remaining[3] = byte(quotient >> 5)
+	ph.Remaining[4] = 0b00000100 | byte(quotient<<3)&0b11111000 | byte(remainder>>7)&0b00000011
+	ph.Remaining[5] = 0b00000001 | byte(remainder<<1)
+	// Program mux rate
+	ph.Remaining[6] = byte(programMuxRate >> 14)
+	ph.Remaining[7] = byte(programMuxRate >> 6)
+	ph.Remaining[8] = 0b00000011 | byte(programMuxRate<<2)
+	// Reserved bits and no stuffing bytes
+	ph.Remaining[9] = 0b11111000
+	return
+}
+
 // Validate check if the data within the PackHeader are valid
 func (ph PackHeader) Validate() error {
 	if err := ph.MPH.Validate(); err != nil {
@@ -21,9 +21,37 @@ func (pesp PESPacket) ExtractSubtitle() (subtitle SubtitleRaw, err error) {
 		err = fmt.Errorf("the packet stream ID (%s) does not match the expected private stream 1", pesp.Header.MPH.StreamID())
 		return
 	}
+	// Scrambled payloads would only produce garbage, report them as such
+	if pesp.Scrambled() {
+		err = &ScrambledError{
+			SubtitleID: pesp.Header.SubStreamID.SubtitleID(),
+			Control:    pesp.ScramblingControl(),
+			Packets:    1,
+		}
+		return
+	}
 	return extractRawSubtitle(pesp)
 }
 
+// ScramblingControl returns the scrambling control of the packet. Packets without PES extension can not be scrambled.
+func (pesp PESPacket) ScramblingControl() ScramblingControl {
+	if pesp.Header.Extension == nil {
+		return ScramblingControlNotScrambled
+	}
+	return pesp.Header.Extension.ScramblingControl()
+}
+
+// Scrambled returns true if the packet payload is scrambled (CSS) and must be decrypted before being used.
+func (pesp PESPacket) Scrambled() bool {
+	return pesp.ScramblingControl() != ScramblingControlNotScrambled
+}
+
+// HasPTS returns true if the packet carries a Presentation Time Stamp (whatever its value).
+// Within a subtitle stream, it marks the first packet of a subtitle.
+func (pesp PESPacket) HasPTS() bool {
+	return pesp.Header.Extension != nil && pesp.Header.Extension.PTSDTSPresence()&JustPTS == JustPTS
+}
+
 // PESHeader represents the headers and associated data of aPacketized Elementary Stream header.
 // More infos on https://dvd.sourceforge.net/dvdinfo/pes-hdr.html
 type PESHeader struct {
@@ -416,6 +444,20 @@ func (sc ScramblingControl) GoString() string {
 	return fmt.Sprintf("%s (%02b)", sc.String(), sc)
 }
 
+// ScrambledError is returned when subtitle payloads are scrambled (CSS) and therefore can not be decoded.
+// Sources producing this error must go through a decryption step first.
+type ScrambledError struct {
+	SubtitleID int               // the subtitle stream the scrambled payloads belong to
+	Control    ScramblingControl // the scrambling control of the first scrambled packet encountered
+	Packets    int               // the number of scrambled packets encountered for this stream
+}
+
+// Error implements the error interface.
+func (se *ScrambledError) Error() string {
+	return fmt.Sprintf("subtitle stream #%d is scrambled (%s): %d scrambled packet(s) found",
+		se.SubtitleID, se.Control, se.Packets)
+}
+
 // PTSDTSPresence is the presence of PTS and DTS (or not)
 type PTSDTSPresence byte
 
@@ -485,6 +527,18 @@ func (pesed *PESExtensionData) ComputePTS() (pts time.Duration) {
 	return time.Duration(ticks * uint64(time.Second) / PTSDTSClockFrequency)
 }
 
+// SetPTS encodes the Presentation Time Stamp value (the PTS/DTS presence flags of the extension header must be set accordingly)
+func (pesed *PESExtensionData) SetPTS(pts time.Duration) {
+	ticks := uint64(pts) * PTSDTSClockFrequency / uint64(time.Second)
+	pesed.PTS = []byte{
+		0b00100001 | byte(ticks>>29)&0b00001110,
+		byte(ticks >> 22),
+		0b00000001 | byte(ticks>>14)&0b11111110,
+		byte(ticks >> 7),
+		0b00000001 | byte(ticks<<1)&0b11111110,
+	}
+}
+
 // ComputeDTS computes the Decode Time Stamp value
 func (pesed *PESExtensionData) ComputeDTS() (pts time.Duration) {
 	if len(pesed.PTS) == 0 {
@@ -1,27 +1,69 @@
 package vobsub
 
 import (
+	"cmp"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"slices"
 	"strings"
 	"time"
 )
 
 // Subtitle is the final, high level, representation of a subtitle
 type Subtitle struct {
-	Start time.Duration
-	Stop  time.Duration
-	Image image.Image
+	Start     time.Duration
+	Stop      time.Duration
+	Forced    bool // forced subtitles are meant to be displayed even if subtitles are turned off (foreign parts only)
+	Image     image.Image
+	Placement Placement
+	// Text is the recognized text of the image, if OCR has been requested (see DecodeOptions.OCR and OCR for details)
+	Text string
+	OCR  *OCRResult
+}
+
+// Placement describes where a subtitle is displayed on the video.
+// The SPU coordinates define the subtitle display area (both corners included), which is moved by the idx "org" offset:
+// the result is the area covered by the subtitle on the canvas (the video frame, sized by the idx "size" unless overridden).
+// Full size images are the canvas with the subtitle drawn at Area, anything outside the canvas being cut.
+// Other images keep the SPU coordinates as bounds: move them by Offset (the idx origin) to place them.
+type Placement struct {
+	Area   image.Rectangle // subtitle display area on the canvas
+	Canvas image.Rectangle // from (0, 0) to the canvas size
+	Offset image.Point     // translation from the image bounds to the canvas, zero for full size images
+}
+
+// Clipped returns true if a part of the subtitle display area is outside the canvas (and cut from full size images).
+func (p Placement) Clipped() bool {
+	return !p.Area.In(p.Canvas)
+}
+
+// Visible returns the part of the subtitle display area within the canvas.
+func (p Placement) Visible() image.Rectangle {
+	return p.Area.Intersect(p.Canvas)
+}
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (p Placement) String() string {
+	if p.Clipped() {
+		return fmt.Sprintf("%v on %v canvas (clipped to %v)", p.Area, p.Canvas.Size(), p.Visible())
+	}
+	return fmt.Sprintf("%v on %v canvas", p.Area, p.Canvas.Size())
 }
 
 const (
 	subtitleHeaderLength                  = 2
 	subtitleHeaderDataLength              = 2
 	subtitleHeadersTotalLen               = subtitleHeaderLength + subtitleHeaderDataLength
+	subtitleMaxSize                       = 53220 // SPU buffer size of DVD players (the size header could address 0xffff bytes)
 	subtitleCTRLSeqDateLen                = 2
+	subtitleCTRLSeqDateUnit               = time.Second / 100
+	subtitleCTRLSeqNextOffsetLen          = 2
 	subtitleCTRLSeqCmdForceDisplaying     = 0x00
 	subtitleCTRLSeqCmdStartDate           = 0x01
 	subtitleCTRLSeqCmdStopDate            = 0x02
@@ -34,6 +76,12 @@ const (
 	subtitleCTRLSeqCmdCoordinatesArgsLen  = 6
 	subtitleCTRLSeqCmdRLEOffsets          = 0x06
 	subtitleCTRLSeqCmdRLEOffsetsArgsLen   = 4
+	subtitleCTRLSeqCmdColorContrast       = 0x07
+	subtitleCTRLSeqCmdColorContrastSize   = 2
+	subtitleColorContrastLinesLen         = 4
+	subtitleColorContrastLinesEnd         = 0x0fffffff
+	subtitleColorContrastChangeLen        = 6
+	subtitleColorContrastMaxChanges       = 0x0f // number of column changes is encoded on 4 bits
 	subtitleCTRLSeqCmdEnd                 = 0xff
 )
 
@@ -44,103 +92,586 @@ type SubtitleRaw struct {
 	ControlSequences []ControlSequence
 }
 
+// ImageFormat selects the type of the images generated by the rendering
+type ImageFormat int
+
+const (
+	// ImageFormatRGBA generates *image.RGBA images (alpha premultiplied colors). This is the default.
+	ImageFormatRGBA ImageFormat = iota
+	// ImageFormatNRGBA generates *image.NRGBA images (non alpha premultiplied colors)
+	ImageFormatNRGBA
+	// ImageFormatPaletted generates *image.Paletted images using the effective colors of the subtitle (4 colors unless
+	// the subtitle changes colors by region). Ideal for small PNG files and further processing. Images scaled with
+	// smoothing filters keep these colors: smoothed pixels get the closest one.
+	ImageFormatPaletted
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (imgf ImageFormat) String() string {
+	switch imgf {
+	case ImageFormatRGBA:
+		return "RGBA"
+	case ImageFormatNRGBA:
+		return "NRGBA"
+	case ImageFormatPaletted:
+		return "Paletted"
+	default:
+		return "Unknown"
+	}
+}
+
+// RenderOptions controls how subtitles images are rendered
+type RenderOptions struct {
+	// FullSize generates images with the size of the original video feed with positioned subtitles.
+	// Otherwise only the subtitle rendering window is generated (smaller images, less empty space).
+	FullSize bool
+	// CanvasSize overrides the video size of the idx file (used for full size images and placements) if not zero
+	CanvasSize image.Point
+	// Format selects the type of the generated images
+	Format ImageFormat
+	// Palette optionally overrides the colors of the subtitles
+	Palette *PaletteOverride
+	// Scale optionally scales the images (after cropping) and the placements from the canvas to another video frame
+	Scale *ScaleOptions
+	// Binarize optionally generates OCR friendly images (after cropping and scaling): see BinarizeOptions.
+	// The 4 colors of the subtitle are classified, Format is ignored and scaling is applied to the text mask.
+	Binarize *BinarizeOptions
+	// Crop trims the images to the bounding box of their visible (non transparent) pixels.
+	// Images bounds stay in video coordinates: cropped images can still be placed exactly.
+	Crop bool
+	// Lazy generates *LazyImage images: subtitles are only rasterized when their pixels are accessed.
+	// See LazyImage for details.
+	Lazy bool
+	// Cache optionally bounds the number of rasterized lazy images kept in memory, releasing the least recently used ones.
+	// It is only used when Lazy is set and can be shared.
+	Cache *ImageCache
+}
+
+// PaletteOverride replaces the colors used to render the subtitles, instead of patching the idx palette by hand.
+// For example to get white text with a black outline regardless of the disc colors, set the pattern slot (usually the text)
+// to white and the emphasis slots (usually the outline and anti-aliasing) to black, forcing the alphas to {0, 15, 15, 15}.
+type PaletteOverride struct {
+	// Palette replaces the 16 colors idx palette if not nil
+	Palette color.Palette
+	// Slots replaces the color of each SPU color slot (background, pattern, emphasis 1 and emphasis 2), regardless
+	// of the palette colors selected by the SPU. Nil entries keep the SPU selected color.
+	Slots [SubtitleColorSlots]color.Color
+	// Alphas forces the contrast (0 transparent to 15 opaque) of each SPU color slot if not nil
+	Alphas *[SubtitleColorSlots]uint8
+}
+
+// SubtitleState is one display state of a subtitle: what is displayed between StartDelay and StopDelay (relative to the subtitle PTS).
+// A StopDelay equal to StartDelay means the subtitle does not specify when this state ends.
+type SubtitleState struct {
+	StartDelay time.Duration
+	StopDelay  time.Duration
+	Forced     bool
+	Image      image.Image
+	Placement  Placement
+}
+
 // Decode method takes the subtitle metadata and a boolean flag to determine if full-size images should be generated.
 // It returns an image of the subtitle, its start delay, stop delay, and any errors that occurred during decoding.
+// All the control sequences are consolidated: the last display parameters win and only one start/stop pair is kept.
+// Use DecodeStates() to get every display state of the subtitle.
+// The SPU display area includes its second corner (see SubtitlesWindow.Rect()): images are one pixel wider and taller
+// than Point2 minus Point1.
 func (sr SubtitleRaw) Decode(metadata IdxMetadata, fullSize bool) (img image.Image, startDelay, stopDelay time.Duration, err error) {
-	// Consolidate rendering metadata
-	var (
-		paletteColors *ControlSequencePalette
-		alphaChannels *ControlSequenceAlphaChannels
-		coordinates   *ControlSequenceCoordinates
-		RLEOffsets    *ControlSequenceRLEOffsets
-	)
+	return sr.DecodeWithOptions(metadata, RenderOptions{FullSize: fullSize})
+}
+
+// DecodeWithOptions works as Decode() but allows to fine tune the rendering of the image.
+// Unless cropped, scaled or full size, the image bounds are the SPU display area with both corners included.
+func (sr SubtitleRaw) DecodeWithOptions(metadata IdxMetadata, opts RenderOptions) (img image.Image, startDelay, stopDelay time.Duration, err error) {
+	state, startDelay, stopDelay := sr.consolidate()
+	img, err = state.render(sr.Data, metadata, opts)
+	return
+}
+
+// Placement returns where the subtitle decoded by DecodeWithOptions() is displayed on the canvas.
+func (sr SubtitleRaw) Placement(metadata IdxMetadata, opts RenderOptions) (placement Placement, err error) {
+	state, _, _ := sr.consolidate()
+	if err = state.check(); err != nil {
+		return
+	}
+	if _, err = newRenderScaler(metadata, opts); err != nil {
+		return
+	}
+	placement = state.placement(metadata, opts)
+	return
+}
+
+// consolidate merges all the control sequences: the last display parameters win and only one start/stop pair is kept
+func (sr SubtitleRaw) consolidate() (state spuDisplayState, startDelay, stopDelay time.Duration) {
 	for _, cs := range sr.ControlSequences {
-		if cs.StartDate {
+		if cs.StartDate || cs.ForceDisplaying {
 			startDelay = cs.Date.GetDelay()
 		} else if cs.StopDate {
 			stopDelay = cs.Date.GetDelay()
 		}
-		if cs.PaletteColors != nil {
-			paletteColors = cs.PaletteColors
+		state.apply(cs)
+	}
+	return
+}
+
+// Forced returns true if the subtitle is forced: displayed even if subtitles are turned off
+func (sr SubtitleRaw) Forced() bool {
+	for _, cs := range sr.ControlSequences {
+		if cs.ForceDisplaying {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeStates decodes every display state of the subtitle. Each display state change (start, stop, palette or alpha change,
+// new coordinates, etc...) ends the current state and starts a new one if the subtitle is still displayed,
+// allowing to preserve color changes and blinking subtitles. States sharing the same display parameters share the same image.
+func (sr SubtitleRaw) DecodeStates(metadata IdxMetadata, opts RenderOptions) (states []SubtitleState, err error) {
+	var (
+		current   spuDisplayState
+		displayed bool
+		forced    bool
+		opened    *SubtitleState
+		openedFor spuDisplayState
+		rendered  = make(map[spuDisplayState]image.Image, len(sr.ControlSequences))
+	)
+	closeState := func(stopDelay time.Duration, stopKnown bool) (err error) {
+		defer func() { opened = nil }()
+		if stopKnown && stopDelay <= opened.StartDelay {
+			// empty state, discard it
+			return
+		}
+		var found bool
+		if opened.Image, found = rendered[openedFor]; !found {
+			if opened.Image, err = openedFor.render(sr.Data, metadata, opts); err != nil {
+				return
+			}
+			rendered[openedFor] = opened.Image
+		}
+		opened.StopDelay = stopDelay
+		opened.Placement = openedFor.placement(metadata, opts)
+		states = append(states, *opened)
+		return
+	}
+	for index, cs := range sr.ControlSequences {
+		date := cs.Date.GetDelay()
+		changed := cs.changesDisplay()
+		if opened != nil && (changed || cs.StopDate) {
+			if err = closeState(date, true); err != nil {
+				err = fmt.Errorf("failed to render state ending with control sequence #%d: %w", index+1, err)
+				return
+			}
+		}
+		current.apply(cs)
+		if cs.StopDate {
+			displayed = false
 		}
-		if cs.AlphaChannels != nil {
-			alphaChannels = cs.AlphaChannels
+		if cs.StartDate || cs.ForceDisplaying {
+			displayed = true
+			forced = cs.ForceDisplaying
 		}
-		if cs.Coordinates != nil {
-			coordinates = cs.Coordinates
+		if displayed && opened == nil {
+			opened = &SubtitleState{
+				StartDelay: date,
+				Forced:     forced,
+			}
+			openedFor = current
 		}
-		if cs.RLEOffsets != nil {
-			RLEOffsets = cs.RLEOffsets
+	}
+	if opened != nil {
+		// no stop date for the last state
+		if err = closeState(opened.StartDelay, false); err != nil {
+			err = fmt.Errorf("failed to render last state: %w", err)
+			return
 		}
 	}
-	if paletteColors == nil {
+	return
+}
+
+// spuDisplayState contains the display parameters of a subtitle at a given time
+type spuDisplayState struct {
+	paletteColors *ControlSequencePalette
+	alphaChannels *ControlSequenceAlphaChannels
+	coordinates   *ControlSequenceCoordinates
+	RLEOffsets    *ControlSequenceRLEOffsets
+	colorContrast *ControlSequenceColorContrast
+}
+
+func (state *spuDisplayState) apply(cs ControlSequence) {
+	if cs.PaletteColors != nil {
+		state.paletteColors = cs.PaletteColors
+	}
+	if cs.AlphaChannels != nil {
+		state.alphaChannels = cs.AlphaChannels
+	}
+	if cs.Coordinates != nil {
+		state.coordinates = cs.Coordinates
+	}
+	if cs.RLEOffsets != nil {
+		state.RLEOffsets = cs.RLEOffsets
+	}
+	if cs.ColorContrast != nil {
+		state.colorContrast = cs.ColorContrast
+	}
+}
+
+// render returns the image of the display state: rasterized right away or a *LazyImage depending on opts
+func (state spuDisplayState) render(data []byte, metadata IdxMetadata, opts RenderOptions) (img image.Image, err error) {
+	if err = state.check(); err != nil {
+		return
+	}
+	if _, err = newRenderScaler(metadata, opts); err != nil {
+		return
+	}
+	if opts.Lazy {
+		img = newLazyImage(data, state, metadata, opts)
+		return
+	}
+	return state.draw(data, metadata, opts)
+}
+
+// check verifies that the display state contains everything needed to draw the subtitle
+func (state spuDisplayState) check() (err error) {
+	if state.paletteColors == nil {
 		err = fmt.Errorf("missing palette colors ids in subtitle")
 		return
 	}
-	if alphaChannels == nil {
+	if state.alphaChannels == nil {
 		err = fmt.Errorf("missing alpha channels ids in subtitle")
 		return
 	}
-	if coordinates == nil {
+	if state.coordinates == nil {
 		err = fmt.Errorf("missing coordinates in subtitle")
 		return
 	}
-	if RLEOffsets == nil {
+	if state.RLEOffsets == nil {
 		err = fmt.Errorf("missing RLE offsets in subtitle")
 		return
 	}
-	// Adjust the palette
-	palette := make(color.Palette, 4)
-	colorsIdx := paletteColors.GetIDs()
-	alphaRatio := alphaChannels.GetRatios()
-	for i := range 4 {
-		r, g, b, a := metadata.Palette[colorsIdx[i]].RGBA()
-		a = uint32(float64(a) * alphaRatio[i])
-		palette[i] = color.RGBA{
-			R: uint8(r),
-			G: uint8(g),
-			B: uint8(b),
-			A: uint8(a),
-		}
-	}
-	// Create the subtitle image
-	coord := coordinates.Get()
-	subtitleImg := image.NewRGBA(image.Rect(coord.Point1.X, coord.Point1.Y, coord.Point2.X, coord.Point2.Y))
-	firstLineOffset, secondLineOffset := RLEOffsets.Get()
-	//// odd lines
-	iter := &nibbleIterator{
-		data: sr.Data[firstLineOffset:secondLineOffset],
-	}
-	if err = drawOddOrEvenLines(subtitleImg, palette, iter, false); err != nil {
-		err = fmt.Errorf("failed to draw even lines: %w", err)
+	return
+}
+
+// bounds returns the bounds of the image draw() would generate
+func (state spuDisplayState) bounds(metadata IdxMetadata, opts RenderOptions) (bounds image.Rectangle) {
+	if opts.FullSize {
+		bounds = canvas(metadata, opts)
+	} else {
+		bounds = state.coordinates.Get().Rect()
+	}
+	if scaler, _ := newRenderScaler(metadata, opts); scaler != nil {
+		if opts.FullSize {
+			bounds = scaler.target
+		} else {
+			bounds = scaler.Rect(bounds)
+		}
+	}
+	if opts.Binarize != nil {
+		bounds = opts.Binarize.Rect(bounds)
+	}
+	return
+}
+
+// placement returns where the subtitle is displayed on the canvas
+func (state spuDisplayState) placement(metadata IdxMetadata, opts RenderOptions) (placement Placement) {
+	placement = state.unscaledPlacement(metadata, opts)
+	if scaler, _ := newRenderScaler(metadata, opts); scaler != nil {
+		placement = scaler.Placement(placement)
+	}
+	return
+}
+
+// unscaledPlacement returns where the subtitle is displayed on the canvas, before any scaling
+func (state spuDisplayState) unscaledPlacement(metadata IdxMetadata, opts RenderOptions) (placement Placement) {
+	placement = Placement{
+		Area:   state.coordinates.Get().Rect().Add(metadata.Origin),
+		Canvas: canvas(metadata, opts),
+	}
+	if !opts.FullSize {
+		placement.Offset = metadata.Origin
+	}
+	return
+}
+
+// newRenderScaler returns the scaler requested by opts (nil if none)
+func newRenderScaler(metadata IdxMetadata, opts RenderOptions) (scaler *Scaler, err error) {
+	if opts.Scale == nil {
+		return
+	}
+	if scaler, err = NewScaler(canvas(metadata, opts).Size(), *opts.Scale); err != nil {
+		err = fmt.Errorf("invalid scale options: %w", err)
+	}
+	return
+}
+
+func canvas(metadata IdxMetadata, opts RenderOptions) image.Rectangle {
+	if opts.CanvasSize != (image.Point{}) {
+		return image.Rectangle{Max: opts.CanvasSize}
+	}
+	return image.Rect(0, 0, metadata.Width, metadata.Height)
+}
+
+// draw rasterizes the display state, check() must have been called before
+func (state spuDisplayState) draw(data []byte, metadata IdxMetadata, opts RenderOptions) (img image.Image, err error) {
+	// Adjust the palette (and its regional variations if any)
+	palettes, err := newSubtitlePalettes(metadata.Palette, *state.paletteColors, *state.alphaChannels, state.colorContrast, opts.Palette)
+	if err != nil {
+		err = fmt.Errorf("failed to build subtitle palettes: %w", err)
+		return
+	}
+	coord := state.coordinates.Get()
+	firstLineOffset, secondLineOffset := state.RLEOffsets.Get()
+	subtitleRect := coord.Rect()
+	format := opts.Format
+	if opts.Binarize != nil {
+		// binarization classifies the subtitle colors slots, pixels are then mapped by palette index
+		format = ImageFormatPaletted
+	}
+	var target draw.Image
+	if !opts.FullSize {
+		target = newSubtitleImage(subtitleRect, format, palettes.colors)
+		if err = rasterize(target, subtitleRect, subtitleRect.Min, coord, data, firstLineOffset, secondLineOffset, palettes); err != nil {
+			err = fmt.Errorf("failed to draw subtitle: %w", err)
+			return
+		}
+	} else {
+		// Draw the subtitle directly within the canvas, at its placement (parts outside the canvas are cut)
+		placement := state.unscaledPlacement(metadata, opts)
+		target = newTransparentImage(placement.Canvas, format, palettes.colors)
+		if err = rasterize(target, placement.Area, placement.Area.Min, coord, data, firstLineOffset, secondLineOffset, palettes); err != nil {
+			err = fmt.Errorf("failed to draw subtitle: %w", err)
+			return
+		}
+	}
+	img = target
+	if opts.Crop {
+		img = cropToVisible(target)
+	}
+	scaler, err := newRenderScaler(metadata, opts)
+	if err != nil {
+		return
+	}
+	if opts.Binarize != nil {
+		img = binarizePaletted(img.(*image.Paletted), scaler, *opts.Binarize)
+		return
+	}
+	if scaler != nil {
+		img = toImageFormat(scaler.Scale(img), opts.Format, palettes.colors)
+	}
+	return
+}
+
+// toImageFormat returns img as an image of the requested format, converting it if needed. Paletted conversions
+// map each pixel to the closest color of palette (a transparent color is added if needed).
+func toImageFormat(img image.Image, format ImageFormat, palette color.Palette) image.Image {
+	switch format {
+	case ImageFormatNRGBA:
+		if _, ok := img.(*image.NRGBA); ok {
+			return img
+		}
+		nrgba := image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Rect, img, nrgba.Rect.Min, draw.Src)
+		return nrgba
+	case ImageFormatPaletted:
+		if _, ok := img.(*image.Paletted); ok {
+			return img
+		}
+		transparentIndex(&palette)
+		paletted := image.NewPaletted(img.Bounds(), palette)
+		draw.Draw(paletted, paletted.Rect, img, paletted.Rect.Min, draw.Src)
+		return paletted
+	default:
+		return toRGBA(img)
+	}
+}
+
+// newSubtitleImage creates an image of the requested format (paletted images use the palette as is)
+func newSubtitleImage(bounds image.Rectangle, format ImageFormat, palette color.Palette) draw.Image {
+	switch format {
+	case ImageFormatPaletted:
+		return image.NewPaletted(bounds, palette)
+	case ImageFormatNRGBA:
+		return image.NewNRGBA(bounds)
+	default:
+		return image.NewRGBA(bounds)
+	}
+}
+
+// newTransparentImage creates a fully transparent image of the requested format.
+// For paletted images, a transparent color is added to the palette if it does not contain one already.
+func newTransparentImage(bounds image.Rectangle, format ImageFormat, palette color.Palette) draw.Image {
+	switch format {
+	case ImageFormatPaletted:
+		transparentIndex := -1
+		for index, paletteColor := range palette {
+			if _, _, _, a := paletteColor.RGBA(); a == 0 {
+				transparentIndex = index
+				break
+			}
+		}
+		if transparentIndex == -1 {
+			palette = append(palette[:len(palette):len(palette)], color.NRGBA{})
+			transparentIndex = len(palette) - 1
+		}
+		paletted := image.NewPaletted(bounds, palette)
+		if transparentIndex != 0 {
+			for i := range paletted.Pix {
+				paletted.Pix[i] = uint8(transparentIndex)
+			}
+		}
+		return paletted
+	case ImageFormatNRGBA:
+		return image.NewNRGBA(bounds)
+	default:
+		return image.NewRGBA(bounds)
+	}
+}
+
+// commonCanvas returns the canvas shared by the subtitles (empty if there is none)
+func commonCanvas(subtitles []Subtitle) (canvas image.Rectangle, err error) {
+	for index, sub := range subtitles {
+		if sub.Placement.Canvas.Empty() {
+			err = fmt.Errorf("subtitle #%d has no canvas", index+1)
+			return
+		}
+		if index == 0 {
+			canvas = sub.Placement.Canvas
+		} else if sub.Placement.Canvas != canvas {
+			err = fmt.Errorf("subtitle #%d canvas %v differs from the previous ones %v", index+1, sub.Placement.Canvas, canvas)
+			return
+		}
+	}
+	return
+}
+
+// sortedByStart returns a copy of subtitles sorted by start time
+func sortedByStart(subtitles []Subtitle) (ordered []Subtitle) {
+	ordered = slices.Clone(subtitles)
+	slices.SortStableFunc(ordered, func(a, b Subtitle) int { return cmp.Compare(a.Start, b.Start) })
+	return
+}
+
+// startOrder returns the indexes of subtitles sorted by their start time
+func startOrder(subtitles []Subtitle) (order []int) {
+	order = make([]int, len(subtitles))
+	for index := range order {
+		order[index] = index
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(subtitles[a].Start, subtitles[b].Start) })
+	return
+}
+
+// placedImage returns the visible pixels of the subtitle image within its canvas, with canvas coordinates as bounds.
+// If scaler is not nil, the image is then scaled (and clipped) to the target frame. Nothing visible gives an empty image.
+func placedImage(sub Subtitle, scaler *Scaler) (img image.Image, err error) {
+	source := sub.Image
+	if lazy, ok := source.(*LazyImage); ok {
+		if source, err = lazy.Render(); err != nil {
+			return
+		}
+	}
+	if source == nil {
+		err = errors.New("subtitle has no image")
 		return
 	}
-	//// even lines
-	iter = &nibbleIterator{
-		data: sr.Data[secondLineOffset:],
+	visible := source.Bounds().Add(sub.Placement.Offset).Intersect(sub.Placement.Canvas)
+	placed := image.NewNRGBA(visible)
+	draw.Draw(placed, visible, source, visible.Min.Sub(sub.Placement.Offset), draw.Src)
+	img = cropToVisible(placed)
+	if scaler != nil && !img.Bounds().Empty() {
+		scaled := scaler.Scale(img)
+		img = toRGBA(scaled).SubImage(scaled.Bounds().Intersect(scaler.target))
+	}
+	return
+}
+
+// cropToVisible returns a copy of img restricted to the bounding box of its non transparent pixels.
+// The copy keeps the coordinates of the pixels. A fully transparent image gives an empty image located at img bounds origin.
+func cropToVisible(img draw.Image) image.Image {
+	var (
+		bounds  = img.Bounds()
+		visible = image.Rectangle{Min: bounds.Min, Max: bounds.Min}
+		pix     []uint8
+		stride  int
+		bpp     int
+		opaque  func(offset int) bool
+	)
+	switch typed := img.(type) {
+	case *image.Paletted:
+		transparent := make([]bool, 256)
+		for index, paletteColor := range typed.Palette {
+			_, _, _, a := paletteColor.RGBA()
+			transparent[index] = a == 0
+		}
+		pix, stride, bpp = typed.Pix, typed.Stride, 1
+		opaque = func(offset int) bool { return !transparent[pix[offset]] }
+	case *image.NRGBA:
+		pix, stride, bpp = typed.Pix, typed.Stride, 4
+		opaque = func(offset int) bool { return pix[offset+3] != 0 }
+	case *image.RGBA:
+		pix, stride, bpp = typed.Pix, typed.Stride, 4
+		opaque = func(offset int) bool { return pix[offset+3] != 0 }
+	default:
+		return img
+	}
+	// Find the bounding box
+	minX, minY, maxX, maxY := bounds.Dx(), bounds.Dy(), -1, -1
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if opaque(y*stride + x*bpp) {
+				minX, maxX = min(minX, x), max(maxX, x)
+				minY, maxY = min(minY, y), max(maxY, y)
+			}
+		}
+	}
+	if maxY >= 0 {
+		visible = image.Rect(minX, minY, maxX+1, maxY+1).Add(bounds.Min)
+	}
+	// Copy it
+	var (
+		cropped    image.Image
+		croppedPix []uint8
+	)
+	switch typed := img.(type) {
+	case *image.Paletted:
+		paletted := image.NewPaletted(visible, typed.Palette)
+		cropped, croppedPix = paletted, paletted.Pix
+	case *image.NRGBA:
+		nrgba := image.NewNRGBA(visible)
+		cropped, croppedPix = nrgba, nrgba.Pix
+	default:
+		rgba := image.NewRGBA(visible)
+		cropped, croppedPix = rgba, rgba.Pix
+	}
+	rowLength := visible.Dx() * bpp
+	for y := range visible.Dy() {
+		rowOffset := (minY+y)*stride + minX*bpp
+		copy(croppedPix[y*rowLength:(y+1)*rowLength], pix[rowOffset:rowOffset+rowLength])
 	}
-	if err = drawOddOrEvenLines(subtitleImg, palette, iter, true); err != nil {
-		err = fmt.Errorf("failed to draw even lines: %w", err)
+	return cropped
+}
+
+// Encode assembles the raw subtitle into a complete SPU: size headers, data and control sequences.
+// Control sequences offsets are computed during assembly, RLE offsets must be relative to Data (as returned by ControlSequenceRLEOffsets.Get()).
+// The SPU must fit within the 53220 bytes buffer of DVD players.
+func (sr SubtitleRaw) Encode() (spu []byte, err error) {
+	dataSize := subtitleHeadersTotalLen + len(sr.Data)
+	sequences, err := encodeCTRLSeqs(sr.ControlSequences, dataSize)
+	if err != nil {
+		err = fmt.Errorf("failed to encode control sequences: %w", err)
 		return
 	}
-	if !fullSize {
-		img = subtitleImg
+	size := dataSize + len(sequences)
+	if size > subtitleMaxSize {
+		err = fmt.Errorf("the encoded subtitle size (%d) exceeds the maximum size (%d)", size, subtitleMaxSize)
 		return
 	}
-	// Place the image within the full size screen (and apply idx offset if any)
-	fullSizeImg := image.NewRGBA(image.Rect(0, 0, metadata.Width, metadata.Height))
-	targetZone := image.Rectangle{
-		Min: image.Point{
-			X: metadata.Origin.X,
-			Y: metadata.Origin.Y,
-		},
-		Max: image.Point{
-			X: metadata.Width,
-			Y: metadata.Height,
-		},
-	}
-	draw.Draw(fullSizeImg, targetZone, subtitleImg, image.Point{}, draw.Src)
-	img = fullSizeImg
+	spu = make([]byte, 0, size)
+	spu = append(spu, byte(size>>8), byte(size), byte(dataSize>>8), byte(dataSize))
+	spu = append(spu, sr.Data...)
+	spu = append(spu, sequences...)
 	return
 }
 
@@ -153,13 +684,26 @@ type ControlSequence struct {
 	AlphaChannels   *ControlSequenceAlphaChannels
 	Coordinates     *ControlSequenceCoordinates
 	RLEOffsets      *ControlSequenceRLEOffsets
+	ColorContrast   *ControlSequenceColorContrast
 }
 
 type ControlSequenceDate [subtitleCTRLSeqDateLen]byte
 
 // GetDelay convert the control sequence date to the actual delay it represents
 func (csd ControlSequenceDate) GetDelay() time.Duration {
-	return time.Duration(int(csd[0])<<8|int(csd[1])) * (time.Second / 100)
+	return time.Duration(int(csd[0])<<8|int(csd[1])) * subtitleCTRLSeqDateUnit
+}
+
+// NewControlSequenceDate creates the control sequence date representing the delay (truncated to the date precision)
+func NewControlSequenceDate(delay time.Duration) (csd ControlSequenceDate, err error) {
+	ticks := delay / subtitleCTRLSeqDateUnit
+	if ticks < 0 || ticks > 0xffff {
+		err = fmt.Errorf("delay %s can not be represented as a control sequence date", delay)
+		return
+	}
+	csd[0] = byte(ticks >> 8)
+	csd[1] = byte(ticks)
+	return
 }
 
 type ControlSequencePalette [subtitleCTRLSeqCmdPaletteArgsLen]byte
@@ -173,6 +717,13 @@ func (csp ControlSequencePalette) GetIDs() (colorsIdx [4]uint8) {
 	return
 }
 
+// NewControlSequencePalette creates the palette command arguments from the 4 palette IDs used by the subtitle
+func NewControlSequencePalette(colorsIdx [4]uint8) (csp ControlSequencePalette) {
+	csp[0] = (colorsIdx[3]&0b00001111)<<4 | colorsIdx[2]&0b00001111
+	csp[1] = (colorsIdx[1]&0b00001111)<<4 | colorsIdx[0]&0b00001111
+	return
+}
+
 type ControlSequenceAlphaChannels [subtitleCTRLSeqCmdAlphaChannelArgsLen]byte
 
 // GetAlphaChannelRatios return the ratios of the alpha channels used by the 4 colors of the subtitle.
@@ -185,6 +736,13 @@ func (csac ControlSequenceAlphaChannels) GetRatios() (alphas [4]float64) {
 	return
 }
 
+// NewControlSequenceAlphaChannels creates the alpha channel command arguments from the 4 contrast levels (0 to 15) of the subtitle colors
+func NewControlSequenceAlphaChannels(levels [4]uint8) (csac ControlSequenceAlphaChannels) {
+	csac[0] = (levels[3]&0b00001111)<<4 | levels[2]&0b00001111
+	csac[1] = (levels[1]&0b00001111)<<4 | levels[0]&0b00001111
+	return
+}
+
 type ControlSequenceCoordinates [subtitleCTRLSeqCmdCoordinatesArgsLen]byte
 
 // GetCoordinates returns the coordinates of the subtitle canvea on the screen : x1, x2, y1, y2
@@ -196,6 +754,23 @@ func (csc ControlSequenceCoordinates) Get() (coord SubtitlesWindow) {
 	return
 }
 
+// NewControlSequenceCoordinates creates the coordinates command arguments from a subtitle window (coordinates are encoded on 12 bits)
+func NewControlSequenceCoordinates(coord SubtitlesWindow) (csc ControlSequenceCoordinates, err error) {
+	for _, value := range []int{coord.Point1.X, coord.Point2.X, coord.Point1.Y, coord.Point2.Y} {
+		if value < 0 || value > 0xfff {
+			err = fmt.Errorf("coordinate value %d does not fit within 12 bits", value)
+			return
+		}
+	}
+	csc[0] = byte(coord.Point1.X >> 4)
+	csc[1] = byte(coord.Point1.X&0b00001111)<<4 | byte(coord.Point2.X>>8)
+	csc[2] = byte(coord.Point2.X)
+	csc[3] = byte(coord.Point1.Y >> 4)
+	csc[4] = byte(coord.Point1.Y&0b00001111)<<4 | byte(coord.Point2.Y>>8)
+	csc[5] = byte(coord.Point2.Y)
+	return
+}
+
 type ControlSequenceRLEOffsets [subtitleCTRLSeqCmdRLEOffsetsArgsLen]byte
 
 func (csrleo ControlSequenceRLEOffsets) Get() (firstLineOffset int, secondLineOffset int) {
@@ -206,6 +781,43 @@ func (csrleo ControlSequenceRLEOffsets) Get() (firstLineOffset int, secondLineOf
 	return
 }
 
+// NewControlSequenceRLEOffsets creates the RLE offsets command arguments from offsets relative to the subtitle data (as returned by Get())
+func NewControlSequenceRLEOffsets(firstLineOffset int, secondLineOffset int) (csrleo ControlSequenceRLEOffsets) {
+	firstLineOffset += subtitleHeadersTotalLen
+	secondLineOffset += subtitleHeadersTotalLen
+	csrleo[0] = byte(firstLineOffset >> 8)
+	csrleo[1] = byte(firstLineOffset)
+	csrleo[2] = byte(secondLineOffset >> 8)
+	csrleo[3] = byte(secondLineOffset)
+	return
+}
+
+// ControlSequenceColorContrast contains the parameters of the change color and contrast command (CHG_COLCON).
+// It allows to use different palette colors and alpha channels for several regions of the subtitle (karaoke for example).
+type ControlSequenceColorContrast struct {
+	Lines []ColorContrastLines
+}
+
+// ColorContrastLines is a line control information: the changes applied to a range of screen lines
+type ColorContrastLines struct {
+	StartLine, EndLine int // inclusive
+	Changes            []ColorContrastChange
+}
+
+// ColorContrastChange is a pixel control information: starting at StartColumn (on screen) and until the next change or the end of the line,
+// the subtitle uses these palette colors and alpha channels instead of the ones set by the palette and alpha channel commands.
+type ColorContrastChange struct {
+	StartColumn   int
+	PaletteColors ControlSequencePalette
+	AlphaChannels ControlSequenceAlphaChannels
+}
+
+// changesDisplay returns true if the control sequence changes how the subtitle is displayed
+func (cs ControlSequence) changesDisplay() bool {
+	return cs.PaletteColors != nil || cs.AlphaChannels != nil || cs.Coordinates != nil ||
+		cs.RLEOffsets != nil || cs.ColorContrast != nil
+}
+
 func (cs ControlSequence) String() string {
 	var builder strings.Builder
 	builder.WriteString(fmt.Sprintf("Delay: %s", cs.Date.GetDelay()))
@@ -261,6 +873,23 @@ func (cs ControlSequence) String() string {
 			fmt.Sprintf(" | RLE Offsets: 1st(%d) 2nd(%d)", firstLineOffset, secondLineOffset),
 		)
 	}
+	// Color and contrast changes
+	if cs.ColorContrast != nil {
+		builder.WriteString(" | ColorContrast:")
+		for _, lines := range cs.ColorContrast.Lines {
+			builder.WriteString(fmt.Sprintf(" lines(%d-%d)", lines.StartLine, lines.EndLine))
+			for _, change := range lines.Changes {
+				colors := change.PaletteColors.GetIDs()
+				alphas := change.AlphaChannels.GetRatios()
+				builder.WriteString(
+					fmt.Sprintf(" [column(%d) colors(%d %d %d %d) alphas(%f %f %f %f)]", change.StartColumn,
+						colors[0], colors[1], colors[2], colors[3],
+						alphas[0], alphas[1], alphas[2], alphas[3],
+					),
+				)
+			}
+		}
+	}
 	return builder.String()
 }
 
@@ -272,6 +901,11 @@ func (coord SubtitlesWindow) Size() (width, height int) {
 	return coord.Point2.X - coord.Point1.X + 1, coord.Point2.Y - coord.Point1.Y + 1
 }
 
+// Rect returns the rectangle covered by the window: Point2 is included, unlike image.Rectangle Max
+func (coord SubtitlesWindow) Rect() image.Rectangle {
+	return image.Rectangle{Min: coord.Point1, Max: coord.Point2.Add(image.Point{X: 1, Y: 1})}
+}
+
 /*
 	Extract helpers
 */
@@ -411,6 +1045,25 @@ func parseCTRLSeq(sequences []byte) (cs ControlSequence, nextOffset, index int,
 				cs.RLEOffsets[i] = sequences[index+i]
 			}
 			index += subtitleCTRLSeqCmdRLEOffsetsArgsLen
+		case subtitleCTRLSeqCmdColorContrast:
+			if index+subtitleCTRLSeqCmdColorContrastSize > len(sequences) {
+				err = fmt.Errorf("can not read color contrast command: index is %d and sequences length is %d: need at least %d bytes to read the command size",
+					index, len(sequences), subtitleCTRLSeqCmdColorContrastSize,
+				)
+				return
+			}
+			size := int(sequences[index])<<8 | int(sequences[index+1]) // includes the size bytes
+			if size < subtitleCTRLSeqCmdColorContrastSize || index+size > len(sequences) {
+				err = fmt.Errorf("can not read color contrast command: index is %d and sequences length is %d: invalid parameters size %d",
+					index, len(sequences), size,
+				)
+				return
+			}
+			if cs.ColorContrast, err = parseColorContrast(sequences[index+subtitleCTRLSeqCmdColorContrastSize : index+size]); err != nil {
+				err = fmt.Errorf("can not parse color contrast command: %w", err)
+				return
+			}
+			index += size
 		case subtitleCTRLSeqCmdEnd:
 			return
 		default:
@@ -420,137 +1073,242 @@ func parseCTRLSeq(sequences []byte) (cs ControlSequence, nextOffset, index int,
 	}
 }
 
-func drawOddOrEvenLines(rgbaImg *image.RGBA, palette color.Palette, iter *nibbleIterator, evenLines bool) (err error) {
-	bounds := rgbaImg.Bounds()
-	var (
-		relativeX, relativeY int
-		absoluteX, absoluteY int
-		length               int
-		pixel                rlePixel
-	)
-	if evenLines {
-		relativeY = 1
+/*
+	Encode helpers
+*/
+
+func encodeCTRLSeqs(ctrlSeqs []ControlSequence, baseOffset int) (sequences []byte, err error) {
+	if len(ctrlSeqs) == 0 {
+		err = errors.New("a subtitle needs at least one control sequence")
+		return
 	}
-	absoluteY = bounds.Min.Y + relativeY
-	for !iter.Ended() {
-		if pixel, err = decodeRLE(iter); err != nil {
+	for index, ctrlSeq := range ctrlSeqs {
+		var cmds []byte
+		if cmds, err = ctrlSeq.encodeCommands(); err != nil {
+			err = fmt.Errorf("failed to encode control sequence #%d: %w", index+1, err)
 			return
 		}
-		if length = int(pixel.repeat); length == 0 {
-			// going until the end of line
-			length = bounds.Max.X - (bounds.Min.X + relativeX) + 1
-		}
-		for range length {
-			absoluteX = bounds.Min.X + relativeX
-			rgbaImg.Set(absoluteX, absoluteY, palette[pixel.color])
-			if absoluteX == bounds.Max.X {
-				// Need a new line for next pixel
-				relativeX = 0
-				relativeY += 2
-				absoluteY = bounds.Min.Y + relativeY
-				if absoluteY > bounds.Max.Y {
-					return
-				}
-				iter.Align() // align decoder if needed for new line
-				break        // discard any repetition remaining (cause we reached the end of the line)
-			}
-			relativeX++
+		currentOffset := baseOffset + len(sequences)
+		nextOffset := currentOffset + subtitleCTRLSeqDateLen + subtitleCTRLSeqNextOffsetLen + len(cmds)
+		if index == len(ctrlSeqs)-1 {
+			// last control seq must point to itself
+			nextOffset = currentOffset
 		}
+		sequences = append(sequences, ctrlSeq.Date[0], ctrlSeq.Date[1], byte(nextOffset>>8), byte(nextOffset))
+		sequences = append(sequences, cmds...)
 	}
 	return
 }
 
-func decodeRLE(nibbles *nibbleIterator) (p rlePixel, err error) {
-	// 1 nibble letters:  rrcc
-	// 2 nibbles letters: 00rr rrcc
-	// 3 nibbles letters: 0000 rrrr rrcc
-	// 4 nibbles letters: 0000 00rr rrrr rrcc
-	var firstNibble, secondNibble, thirdNibble, fourthNibble byte
-	var ok bool
-	if firstNibble, ok = nibbles.Next(); !ok {
-		err = errors.New("no more data")
-		return
+func (cs ControlSequence) encodeCommands() (cmds []byte, err error) {
+	if cs.ForceDisplaying {
+		cmds = append(cmds, subtitleCTRLSeqCmdForceDisplaying)
 	}
-	if firstNibble&0b1100 != 0 {
-		// 1 nibble letter
-		p.repeat = (firstNibble & 0b1100) >> 2
-		p.color = firstNibble & 0b0011
-		return
+	if cs.StartDate {
+		cmds = append(cmds, subtitleCTRLSeqCmdStartDate)
 	}
-	// 3 possibilities left, all requiring a second nibble
-	if secondNibble, ok = nibbles.Next(); !ok {
-		if firstNibble != 0 {
-			err = fmt.Errorf("missing second nibble after 0b%04b", firstNibble)
-		}
-		return
+	if cs.StopDate {
+		cmds = append(cmds, subtitleCTRLSeqCmdStopDate)
 	}
-	if firstNibble != 0 {
-		// 2 nibbles letter
-		p.repeat = (firstNibble&0b0011)<<2 | (secondNibble&0b1100)>>2
-		p.color = secondNibble & 0b0011
-		return
+	if cs.PaletteColors != nil {
+		cmds = append(cmds, subtitleCTRLSeqCmdPalette)
+		cmds = append(cmds, cs.PaletteColors[:]...)
 	}
-	// 2 possibilities left, both requiring a third nibble
-	if thirdNibble, ok = nibbles.Next(); !ok {
-		if firstNibble != 0 || secondNibble != 0 {
-			err = fmt.Errorf("missing third nibble after 0b%04b 0b%04b", firstNibble, secondNibble)
-		}
-		return
+	if cs.AlphaChannels != nil {
+		cmds = append(cmds, subtitleCTRLSeqCmdAlphaChannel)
+		cmds = append(cmds, cs.AlphaChannels[:]...)
 	}
-	if secondNibble&0b1100 != 0 {
-		// 3 nibbles letter
-		p.repeat = secondNibble<<2 | (thirdNibble&0b1100)>>2
-		p.color = thirdNibble & 0b0011
-		return
+	if cs.Coordinates != nil {
+		cmds = append(cmds, subtitleCTRLSeqCmdCoordinates)
+		cmds = append(cmds, cs.Coordinates[:]...)
+	}
+	if cs.RLEOffsets != nil {
+		cmds = append(cmds, subtitleCTRLSeqCmdRLEOffsets)
+		cmds = append(cmds, cs.RLEOffsets[:]...)
 	}
-	// 4 nibbles letter
-	if fourthNibble, ok = nibbles.Next(); !ok {
-		if firstNibble != 0 || secondNibble != 0 || thirdNibble != 0 {
-			err = fmt.Errorf("missing fourth nibble after 0b%04b 0b%04b 0b%04b", firstNibble, secondNibble, thirdNibble)
+	if cs.ColorContrast != nil {
+		var parameters []byte
+		if parameters, err = cs.ColorContrast.encode(); err != nil {
+			err = fmt.Errorf("invalid color contrast command: %w", err)
+			return
 		}
-		return
+		cmds = append(cmds, subtitleCTRLSeqCmdColorContrast)
+		cmds = append(cmds, parameters...)
 	}
-	p.repeat = secondNibble<<6 | thirdNibble<<2 | (fourthNibble&0b1100)>>2
-	p.color = fourthNibble & 0b0011
+	return append(cmds, subtitleCTRLSeqCmdEnd), nil
+}
+
+func (cscc ControlSequenceColorContrast) encode() (parameters []byte, err error) {
+	parameters = make([]byte, subtitleCTRLSeqCmdColorContrastSize, subtitleCTRLSeqCmdColorContrastSize+subtitleColorContrastLinesLen)
+	for index, lines := range cscc.Lines {
+		if len(lines.Changes) > subtitleColorContrastMaxChanges {
+			err = fmt.Errorf("lines region #%d has %d column changes (max is %d)", index+1, len(lines.Changes), subtitleColorContrastMaxChanges)
+			return
+		}
+		parameters = append(parameters,
+			byte(lines.StartLine>>8)&0b00001111, byte(lines.StartLine),
+			byte(len(lines.Changes))<<4|byte(lines.EndLine>>8)&0b00001111, byte(lines.EndLine),
+		)
+		for _, change := range lines.Changes {
+			parameters = append(parameters, byte(change.StartColumn>>8), byte(change.StartColumn))
+			parameters = append(parameters, change.PaletteColors[:]...)
+			parameters = append(parameters, change.AlphaChannels[:]...)
+		}
+	}
+	parameters = binary.BigEndian.AppendUint32(parameters, subtitleColorContrastLinesEnd)
+	// size includes the size bytes
+	parameters[0] = byte(len(parameters) >> 8)
+	parameters[1] = byte(len(parameters))
 	return
 }
 
-type nibbleIterator struct {
-	data []byte
-	// instructions for next read
-	index   int
-	readLow bool
+func parseColorContrast(parameters []byte) (colorContrast *ControlSequenceColorContrast, err error) {
+	colorContrast = new(ControlSequenceColorContrast)
+	index := 0
+	for {
+		if index+subtitleColorContrastLinesLen > len(parameters) {
+			err = fmt.Errorf("can not read line control information: index is %d and parameters length is %d: need at least %d bytes",
+				index, len(parameters), subtitleColorContrastLinesLen,
+			)
+			return
+		}
+		lineInfo := parameters[index : index+subtitleColorContrastLinesLen]
+		index += subtitleColorContrastLinesLen
+		if binary.BigEndian.Uint32(lineInfo) == subtitleColorContrastLinesEnd {
+			return
+		}
+		lines := ColorContrastLines{
+			StartLine: int(lineInfo[0]&0b00001111)<<8 | int(lineInfo[1]),
+			EndLine:   int(lineInfo[2]&0b00001111)<<8 | int(lineInfo[3]),
+			Changes:   make([]ColorContrastChange, int(lineInfo[2]>>4)),
+		}
+		for i := range lines.Changes {
+			if index+subtitleColorContrastChangeLen > len(parameters) {
+				err = fmt.Errorf("can not read pixel control information #%d of lines %d-%d: index is %d and parameters length is %d: need at least %d bytes",
+					i+1, lines.StartLine, lines.EndLine, index, len(parameters), subtitleColorContrastChangeLen,
+				)
+				return
+			}
+			lines.Changes[i] = ColorContrastChange{
+				StartColumn:   int(parameters[index])<<8 | int(parameters[index+1]),
+				PaletteColors: ControlSequencePalette{parameters[index+2], parameters[index+3]},
+				AlphaChannels: ControlSequenceAlphaChannels{parameters[index+4], parameters[index+5]},
+			}
+			index += subtitleColorContrastChangeLen
+		}
+		colorContrast.Lines = append(colorContrast.Lines, lines)
+	}
+}
+
+// subtitlePalettes contains the 4 colors palette of the subtitle and its variations by region (set by the color contrast command)
+type subtitlePalettes struct {
+	colors  color.Palette // 4 colors by palette: the base palette first then the regional ones
+	regions []paletteRegionLines
+}
+
+type paletteRegionLines struct {
+	startLine, endLine int
+	startColumns       []int
+	offsets            []uint8 // offset of the palette within the colors
 }
 
-func (ni *nibbleIterator) Next() (nibble byte, ok bool) {
-	if ni.Ended() {
+func newSubtitlePalettes(idxPalette color.Palette, paletteColors ControlSequencePalette, alphaChannels ControlSequenceAlphaChannels,
+	colorContrast *ControlSequenceColorContrast, override *PaletteOverride) (palettes *subtitlePalettes, err error) {
+	palettes = new(subtitlePalettes)
+	known := make(map[[4]color.NRGBA]uint8, 1)
+	addPalette := func(paletteColors ControlSequencePalette, alphaChannels ControlSequenceAlphaChannels) (offset uint8, err error) {
+		palette, err := buildSubtitlePalette(idxPalette, paletteColors, alphaChannels, override)
+		if err != nil {
+			return
+		}
+		offset, found := known[palette]
+		if found {
+			return
+		}
+		if len(palettes.colors)+len(palette) > 256 {
+			err = errors.New("too many different palettes within the subtitle")
+			return
+		}
+		offset = uint8(len(palettes.colors))
+		for _, paletteColor := range palette {
+			palettes.colors = append(palettes.colors, paletteColor)
+		}
+		known[palette] = offset
 		return
 	}
-	ok = true
-	if !ni.readLow {
-		// First read at index
-		nibble = (ni.data[ni.index] & 0b11110000) >> 4
-	} else {
-		// Second read at index
-		nibble = (ni.data[ni.index] & 0b00001111)
-		ni.index++
+	if _, err = addPalette(paletteColors, alphaChannels); err != nil {
+		return
+	}
+	if colorContrast == nil {
+		return
+	}
+	palettes.regions = make([]paletteRegionLines, len(colorContrast.Lines))
+	for i, lines := range colorContrast.Lines {
+		region := paletteRegionLines{
+			startLine:    lines.StartLine,
+			endLine:      lines.EndLine,
+			startColumns: make([]int, len(lines.Changes)),
+			offsets:      make([]uint8, len(lines.Changes)),
+		}
+		for j, change := range lines.Changes {
+			region.startColumns[j] = change.StartColumn
+			if region.offsets[j], err = addPalette(change.PaletteColors, change.AlphaChannels); err != nil {
+				return
+			}
+		}
+		palettes.regions[i] = region
 	}
-	ni.readLow = !ni.readLow
 	return
 }
 
-func (ni *nibbleIterator) Align() {
-	if ni.readLow {
-		ni.index++
-		ni.readLow = false
+// OffsetAt returns the offset within colors of the palette to use for the pixel at the (absolute) x, y coordinates
+func (sp *subtitlePalettes) OffsetAt(x, y int) (offset uint8) {
+	for _, region := range sp.regions {
+		if y < region.startLine || y > region.endLine {
+			continue
+		}
+		for i, startColumn := range region.startColumns {
+			if x >= startColumn {
+				offset = region.offsets[i]
+			}
+		}
+		break
 	}
+	return
 }
 
-func (ni *nibbleIterator) Ended() bool {
-	return ni.index >= len(ni.data)
-}
-
-type rlePixel struct {
-	color  uint8 // only 4 values are used: 0x00, 0x01, 0x02, 0x03
-	repeat uint8
+// buildSubtitlePalette computes the 4 (non alpha premultiplied) colors of a subtitle, applying the override if any
+func buildSubtitlePalette(idxPalette color.Palette, paletteColors ControlSequencePalette, alphaChannels ControlSequenceAlphaChannels,
+	override *PaletteOverride) (palette [4]color.NRGBA, err error) {
+	colorsIdx := paletteColors.GetIDs()
+	alphaRatio := alphaChannels.GetRatios()
+	var slots [SubtitleColorSlots]color.Color
+	if override != nil {
+		if override.Palette != nil {
+			idxPalette = override.Palette
+		}
+		if override.Alphas != nil {
+			for slot, level := range override.Alphas {
+				if level >= SubtitleAlphaLevels {
+					err = fmt.Errorf("invalid forced alpha level for color slot #%d: %d (max is %d)", slot, level, SubtitleAlphaLevels-1)
+					return
+				}
+			}
+			alphaRatio = NewControlSequenceAlphaChannels(*override.Alphas).GetRatios()
+		}
+		slots = override.Slots
+	}
+	for i := range 4 {
+		if slots[i] != nil {
+			palette[i] = color.NRGBAModel.Convert(slots[i]).(color.NRGBA)
+		} else {
+			if int(colorsIdx[i]) >= len(idxPalette) {
+				err = fmt.Errorf("color #%d uses palette ID %d but palette only has %d colors", i, colorsIdx[i], len(idxPalette))
+				return
+			}
+			palette[i] = color.NRGBAModel.Convert(idxPalette[colorsIdx[i]]).(color.NRGBA)
+		}
+		palette[i].A = uint8(float64(palette[i].A) * alphaRatio[i])
+	}
+	return
 }
@@ -0,0 +1,449 @@
+package vobsub
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	// SubtitleColorSlots is the number of colors a subtitle (SPU) can use
+	SubtitleColorSlots = 4
+	// SubtitleAlphaLevels is the number of contrast (alpha) levels a subtitle color can use (0 transparent to 15 opaque)
+	SubtitleAlphaLevels = 16
+)
+
+// EncodeParams contains the display parameters of a subtitle to encode
+type EncodeParams struct {
+	// Colors contains the palette IDs (within the 16 colors .idx palette) used by each of the 4 subtitle color slots:
+	// background, pattern, emphasis 1 and emphasis 2
+	Colors [SubtitleColorSlots]uint8
+	// Alphas contains the contrast of each of the 4 subtitle color slots: 0 (transparent) to 15 (opaque)
+	Alphas [SubtitleColorSlots]uint8
+	// StartDelay and StopDelay are relative to the subtitle PTS. A StopDelay not greater than StartDelay produces a subtitle without stop date.
+	StartDelay, StopDelay time.Duration
+	// Forced marks the subtitle as forced: it will be displayed even if subtitles are turned off
+	Forced bool
+}
+
+// EncodeSubtitle is the inverse of SubtitleRaw.Decode: it encodes an image into a complete SPU, ready to be muxed within a .sub file.
+// See NewSubtitleRaw() for the image requirements.
+func EncodeSubtitle(img image.Image, palette color.Palette, params EncodeParams) (spu []byte, err error) {
+	rawSub, err := NewSubtitleRaw(img, palette, params)
+	if err != nil {
+		return
+	}
+	return rawSub.Encode()
+}
+
+// NewSubtitleRaw creates a raw subtitle from an image. The image bounds are used as the subtitle coordinates on screen.
+// If img is an *image.Paletted with 4 colors or less, its color indexes are used as is for the subtitle color slots.
+// Otherwise each pixel is quantized to the closest of the 4 colors defined by the params colors IDs and alphas within the palette.
+func NewSubtitleRaw(img image.Image, palette color.Palette, params EncodeParams) (subtitle SubtitleRaw, err error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		err = errors.New("can not encode an empty image")
+		return
+	}
+	for slot, level := range params.Alphas {
+		if level >= SubtitleAlphaLevels {
+			err = fmt.Errorf("invalid alpha level for color slot #%d: %d (max is %d)", slot, level, SubtitleAlphaLevels-1)
+			return
+		}
+	}
+	// Get the color slot of each pixel
+	slots, err := quantizeToSlots(img, palette, params)
+	if err != nil {
+		err = fmt.Errorf("failed to quantize image: %w", err)
+		return
+	}
+	// Encode the 2 interlaced fields
+	width := bounds.Dx()
+	topField := encodeRLEField(slots, width, bounds.Dy(), 0)
+	bottomField := encodeRLEField(slots, width, bounds.Dy(), 1)
+	subtitle.Data = make([]byte, 0, len(topField)+len(bottomField))
+	subtitle.Data = append(subtitle.Data, topField...)
+	subtitle.Data = append(subtitle.Data, bottomField...)
+	// Build the control sequences
+	coordinates, err := NewControlSequenceCoordinates(SubtitlesWindow{
+		Point1: bounds.Min,
+		Point2: bounds.Max.Sub(image.Point{X: 1, Y: 1}),
+	})
+	if err != nil {
+		err = fmt.Errorf("invalid image bounds: %w", err)
+		return
+	}
+	startDate, err := NewControlSequenceDate(params.StartDelay)
+	if err != nil {
+		err = fmt.Errorf("invalid start delay: %w", err)
+		return
+	}
+	paletteColors := NewControlSequencePalette(params.Colors)
+	alphaChannels := NewControlSequenceAlphaChannels(params.Alphas)
+	rleOffsets := NewControlSequenceRLEOffsets(0, len(topField))
+	startSeq := ControlSequence{
+		Date:            startDate,
+		ForceDisplaying: params.Forced,
+		StartDate:       !params.Forced,
+		PaletteColors:   &paletteColors,
+		AlphaChannels:   &alphaChannels,
+		Coordinates:     &coordinates,
+		RLEOffsets:      &rleOffsets,
+	}
+	subtitle.ControlSequences = []ControlSequence{startSeq}
+	if params.StopDelay > params.StartDelay {
+		var stopDate ControlSequenceDate
+		if stopDate, err = NewControlSequenceDate(params.StopDelay); err != nil {
+			err = fmt.Errorf("invalid stop delay: %w", err)
+			return
+		}
+		subtitle.ControlSequences = append(subtitle.ControlSequences, ControlSequence{
+			Date:     stopDate,
+			StopDate: true,
+		})
+	}
+	return
+}
+
+/*
+	Quantization helpers
+*/
+
+// quantizeToSlots returns the color slot (0 to 3) of each pixel of the image, line by line
+func quantizeToSlots(img image.Image, palette color.Palette, params EncodeParams) (slots []uint8, err error) {
+	bounds := img.Bounds()
+	slots = make([]uint8, bounds.Dx()*bounds.Dy())
+	// Paletted images with 4 colors or less are already using slots
+	if paletted, ok := img.(*image.Paletted); ok && len(paletted.Palette) <= SubtitleColorSlots {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(slots[(y-bounds.Min.Y)*bounds.Dx():], paletted.Pix[paletted.PixOffset(bounds.Min.X, y):paletted.PixOffset(bounds.Max.X, y)])
+		}
+		return
+	}
+	// Compute the 4 colors the subtitle will be displayed with
+	var slotColors [SubtitleColorSlots]color.NRGBA
+	for slot, paletteID := range params.Colors {
+		if int(paletteID) >= len(palette) {
+			err = fmt.Errorf("color slot #%d uses palette ID %d but palette only has %d colors", slot, paletteID, len(palette))
+			return
+		}
+		slotColors[slot] = color.NRGBAModel.Convert(palette[paletteID]).(color.NRGBA)
+		slotColors[slot].A = uint8(float64(slotColors[slot].A) * float64(params.Alphas[slot]) * subtitleCTRLSeqCmdAlphaChannelRatio)
+	}
+	// Find the closest slot for each pixel
+	cache := make(map[color.NRGBA]uint8)
+	index := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			slot, found := cache[pixel]
+			if !found {
+				slot = closestSlot(pixel, slotColors)
+				cache[pixel] = slot
+			}
+			slots[index] = slot
+			index++
+		}
+	}
+	return
+}
+
+func closestSlot(pixel color.NRGBA, slotColors [SubtitleColorSlots]color.NRGBA) (slot uint8) {
+	bestDistance := math.MaxFloat64
+	for candidate, slotColor := range slotColors {
+		if distance := colorDistance(pixel, slotColor); distance < bestDistance {
+			bestDistance = distance
+			slot = uint8(candidate)
+		}
+	}
+	return
+}
+
+// colorDistance computes the distance between 2 colors using their premultiplied values: transparent colors are all alike
+func colorDistance(a, b color.NRGBA) float64 {
+	alphaA, alphaB := float64(a.A)/0xff, float64(b.A)/0xff
+	dr := float64(a.R)*alphaA - float64(b.R)*alphaB
+	dg := float64(a.G)*alphaA - float64(b.G)*alphaB
+	db := float64(a.B)*alphaA - float64(b.B)*alphaB
+	da := float64(a.A) - float64(b.A)
+	return dr*dr + dg*dg + db*db + da*da
+}
+
+/*
+	RLE encode helpers
+*/
+
+const (
+	rleMaxRepeat = 0xff
+)
+
+// encodeRLEField encodes one of the 2 interlaced fields (firstLine 0 for the top field, 1 for the bottom one)
+func encodeRLEField(slots []uint8, width, height, firstLine int) []byte {
+	writer := &nibbleWriter{
+		data: make([]byte, 0, width*height/4),
+	}
+	for y := firstLine; y < height; y += 2 {
+		encodeRLELine(writer, slots[y*width:(y+1)*width])
+	}
+	return writer.data
+}
+
+func encodeRLELine(writer *nibbleWriter, line []uint8) {
+	for x := 0; x < len(line); {
+		// Find the run
+		runLength := 1
+		for x+runLength < len(line) && line[x+runLength] == line[x] {
+			runLength++
+		}
+		// Encode it
+		if x+runLength == len(line) && runLength > rleMaxRepeat/4 {
+			// until the end of line, cheaper than several 4 nibbles letters
+			encodeRLERun(writer, 0, line[x])
+		} else {
+			for remaining := runLength; remaining > 0; remaining -= rleMaxRepeat {
+				encodeRLERun(writer, min(remaining, rleMaxRepeat), line[x])
+			}
+		}
+		x += runLength
+	}
+	// Each line must start on a byte boundary
+	writer.Align()
+}
+
+func encodeRLERun(writer *nibbleWriter, repeat int, slot uint8) {
+	// 1 nibble letters:  rrcc
+	// 2 nibbles letters: 00rr rrcc
+	// 3 nibbles letters: 0000 rrrr rrcc
+	// 4 nibbles letters: 0000 00rr rrrr rrcc
+	// A repeat of 0 means until the end of the line (4 nibbles)
+	last := byte(repeat&0b11)<<2 | slot&0b11
+	switch {
+	case repeat == 0:
+		writer.Put(0)
+		writer.Put(0)
+		writer.Put(0)
+		writer.Put(slot & 0b11)
+	case repeat < 0b100:
+		writer.Put(last)
+	case repeat < 0b10000:
+		writer.Put(byte(repeat >> 2))
+		writer.Put(last)
+	case repeat < 0b1000000:
+		writer.Put(0)
+		writer.Put(byte(repeat >> 2))
+		writer.Put(last)
+	default:
+		writer.Put(0)
+		writer.Put(byte(repeat >> 6))
+		writer.Put(byte(repeat>>2) & 0b1111)
+		writer.Put(last)
+	}
+}
+
+type nibbleWriter struct {
+	data []byte
+	// instructions for next write
+	writeLow bool
+}
+
+func (nw *nibbleWriter) Put(nibble byte) {
+	if !nw.writeLow {
+		nw.data = append(nw.data, (nibble&0b1111)<<4)
+	} else {
+		nw.data[len(nw.data)-1] |= nibble & 0b1111
+	}
+	nw.writeLow = !nw.writeLow
+}
+
+func (nw *nibbleWriter) Align() {
+	nw.writeLow = false
+}
+
+/*
+	Color reduction helpers
+*/
+
+// weightedColor is an opaque color and its number of pixels
+type weightedColor struct {
+	color  color.NRGBA
+	weight int
+}
+
+// buildPalette returns a palette of size opaque colors summarizing the visible colors of the images (median cut).
+// Missing colors (if the images have less colors) are black.
+func buildPalette(images []image.Image, size int) (palette color.Palette) {
+	// Gather the visible colors
+	counts := make(map[color.NRGBA]int)
+	for _, img := range images {
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				pixel := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if pixel.A == 0 {
+					continue
+				}
+				pixel.A = 0xff
+				counts[pixel]++
+			}
+		}
+	}
+	colors := make([]weightedColor, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, weightedColor{color: c, weight: count})
+	}
+	slices.SortFunc(colors, func(a, b weightedColor) int { return cmp.Compare(packNRGBA(a.color), packNRGBA(b.color)) })
+	// Split the box with the largest channel range until there is enough boxes
+	boxes := [][]weightedColor{colors}
+	if len(colors) == 0 {
+		boxes = nil
+	}
+	for len(boxes) < size {
+		largest, largestChannel, largestRange := -1, 0, 0
+		for index, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for channel := range 3 {
+				low, high := 0xff, 0
+				for _, wc := range box {
+					value := colorChannel(wc.color, channel)
+					low, high = min(low, value), max(high, value)
+				}
+				if high-low > largestRange {
+					largest, largestChannel, largestRange = index, channel, high-low
+				}
+			}
+		}
+		if largest < 0 {
+			break
+		}
+		box := boxes[largest]
+		slices.SortStableFunc(box, func(a, b weightedColor) int {
+			return cmp.Compare(colorChannel(a.color, largestChannel), colorChannel(b.color, largestChannel))
+		})
+		total := 0
+		for _, wc := range box {
+			total += wc.weight
+		}
+		split, cumulated := 1, box[0].weight
+		for split < len(box)-1 && cumulated*2 < total {
+			cumulated += box[split].weight
+			split++
+		}
+		boxes = append(boxes, box[split:])
+		boxes[largest] = box[:split]
+	}
+	// Average each box
+	palette = make(color.Palette, size)
+	for index := range palette {
+		palette[index] = color.NRGBA{A: 0xff}
+	}
+	for index, box := range boxes {
+		var r, g, b, total int
+		for _, wc := range box {
+			r += int(wc.color.R) * wc.weight
+			g += int(wc.color.G) * wc.weight
+			b += int(wc.color.B) * wc.weight
+			total += wc.weight
+		}
+		palette[index] = color.NRGBA{
+			R: uint8((r + total/2) / total),
+			G: uint8((g + total/2) / total),
+			B: uint8((b + total/2) / total),
+			A: 0xff,
+		}
+	}
+	return
+}
+
+func colorChannel(c color.NRGBA, channel int) int {
+	switch channel {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	default:
+		return int(c.B)
+	}
+}
+
+func packNRGBA(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// slotCandidate is a palette color displayed with an alpha level
+type slotCandidate struct {
+	paletteID, alpha uint8
+}
+
+// chooseSlots returns params with the palette IDs and alpha levels of the 4 color slots best representing the image: the background
+// slot is transparent and the 3 others are picked greedily among the palette colors and alpha levels of the pixels,
+// each one reducing the most the overall color error.
+func chooseSlots(img image.Image, palette color.Palette) (params EncodeParams) {
+	// Map each visible pixel to its closest palette color and alpha level
+	counts := make(map[slotCandidate]int)
+	cache := make(map[color.NRGBA]slotCandidate)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			candidate, found := cache[pixel]
+			if !found {
+				candidate.alpha = uint8((int(pixel.A)*(SubtitleAlphaLevels-1) + 0x7f) / 0xff)
+				if candidate.alpha != 0 {
+					opaque := pixel
+					opaque.A = 0xff
+					bestDistance := math.MaxFloat64
+					for paletteID, paletteColor := range palette {
+						if distance := colorDistance(opaque, color.NRGBAModel.Convert(paletteColor).(color.NRGBA)); distance < bestDistance {
+							candidate.paletteID, bestDistance = uint8(paletteID), distance
+						}
+					}
+				}
+				cache[pixel] = candidate
+			}
+			if candidate.alpha != 0 {
+				counts[candidate]++
+			}
+		}
+	}
+	candidates := slices.SortedFunc(maps.Keys(counts), func(a, b slotCandidate) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a.paletteID, b.paletteID), cmp.Compare(a.alpha, b.alpha))
+	})
+	values := make([]color.NRGBA, len(candidates))
+	distances := make([]float64, len(candidates)) // distance to the closest chosen slot, the transparent one at first
+	for index, candidate := range candidates {
+		values[index] = color.NRGBAModel.Convert(palette[candidate.paletteID]).(color.NRGBA)
+		values[index].A = uint8(float64(values[index].A) * float64(candidate.alpha) * subtitleCTRLSeqCmdAlphaChannelRatio)
+		distances[index] = colorDistance(values[index], color.NRGBA{})
+	}
+	// Greedily choose the slots
+	for slot := 1; slot < SubtitleColorSlots; slot++ {
+		best, bestGain := -1, 0.0
+		for index := range candidates {
+			gain := 0.0
+			for other := range candidates {
+				if distance := colorDistance(values[other], values[index]); distance < distances[other] {
+					gain += float64(counts[candidates[other]]) * (distances[other] - distance)
+				}
+			}
+			if gain > bestGain {
+				best, bestGain = index, gain
+			}
+		}
+		if best < 0 {
+			break
+		}
+		params.Colors[slot], params.Alphas[slot] = candidates[best].paletteID, candidates[best].alpha
+		for other := range candidates {
+			distances[other] = min(distances[other], colorDistance(values[other], values[best]))
+		}
+	}
+	return
+}
@@ -0,0 +1,223 @@
+package vobsub
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestEncodeRLERun(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		repeat   int
+		slot     uint8
+		expected []byte
+	}{
+		{name: "1 pixel", repeat: 1, slot: 1, expected: []byte{0x50}},
+		{name: "4 pixels", repeat: 4, slot: 2, expected: []byte{0x12}},
+		{name: "16 pixels", repeat: 16, slot: 3, expected: []byte{0x04, 0x30}},
+		{name: "64 pixels", repeat: 64, slot: 1, expected: []byte{0x01, 0x01}},
+		{name: "end of line", repeat: 0, slot: 2, expected: []byte{0x00, 0x02}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writer := new(nibbleWriter)
+			encodeRLERun(writer, tc.repeat, tc.slot)
+			writer.Align()
+			if !bytes.Equal(writer.data, tc.expected) {
+				t.Errorf("expected %08b, got %08b", tc.expected, writer.data)
+			}
+		})
+	}
+}
+
+func TestEncodeSubtitleRoundTrip(t *testing.T) {
+	palette := testPalette()
+	// Lines covering every RLE letter size, runs longer than 255 pixels and end of line fills (odd height: unbalanced fields)
+	img := image.NewPaletted(image.Rect(40, 300, 370, 305), color.Palette{color.Transparent, color.White, color.Black, color.Gray{Y: 0x80}})
+	lines := [][]struct {
+		length int
+		slot   uint8
+	}{
+		{{1, 1}, {4, 2}, {16, 3}, {64, 1}, {245, 0}},
+		{{330, 2}},
+		{{300, 3}, {30, 1}},
+		{{63, 1}, {1, 2}, {266, 3}},
+		{{3, 1}, {15, 2}, {63, 3}, {255, 1}, {-1, 2}}, // -1: alternate slots until the end of line
+	}
+	for y, runs := range lines {
+		x := img.Rect.Min.X
+		for _, run := range runs {
+			if run.length < 0 {
+				for ; x < img.Rect.Max.X; x++ {
+					img.SetColorIndex(x, img.Rect.Min.Y+y, uint8(x%2+1))
+				}
+				break
+			}
+			for range run.length {
+				img.SetColorIndex(x, img.Rect.Min.Y+y, run.slot)
+				x++
+			}
+		}
+	}
+	spu, err := EncodeSubtitle(img, palette, EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{0, 15, 15, 15},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := parseTestSPU(t, spu)
+	decoded, _, _, err := raw.DecodeWithOptions(testMetadata(palette), RenderOptions{Format: ImageFormatPaletted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paletted := decoded.(*image.Paletted)
+	if paletted.Rect != img.Rect {
+		t.Fatalf("expected bounds %v, got %v", img.Rect, paletted.Rect)
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if expected, got := img.ColorIndexAt(x, y), paletted.ColorIndexAt(x, y); expected != got {
+				t.Fatalf("pixel (%d, %d): expected slot %d, got %d", x, y, expected, got)
+			}
+		}
+	}
+}
+
+func TestEncodeSubtitleControlSequences(t *testing.T) {
+	palette := testPalette()
+	img := image.NewPaletted(image.Rect(10, 10, 30, 14), color.Palette{color.Transparent, color.White})
+	for _, tc := range []struct {
+		name      string
+		params    EncodeParams
+		nbSeqs    int
+		forced    bool
+		startDate bool
+		start     time.Duration
+		stop      time.Duration
+	}{
+		{name: "start only", params: EncodeParams{}, nbSeqs: 1, startDate: true},
+		{name: "start and stop", params: EncodeParams{StopDelay: 2500 * time.Millisecond}, nbSeqs: 2, startDate: true, stop: 2500 * time.Millisecond},
+		{name: "delayed start", params: EncodeParams{StartDelay: 500 * time.Millisecond, StopDelay: 3 * time.Second}, nbSeqs: 2, startDate: true,
+			start: 500 * time.Millisecond, stop: 3 * time.Second},
+		{name: "stop before start", params: EncodeParams{StartDelay: time.Second, StopDelay: time.Second}, nbSeqs: 1, startDate: true, start: time.Second},
+		{name: "forced", params: EncodeParams{Forced: true, StopDelay: time.Second}, nbSeqs: 2, forced: true, stop: time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.params.Colors = [SubtitleColorSlots]uint8{0, 1, 2, 3}
+			tc.params.Alphas = [SubtitleColorSlots]uint8{0, 15, 15, 15}
+			spu, err := EncodeSubtitle(img, palette, tc.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := parseTestSPU(t, spu)
+			if len(raw.ControlSequences) != tc.nbSeqs {
+				t.Fatalf("expected %d control sequences, got %d", tc.nbSeqs, len(raw.ControlSequences))
+			}
+			first := raw.ControlSequences[0]
+			if first.ForceDisplaying != tc.forced || first.StartDate != tc.startDate {
+				t.Errorf("expected force displaying %v and start date %v commands, got %v and %v",
+					tc.forced, tc.startDate, first.ForceDisplaying, first.StartDate)
+			}
+			if tc.nbSeqs > 1 && !raw.ControlSequences[1].StopDate {
+				t.Errorf("expected the second control sequence to be a stop date")
+			}
+			_, start, stop, err := raw.Decode(testMetadata(palette), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != tc.start || stop != tc.stop {
+				t.Errorf("expected delays %s/%s, got %s/%s", tc.start, tc.stop, start, stop)
+			}
+		})
+	}
+}
+
+func TestEncodeSubtitleMaxSize(t *testing.T) {
+	palette := testPalette()
+	params := EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{0, 15, 15, 15},
+	}
+	// 1 nibble by pixel: 720 * 160 / 2 = 57600 bytes, above the DVD limit but addressable by the size headers
+	img := image.NewPaletted(image.Rect(0, 0, 720, 160), color.Palette{color.Transparent, color.White, color.Black})
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			img.SetColorIndex(x, y, uint8(x%2+1))
+		}
+	}
+	if _, err := EncodeSubtitle(img, palette, params); err == nil {
+		t.Error("expected an error for a SPU larger than 53220 bytes")
+	}
+	// 720 * 140 / 2 = 50400 bytes
+	spu, err := EncodeSubtitle(img.SubImage(image.Rect(0, 0, 720, 140)), palette, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spu) > subtitleMaxSize {
+		t.Errorf("SPU size %d exceeds %d", len(spu), subtitleMaxSize)
+	}
+}
+
+/*
+	Helpers
+*/
+
+func testPalette() color.Palette {
+	palette := make(color.Palette, idxPaletteLen)
+	for index := range palette {
+		palette[index] = color.NRGBA{R: uint8(index * 16), G: uint8(255 - index*16), B: uint8(index * 8), A: 0xff}
+	}
+	return palette
+}
+
+func testMetadata(palette color.Palette) IdxMetadata {
+	return IdxMetadata{
+		Width:      720,
+		Height:     576,
+		AlphaRatio: 1,
+		Palette:    palette,
+	}
+}
+
+// parseTestSPU parses an encoded SPU as read from a .sub file
+func parseTestSPU(t *testing.T, spu []byte) SubtitleRaw {
+	t.Helper()
+	raw, err := extractRawSubtitle(PESPacket{Payload: spu})
+	if err != nil {
+		t.Fatalf("failed to parse the encoded SPU: %v", err)
+	}
+	return raw
+}
+
+func TestEncodeColorContrastChanges(t *testing.T) {
+	palette := testPalette()
+	raw, err := NewSubtitleRaw(image.NewPaletted(image.Rect(0, 0, 64, 4), color.Palette{color.Transparent}), palette, EncodeParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nbChanges := range []int{subtitleColorContrastMaxChanges, subtitleColorContrastMaxChanges + 1} {
+		lines := ColorContrastLines{StartLine: 0, EndLine: 3, Changes: make([]ColorContrastChange, nbChanges)}
+		for index := range lines.Changes {
+			lines.Changes[index] = ColorContrastChange{StartColumn: index * 4}
+		}
+		raw.ControlSequences[0].ColorContrast = &ControlSequenceColorContrast{Lines: []ColorContrastLines{lines}}
+		spu, err := raw.Encode()
+		if nbChanges > subtitleColorContrastMaxChanges {
+			if err == nil {
+				t.Errorf("expected an error for %d column changes", nbChanges)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := parseTestSPU(t, spu)
+		if colorContrast := parsed.ControlSequences[0].ColorContrast; colorContrast == nil || len(colorContrast.Lines) != 1 ||
+			len(colorContrast.Lines[0].Changes) != nbChanges || colorContrast.Lines[0].EndLine != lines.EndLine {
+			t.Errorf("expected %d column changes until line %d, got %+v", nbChanges, lines.EndLine, colorContrast)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package vobsub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FrameRate is the frame rate of a video
+type FrameRate int
+
+const (
+	// FrameRateFromVideo guesses the frame rate from the video height: 25 fps for 576 lines, 29.97 fps for 480 lines
+	// and 23.976 fps otherwise
+	FrameRateFromVideo FrameRate = iota
+	FrameRate23976
+	FrameRate24
+	FrameRate25
+	FrameRate2997
+	FrameRate50
+	FrameRate5994
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (fr FrameRate) String() string {
+	switch fr {
+	case FrameRateFromVideo:
+		return "from video"
+	case FrameRate23976:
+		return "23.976"
+	case FrameRate24:
+		return "24"
+	case FrameRate25:
+		return "25"
+	case FrameRate2997:
+		return "29.97"
+	case FrameRate50:
+		return "50"
+	case FrameRate5994:
+		return "59.94"
+	default:
+		return "Unknown"
+	}
+}
+
+// rate returns the exact frame rate as a fraction (frames per second)
+func (fr FrameRate) rate() (num, den int64) {
+	switch fr {
+	case FrameRate23976:
+		return 24000, 1001
+	case FrameRate24:
+		return 24, 1
+	case FrameRate25:
+		return 25, 1
+	case FrameRate2997:
+		return 30000, 1001
+	case FrameRate50:
+		return 50, 1
+	case FrameRate5994:
+		return 60000, 1001
+	default:
+		return 0, 1
+	}
+}
+
+// nominal returns the integer frame rate used to count the frames of the non drop frame timecodes
+func (fr FrameRate) nominal() int64 {
+	num, den := fr.rate()
+	return (num + den - 1) / den
+}
+
+// Frames returns the number of the frame displayed at timestamp (rounded to the closest frame start).
+func (fr FrameRate) Frames(timestamp time.Duration) int64 {
+	num, den := fr.rate()
+	unit := den * int64(time.Second)
+	return (int64(timestamp)*num + unit/2) / unit
+}
+
+// Timestamp returns the start time of frame.
+func (fr FrameRate) Timestamp(frame int64) time.Duration {
+	num, den := fr.rate()
+	if num == 0 {
+		return 0
+	}
+	return time.Duration(frame * den * int64(time.Second) / num)
+}
+
+// Timecode formats the frame displayed at timestamp as a non drop frame timecode: hh:mm:ss:ff
+func (fr FrameRate) Timecode(timestamp time.Duration) string {
+	frames, nominal := fr.Frames(timestamp), fr.nominal()
+	if nominal == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d:%02d:%02d",
+		frames/(3600*nominal),
+		frames/(60*nominal)%60,
+		frames/nominal%60,
+		frames%nominal,
+	)
+}
+
+// resolve returns the frame rate to use for a video of the given height
+func (fr FrameRate) resolve(height int) FrameRate {
+	if fr != FrameRateFromVideo {
+		return fr
+	}
+	switch height {
+	case 576:
+		return FrameRate25
+	case 480:
+		return FrameRate2997
+	default:
+		return FrameRate23976
+	}
+}
+
+// parseFrameRate parses a frame rate as written by String()
+func parseFrameRate(value string) (fr FrameRate, err error) {
+	value = strings.TrimSpace(value)
+	if value == "23.98" {
+		return FrameRate23976, nil
+	}
+	for fr = FrameRate23976; fr <= FrameRate5994; fr++ {
+		if fr.String() == value {
+			return
+		}
+	}
+	err = fmt.Errorf("unsupported frame rate: %q", value)
+	return
+}
+
+// ParseTimecode returns the start time of the frame of a hh:mm:ss:ff timecode. Drop frame timecodes (where frame
+// numbers 0 and 1, or 0 to 3 at 59.94 fps, are skipped each minute except every tenth one) are only supported for
+// 29.97 and 59.94 fps, and the skipped frame numbers are rejected.
+func (fr FrameRate) ParseTimecode(timecode string, dropFrame bool) (timestamp time.Duration, err error) {
+	nominal := fr.nominal()
+	if nominal == 0 {
+		err = fmt.Errorf("unsupported frame rate: %s", fr)
+		return
+	}
+	fields := strings.FieldsFunc(timecode, func(r rune) bool { return r == ':' || r == ';' || r == '.' })
+	if len(fields) != 4 {
+		err = fmt.Errorf("invalid timecode %q: expected hh:mm:ss:ff", timecode)
+		return
+	}
+	var values [4]int64
+	for index, field := range fields {
+		if values[index], err = strconv.ParseInt(field, 10, 64); err != nil || values[index] < 0 {
+			err = fmt.Errorf("invalid timecode %q: invalid field %q", timecode, field)
+			return
+		}
+	}
+	hours, minutes, seconds, frames := values[0], values[1], values[2], values[3]
+	if minutes >= 60 || seconds >= 60 || frames >= nominal {
+		err = fmt.Errorf("invalid timecode %q: out of range field", timecode)
+		return
+	}
+	frame := ((hours*60+minutes)*60+seconds)*nominal + frames
+	if dropFrame {
+		if fr != FrameRate2997 && fr != FrameRate5994 {
+			err = fmt.Errorf("drop frame timecodes are not supported at %s fps", fr)
+			return
+		}
+		dropped := nominal / 15 // 2 at 29.97 fps, 4 at 59.94 fps
+		totalMinutes := hours*60 + minutes
+		if seconds == 0 && frames < dropped && totalMinutes%10 != 0 {
+			err = fmt.Errorf("invalid timecode %q: frame %d is skipped by drop frame timecodes", timecode, frames)
+			return
+		}
+		frame -= dropped * (totalMinutes - totalMinutes/10)
+	}
+	return fr.Timestamp(frame), nil
+}
@@ -0,0 +1,56 @@
+package vobsub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTimecodeDropFrame(t *testing.T) {
+	for _, test := range []struct {
+		timecode string
+		frame    int64
+	}{
+		{"00:00:59;29", 1799},
+		{"00:01:00;02", 1800}, // frames 0 and 1 are skipped
+		{"00:09:59;29", 17981},
+		{"00:10:00;00", 17982}, // except every tenth minute
+		{"01:00:00;00", 107892},
+	} {
+		timestamp, err := FrameRate2997.ParseTimecode(test.timecode, true)
+		if err != nil {
+			t.Errorf("%s: %v", test.timecode, err)
+			continue
+		}
+		if frame := FrameRate2997.Frames(timestamp); frame != test.frame {
+			t.Errorf("%s: expected frame %d, got %d", test.timecode, test.frame, frame)
+		}
+	}
+	for _, timecode := range []string{"00:01:00;00", "00:01:00;01", "00:19:00;01"} {
+		if _, err := FrameRate2997.ParseTimecode(timecode, true); err == nil || !strings.Contains(err.Error(), "skipped") {
+			t.Errorf("%s: expected a skipped frame error, got: %v", timecode, err)
+		}
+	}
+	if _, err := FrameRate5994.ParseTimecode("00:01:00;03", true); err == nil {
+		t.Error("expected 00:01:00;03 to be skipped at 59.94 fps")
+	}
+	if _, err := FrameRate25.ParseTimecode("00:01:00;00", true); err == nil {
+		t.Error("expected drop frame timecodes to be rejected at 25 fps")
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	for value, expected := range map[string]FrameRate{
+		"23.976": FrameRate23976,
+		"23.98":  FrameRate23976,
+		" 25 ":   FrameRate25,
+		"29.97":  FrameRate2997,
+		"59.94":  FrameRate5994,
+	} {
+		if fr, err := parseFrameRate(value); err != nil || fr != expected {
+			t.Errorf("%q: expected %s, got %s (%v)", value, expected, fr, err)
+		}
+	}
+	if _, err := parseFrameRate("30"); err == nil {
+		t.Error("expected 30 fps to be unsupported")
+	}
+}
@@ -0,0 +1,63 @@
+package vobsub
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"time"
+)
+
+const (
+	// unknownStopMaxDuration is the maximum display duration of subtitles without stop time in exported documents
+	unknownStopMaxDuration = 5 * time.Second
+)
+
+// displayStop returns when the subtitle at index (within subtitles sorted by start time) stops being displayed.
+// Subtitles without stop time are displayed until the next one, 5 seconds at most.
+func displayStop(ordered []Subtitle, index int) (stop time.Duration) {
+	sub := ordered[index]
+	if sub.Stop > sub.Start {
+		return sub.Stop
+	}
+	stop = sub.Start + unknownStopMaxDuration
+	if index+1 < len(ordered) && ordered[index+1].Start > sub.Start {
+		stop = min(stop, ordered[index+1].Start)
+	}
+	return
+}
+
+// numberedImageFile returns the name of the number-th image written next to a document: <document name>_0001.png
+func numberedImageFile(document string, number int) string {
+	return fmt.Sprintf("%s_%04d.png", document, number)
+}
+
+func writePNG(file string, img image.Image) (err error) {
+	fd, err := os.Create(file)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if err = png.Encode(fd, img); err != nil {
+		return
+	}
+	return fd.Close()
+}
+
+func encodePNG(img image.Image) (data []byte, err error) {
+	var buffer bytes.Buffer
+	if err = png.Encode(&buffer, img); err != nil {
+		return
+	}
+	return buffer.Bytes(), nil
+}
+
+func readPNG(file string) (img image.Image, err error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return png.Decode(fd)
+}
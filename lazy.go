@@ -0,0 +1,200 @@
+package vobsub
+
+import (
+	"container/list"
+	"image"
+	"image/color"
+	"sync"
+	"sync/atomic"
+)
+
+// LazyImage is an image.Image keeping only the compact SPU data of a subtitle: it is rasterized when its pixels are accessed.
+// Bounds() does not rasterize the subtitle, unless the image is cropped (see RenderOptions.Crop).
+// The rasterized image (or the rasterization error) is kept within the LazyImage until Release() is called or, if the image
+// has a cache (see RenderOptions.Cache), until the cache drops it. Use Render() to get the rasterized image and the error
+// if the rasterization fails: At() returns transparent pixels in that case.
+type LazyImage struct {
+	data     []byte
+	state    spuDisplayState
+	metadata IdxMetadata
+	opts     RenderOptions
+	bounds   image.Rectangle
+	// rasterization result
+	mutex    sync.Mutex // serializes rasterizations
+	rendered atomic.Pointer[lazyRender]
+}
+
+type lazyRender struct {
+	img image.Image
+	err error
+}
+
+func newLazyImage(data []byte, state spuDisplayState, metadata IdxMetadata, opts RenderOptions) *LazyImage {
+	opts.Lazy = false
+	return &LazyImage{
+		data:     data,
+		state:    state,
+		metadata: metadata,
+		opts:     opts,
+		bounds:   state.bounds(metadata, opts),
+	}
+}
+
+// Render returns the rasterized subtitle, rasterizing it only if it is not kept already.
+func (li *LazyImage) Render() (img image.Image, err error) {
+	rendered := li.render()
+	return rendered.img, rendered.err
+}
+
+// Release drops the rasterized image (or rasterization error) kept by the LazyImage, if any.
+func (li *LazyImage) Release() {
+	li.rendered.Store(nil)
+	if li.opts.Cache != nil {
+		li.opts.Cache.remove(li)
+	}
+}
+
+// render returns the kept rasterization result, rasterizing the subtitle first if needed.
+// Every access marks the image as the most recently used one of its cache.
+func (li *LazyImage) render() (rendered *lazyRender) {
+	if rendered = li.rendered.Load(); rendered != nil {
+		if rendered.err == nil && li.opts.Cache != nil {
+			li.opts.Cache.touch(li)
+		}
+		return
+	}
+	li.mutex.Lock()
+	defer li.mutex.Unlock()
+	if rendered = li.rendered.Load(); rendered != nil {
+		// rasterized meanwhile
+		if rendered.err == nil && li.opts.Cache != nil {
+			li.opts.Cache.touch(li)
+		}
+		return
+	}
+	rendered = new(lazyRender)
+	rendered.img, rendered.err = li.state.draw(li.data, li.metadata, li.opts)
+	li.rendered.Store(rendered)
+	if rendered.err == nil && li.opts.Cache != nil {
+		li.opts.Cache.add(li)
+	}
+	return
+}
+
+// ColorModel implements the image.Image interface.
+func (li *LazyImage) ColorModel() color.Model {
+	switch {
+	case li.opts.Binarize != nil && !li.opts.Binarize.OneBit:
+		return color.GrayModel
+	case li.opts.Binarize != nil || li.opts.Format == ImageFormatPaletted:
+		// the palette is only known once rasterized
+		if rendered := li.render(); rendered.err == nil {
+			return rendered.img.ColorModel()
+		}
+		return color.Palette{color.Transparent}
+	case li.opts.Format == ImageFormatNRGBA:
+		return color.NRGBAModel
+	default:
+		return color.RGBAModel
+	}
+}
+
+// Bounds implements the image.Image interface.
+func (li *LazyImage) Bounds() image.Rectangle {
+	if li.opts.Crop {
+		// the visible area is only known once rasterized
+		if rendered := li.render(); rendered.err == nil {
+			return rendered.img.Bounds()
+		}
+	}
+	return li.bounds
+}
+
+// At implements the image.Image interface.
+func (li *LazyImage) At(x, y int) color.Color {
+	if rendered := li.render(); rendered.err == nil {
+		return rendered.img.At(x, y)
+	}
+	return color.Transparent
+}
+
+// ImageCache bounds the number of rasterized lazy images kept in memory: beyond its capacity, the least recently
+// used ones are released (and rasterized again if needed). It is safe for concurrent use.
+type ImageCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[*LazyImage]*list.Element
+	order    *list.List // most recently used first
+	// front is the most recently used image: touching it again (on each pixel access) does not need to lock the cache
+	front atomic.Pointer[LazyImage]
+}
+
+// NewImageCache returns a cache keeping the capacity most recently used rasterized images.
+func NewImageCache(capacity int) *ImageCache {
+	return &ImageCache{
+		capacity: max(1, capacity),
+		entries:  make(map[*LazyImage]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+// Len returns the number of images currently cached.
+func (ic *ImageCache) Len() int {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	return ic.order.Len()
+}
+
+// Purge releases all the cached images.
+func (ic *ImageCache) Purge() {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	for key := range ic.entries {
+		key.rendered.Store(nil)
+	}
+	clear(ic.entries)
+	ic.order.Init()
+	ic.front.Store(nil)
+}
+
+// add records a newly rasterized image as the most recently used one, releasing the least recently used ones beyond capacity
+func (ic *ImageCache) add(key *LazyImage) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	ic.front.Store(key)
+	if element, found := ic.entries[key]; found {
+		ic.order.MoveToFront(element)
+		return
+	}
+	ic.entries[key] = ic.order.PushFront(key)
+	for ic.order.Len() > ic.capacity {
+		oldest := ic.order.Back()
+		evicted := oldest.Value.(*LazyImage)
+		evicted.rendered.Store(nil)
+		delete(ic.entries, evicted)
+		ic.order.Remove(oldest)
+	}
+}
+
+// touch marks a cached image as the most recently used one
+func (ic *ImageCache) touch(key *LazyImage) {
+	if ic.front.Load() == key {
+		return
+	}
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if element, found := ic.entries[key]; found {
+		ic.order.MoveToFront(element)
+		ic.front.Store(key)
+	}
+}
+
+func (ic *ImageCache) remove(key *LazyImage) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if element, found := ic.entries[key]; found {
+		delete(ic.entries, key)
+		ic.order.Remove(element)
+	}
+	ic.front.CompareAndSwap(key, nil)
+}
@@ -0,0 +1,53 @@
+package vobsub
+
+import (
+	"image"
+	"testing"
+)
+
+func TestImageCacheEviction(t *testing.T) {
+	palette := testPalette()
+	metadata := testMetadata(palette)
+	raw, err := NewSubtitleRaw(testSPUImage(image.Rect(100, 480, 200, 500)), palette, EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{0, 15, 15, 15},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewImageCache(2)
+	lazyImages := make([]*LazyImage, 3)
+	for index := range lazyImages {
+		img, _, _, err := raw.DecodeWithOptions(metadata, RenderOptions{Lazy: true, Cache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lazyImages[index] = img.(*LazyImage)
+	}
+	first, second, third := lazyImages[0], lazyImages[1], lazyImages[2]
+	// Pixel reads rasterize the images and update their recency
+	first.At(152, 490)
+	second.At(152, 490)
+	first.At(152, 490)
+	third.At(152, 490)
+	if cache.Len() != 2 {
+		t.Fatalf("cache holds %d images, expected 2", cache.Len())
+	}
+	if first.rendered.Load() == nil || third.rendered.Load() == nil {
+		t.Error("the most recently read images have been released")
+	}
+	if second.rendered.Load() != nil {
+		t.Error("the least recently read image has not been released")
+	}
+	// Released images are rasterized again when read
+	if _, _, _, a := second.At(152, 490).RGBA(); a == 0 {
+		t.Error("the released image has not been rasterized again")
+	}
+	if first.rendered.Load() != nil {
+		t.Error("the least recently read image has not been released")
+	}
+	cache.Purge()
+	if cache.Len() != 0 || second.rendered.Load() != nil || third.rendered.Load() != nil {
+		t.Error("purged images are still kept")
+	}
+}
@@ -0,0 +1,138 @@
+package vobsub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	packHeaderLength         = len(MPEGHeader{}) + len(PackHeader{}.Remaining)
+	pesHeaderLength          = 6 // start code + packet length
+	pesExtensionHeaderLength = 3
+	pesExtensionFirstByte    = pesExtensionMarker<<6 | 0b00000001 // not scrambled, normal priority, not aligned, not copyrighted, original
+	paddingStreamMinLength   = pesHeaderLength
+	subStreamIDMaxValue      = 0x1f
+)
+
+// SubWriter muxes subtitles (SPUs) into a .sub file: a MPEG-2 program stream made of fixed size packs.
+type SubWriter struct {
+	writer  io.Writer
+	written int64
+	scr     time.Duration
+	closed  bool
+	pack    [PackSize]byte
+}
+
+// NewSubWriter returns a SubWriter writing the .sub program stream to writer.
+// Close() must be called once all subtitles have been written in order to end the program stream.
+func NewSubWriter(writer io.Writer) *SubWriter {
+	return &SubWriter{
+		writer: writer,
+	}
+}
+
+// WriteSubtitle muxes the SPU of the subtitleID stream (0 to 31) to be presented at pts. Subtitles should be written in presentation order.
+// SPUs larger than a pack are split across several PES packets, only the first one carrying the PTS.
+// It returns the position of the subtitle first pack within the .sub file, to be referenced in the matching .idx file.
+func (sw *SubWriter) WriteSubtitle(subtitleID int, pts time.Duration, spu []byte) (filepos int64, err error) {
+	if sw.closed {
+		err = errors.New("the writer is closed")
+		return
+	}
+	if subtitleID < 0 || subtitleID > subStreamIDMaxValue {
+		err = fmt.Errorf("invalid subtitle stream ID %d: must be between 0 and %d", subtitleID, subStreamIDMaxValue)
+		return
+	}
+	if len(spu) == 0 {
+		err = errors.New("can not write an empty subtitle")
+		return
+	}
+	filepos = sw.written
+	// The SCR must allow the decoder to receive the whole subtitle before its presentation, without going backward
+	packDuration := time.Duration(PackSize) * time.Second / (ProgramMuxRateDVD * 50)
+	nbPacks := len(spu)/(PackSize-packHeaderLength-pesHeaderLength-pesExtensionHeaderLength-len(SubStreamID{})) + 1
+	if scr := pts - time.Duration(nbPacks)*packDuration; scr > sw.scr {
+		sw.scr = scr
+	}
+	// Write the packs
+	subStreamID := SubStreamID{byte(SubStreamIDBaseValue + subtitleID)}
+	var (
+		consumed int
+		nbWrite  int
+	)
+	for offset := 0; offset < len(spu); offset += consumed {
+		consumed = sw.buildPack(subStreamID, pts, offset == 0, spu[offset:])
+		nbWrite, err = sw.writer.Write(sw.pack[:])
+		sw.written += int64(nbWrite)
+		if err != nil {
+			err = fmt.Errorf("failed to write pack: %w", err)
+			return
+		}
+		sw.scr += packDuration
+	}
+	return
+}
+
+// Close writes the program end code. It does not close the underlying writer.
+func (sw *SubWriter) Close() (err error) {
+	if sw.closed {
+		return
+	}
+	sw.closed = true
+	nbWrite, err := sw.writer.Write([]byte{0x00, 0x00, 0x01, StreamIDProgramEnd})
+	sw.written += int64(nbWrite)
+	if err != nil {
+		err = fmt.Errorf("failed to write program end code: %w", err)
+	}
+	return
+}
+
+// buildPack fills the pack buffer with a pack containing as much payload as possible and returns the number of payload bytes consumed
+func (sw *SubWriter) buildPack(subStreamID SubStreamID, pts time.Duration, withPTS bool, payload []byte) (consumed int) {
+	// Pack header
+	ph := NewPackHeader(sw.scr, ProgramMuxRateDVD)
+	index := copy(sw.pack[:], ph.MPH[:])
+	index += copy(sw.pack[index:], ph.Remaining[:])
+	// PES extension
+	extension := PESExtension{
+		Header: [3]byte{pesExtensionFirstByte, byte(NoPTSorDTSPresent) << 6, 0},
+	}
+	if withPTS {
+		extension.Header[1] = byte(JustPTS) << 6
+		extension.Data.SetPTS(pts)
+	}
+	// Compute payload and padding sizes
+	available := PackSize - index - pesHeaderLength - len(extension.Header) - len(extension.Data.PTS) - len(subStreamID)
+	consumed = min(len(payload), available)
+	padding := available - consumed
+	stuffing := 0
+	if padding > 0 && padding < paddingStreamMinLength {
+		// too small for a padding stream, use PES header stuffing bytes instead
+		stuffing = padding
+		padding = 0
+	}
+	extension.Header[2] = byte(len(extension.Data.PTS) + stuffing)
+	// PES header
+	packetLength := len(extension.Header) + int(extension.Header[2]) + len(subStreamID) + consumed
+	index += copy(sw.pack[index:], []byte{0x00, 0x00, 0x01, StreamIDPrivateStream1, byte(packetLength >> 8), byte(packetLength)})
+	index += copy(sw.pack[index:], extension.Header[:])
+	index += copy(sw.pack[index:], extension.Data.PTS)
+	for range stuffing {
+		sw.pack[index] = 0xff
+		index++
+	}
+	index += copy(sw.pack[index:], subStreamID[:])
+	// Payload
+	index += copy(sw.pack[index:], payload[:consumed])
+	// Padding stream
+	if padding > 0 {
+		paddingLength := padding - pesHeaderLength
+		index += copy(sw.pack[index:], []byte{0x00, 0x00, 0x01, StreamIDPaddingStream, byte(paddingLength >> 8), byte(paddingLength)})
+		for ; index < PackSize; index++ {
+			sw.pack[index] = 0xff
+		}
+	}
+	return
+}
@@ -0,0 +1,614 @@
+package vobsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	// OCRUnknownGlyph is the text used for glyphs missing from the database
+	OCRUnknownGlyph = "�"
+	// OCRDefaultMinSimilarity is the default minimum similarity (0 to 1) for a glyph to match a database entry
+	OCRDefaultMinSimilarity = 0.75
+	// OCRDefaultSpaceRatio is the default minimum gap between 2 glyphs, relative to the tallest glyph of the line,
+	// to insert a space
+	OCRDefaultSpaceRatio = 0.35
+
+	ocrMinGlyphPixels      = 3   // smaller connected components are noise
+	ocrGlyphOverlapRatio   = 0.5 // components overlapping more than this (relative to the narrowest) are the same glyph
+	ocrSmallBandRatio      = 0.5 // line bands smaller than this (relative to the tallest) are parts of a nearby line
+	ocrSizeTolerance       = 2   // in pixels
+	ocrSizeToleranceRatio  = 0.2
+	ocrBaselineTolerance   = 2 // in pixels
+	ocrBaselineToleranceOf = 4 // fraction of the glyph height also tolerated
+	ocrItalicOpen          = "<i>"
+	ocrItalicClose         = "</i>"
+)
+
+/*
+	Glyphs database
+*/
+
+// GlyphBitmap is the 1 bit image of a glyph: ink pixels are set
+type GlyphBitmap struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Bits   []byte `json:"bits"` // row major, most significant bit first
+}
+
+func newGlyphBitmap(width, height int) GlyphBitmap {
+	return GlyphBitmap{
+		Width:  width,
+		Height: height,
+		Bits:   make([]byte, (width*height+7)/8),
+	}
+}
+
+// At returns true if the pixel at x, y is ink.
+func (gb GlyphBitmap) At(x, y int) bool {
+	if x < 0 || y < 0 || x >= gb.Width || y >= gb.Height {
+		return false
+	}
+	index := y*gb.Width + x
+	return gb.Bits[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (gb GlyphBitmap) set(x, y int) {
+	index := y*gb.Width + x
+	gb.Bits[index/8] |= 0x80 >> (index % 8)
+}
+
+// Image returns the glyph as a black on white image, to be displayed for training.
+func (gb GlyphBitmap) Image() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, gb.Width, gb.Height))
+	for y := range gb.Height {
+		for x := range gb.Width {
+			if !gb.At(x, y) {
+				img.Pix[y*img.Stride+x] = 0xff
+			}
+		}
+	}
+	return img
+}
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (gb GlyphBitmap) String() string {
+	var builder strings.Builder
+	for y := range gb.Height {
+		for x := range gb.Width {
+			if gb.At(x, y) {
+				builder.WriteByte('#')
+			} else {
+				builder.WriteByte('.')
+			}
+		}
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+// Glyph is a database entry: the bitmap of a glyph and its text.
+// The text can contain several characters for glyphs touching each other (ligatures like "fi" or "rn").
+type Glyph struct {
+	Text   string      `json:"text"`
+	Italic bool        `json:"italic,omitempty"`
+	Bitmap GlyphBitmap `json:"bitmap"`
+	// BaselineOffset is the position of the glyph bottom relative to the line baseline (positive for descenders)
+	// allowing to distinguish glyphs with the same shape like ',' and '\''
+	BaselineOffset int `json:"baseline_offset"`
+}
+
+// GlyphDB is a trainable database of glyphs. It is safe for concurrent use.
+type GlyphDB struct {
+	mutex  sync.RWMutex
+	glyphs []Glyph
+}
+
+// NewGlyphDB returns an empty glyphs database.
+func NewGlyphDB() *GlyphDB {
+	return new(GlyphDB)
+}
+
+// LoadGlyphDB reads a glyphs database file previously written by GlyphDB.Save().
+func LoadGlyphDB(file string) (db *GlyphDB, err error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		err = fmt.Errorf("failed to open file: %w", err)
+		return
+	}
+	defer fd.Close()
+	return ReadGlyphDB(fd)
+}
+
+// ReadGlyphDB reads a glyphs database previously written by GlyphDB.Write().
+func ReadGlyphDB(reader io.Reader) (db *GlyphDB, err error) {
+	var glyphs []Glyph
+	if err = json.NewDecoder(reader).Decode(&glyphs); err != nil {
+		err = fmt.Errorf("failed to decode glyphs database: %w", err)
+		return
+	}
+	db = NewGlyphDB()
+	for index, glyph := range glyphs {
+		if err = db.Add(glyph); err != nil {
+			err = fmt.Errorf("invalid glyph #%d: %w", index+1, err)
+			return
+		}
+	}
+	return
+}
+
+// Save writes the database to file.
+func (db *GlyphDB) Save(file string) (err error) {
+	fd, err := os.Create(file)
+	if err != nil {
+		err = fmt.Errorf("failed to create file: %w", err)
+		return
+	}
+	defer fd.Close()
+	if err = db.Write(fd); err != nil {
+		return
+	}
+	return fd.Close()
+}
+
+// Write writes the database to writer (JSON).
+func (db *GlyphDB) Write(writer io.Writer) (err error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "\t")
+	if err = encoder.Encode(db.glyphs); err != nil {
+		err = fmt.Errorf("failed to encode glyphs database: %w", err)
+	}
+	return
+}
+
+// Add adds a glyph to the database.
+func (db *GlyphDB) Add(glyph Glyph) error {
+	if glyph.Text == "" {
+		return errors.New("empty glyph text")
+	}
+	if glyph.Bitmap.Width <= 0 || glyph.Bitmap.Height <= 0 || len(glyph.Bitmap.Bits) != (glyph.Bitmap.Width*glyph.Bitmap.Height+7)/8 {
+		return fmt.Errorf("invalid %dx%d bitmap with %d bytes", glyph.Bitmap.Width, glyph.Bitmap.Height, len(glyph.Bitmap.Bits))
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.glyphs = append(db.glyphs, glyph)
+	return nil
+}
+
+// Train adds the unknown glyph to the database with its text.
+func (db *GlyphDB) Train(unknown UnknownGlyph, text string, italic bool) error {
+	return db.Add(Glyph{
+		Text:           text,
+		Italic:         italic,
+		Bitmap:         unknown.Bitmap,
+		BaselineOffset: unknown.BaselineOffset,
+	})
+}
+
+// Len returns the number of glyphs within the database.
+func (db *GlyphDB) Len() int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return len(db.glyphs)
+}
+
+// match returns the best matching glyph and its similarity (0 to 1)
+func (db *GlyphDB) match(bitmap GlyphBitmap, baselineOffset int) (best *Glyph, similarity float64) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	for index := range db.glyphs {
+		glyph := &db.glyphs[index]
+		if !closeTo(glyph.Bitmap.Width, bitmap.Width) || !closeTo(glyph.Bitmap.Height, bitmap.Height) {
+			continue
+		}
+		if abs(glyph.BaselineOffset-baselineOffset) > ocrBaselineTolerance+bitmap.Height/ocrBaselineToleranceOf {
+			continue
+		}
+		if candidate := compareBitmaps(glyph.Bitmap, bitmap); candidate > similarity {
+			best, similarity = glyph, candidate
+		}
+	}
+	return
+}
+
+func closeTo(reference, value int) bool {
+	return abs(reference-value) <= max(ocrSizeTolerance, int(float64(reference)*ocrSizeToleranceRatio))
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// compareBitmaps returns the ratio of common ink pixels over all the ink pixels (Jaccard index) of the 2 bitmaps.
+// The reference is stretched to the candidate size and shifted by up to 1 pixel to find the best alignment.
+func compareBitmaps(reference, candidate GlyphBitmap) (best float64) {
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			var common, total int
+			for y := range candidate.Height {
+				refY := rescaleIndex(y+dy, candidate.Height, reference.Height)
+				for x := range candidate.Width {
+					refX := rescaleIndex(x+dx, candidate.Width, reference.Width)
+					refInk, ink := reference.At(refX, refY), candidate.At(x, y)
+					if refInk && ink {
+						common++
+					}
+					if refInk || ink {
+						total++
+					}
+				}
+			}
+			if total > 0 {
+				best = max(best, float64(common)/float64(total))
+			}
+		}
+	}
+	return
+}
+
+// rescaleIndex maps a pixel index from a size to another one (negative indexes stay out of bounds)
+func rescaleIndex(index, from, to int) int {
+	if index < 0 {
+		return -1
+	}
+	return index * to / from
+}
+
+/*
+	Recognizer
+*/
+
+// Recognizer recognizes the text of subtitles images. Implementations must be safe for concurrent use.
+// TemplateOCR is the built-in implementation, other OCR engines can be plugged in by implementing it.
+type Recognizer interface {
+	// Recognize returns the text of the image (lines separated by \n, italic runs surrounded by <i> and </i>)
+	// and the confidence (0 to 1) of the recognition.
+	Recognize(img image.Image) (result OCRResult, err error)
+}
+
+var _ Recognizer = (*TemplateOCR)(nil)
+
+// TemplateOCR recognizes the text of subtitles images by comparing their glyphs with the ones of a glyphs database.
+// Images are binarized (see BinarizeOptions), split into lines then glyphs (connected pixels, the ones stacked
+// vertically like the dot of an 'i' being merged). Each glyph is compared to the database glyphs of about the same size
+// and position relative to the line baseline. Glyphs without match are tried merged with the next one (glyphs split in
+// several parts) then reported as unknown, to be trained. Runs of italic glyphs are surrounded by <i> and </i>.
+// Images already binarized (*image.Gray) are used as is: dark pixels are ink (bright pixels if Binarize.Inverse is set).
+type TemplateOCR struct {
+	DB *GlyphDB
+	// Binarize defines how colors are classified as ink. Padding and upscaling are ignored.
+	Binarize BinarizeOptions
+	// MinSimilarity is the minimum similarity (0 to 1) for a glyph to match a database entry, OCRDefaultMinSimilarity if zero
+	MinSimilarity float64
+	// SpaceRatio is the minimum gap between 2 glyphs, relative to the tallest glyph of the line, to insert a space,
+	// OCRDefaultSpaceRatio if zero
+	SpaceRatio float64
+}
+
+// NewTemplateOCR returns a recognizer using db with the default settings.
+func NewTemplateOCR(db *GlyphDB) *TemplateOCR {
+	return &TemplateOCR{
+		DB:            db,
+		MinSimilarity: OCRDefaultMinSimilarity,
+		SpaceRatio:    OCRDefaultSpaceRatio,
+	}
+}
+
+// OCRResult is the text recognized within a subtitle image
+type OCRResult struct {
+	Text string // lines are separated by \n
+	// Confidence of the recognition: 0 to 1. For TemplateOCR, it is the mean similarity of the glyphs (unknown glyphs count as 0).
+	Confidence float64
+	// Unknown contains the glyphs without match (TemplateOCR only)
+	Unknown []UnknownGlyph
+}
+
+// UnknownGlyph is a glyph without match within the database
+type UnknownGlyph struct {
+	Bitmap         GlyphBitmap
+	BaselineOffset int
+	Line           int    // index of the line within the subtitle
+	Context        string // text of the line, the unknown glyphs being OCRUnknownGlyph
+	// WithNext is the glyph merged with the next one, if they are close enough: train it instead of the glyph alone
+	// for glyphs made of separate parts (like '"') or ligatures
+	WithNext *UnknownGlyph
+}
+
+// Recognize returns the text of the subtitle image.
+func (ocr *TemplateOCR) Recognize(img image.Image) (result OCRResult, err error) {
+	if ocr.DB == nil {
+		err = errors.New("no glyphs database")
+		return
+	}
+	if lazy, ok := img.(*LazyImage); ok {
+		if img, err = lazy.Render(); err != nil {
+			err = fmt.Errorf("failed to render lazy image: %w", err)
+			return
+		}
+	}
+	mask := ocr.inkMask(img)
+	var (
+		lines       []string
+		similarity  float64
+		nbGlyphs    int
+		lineUnknown []UnknownGlyph
+	)
+	for _, band := range mask.lines() {
+		text, lineSimilarity, lineGlyphs, unknown := ocr.recognizeLine(mask, band)
+		if lineGlyphs == 0 {
+			continue
+		}
+		for _, glyph := range unknown {
+			glyph.Line = len(lines)
+			glyph.Context = text
+			lineUnknown = append(lineUnknown, glyph)
+		}
+		lines = append(lines, text)
+		similarity += lineSimilarity
+		nbGlyphs += lineGlyphs
+	}
+	result.Text = strings.Join(lines, "\n")
+	result.Unknown = lineUnknown
+	if nbGlyphs > 0 {
+		result.Confidence = similarity / float64(nbGlyphs)
+	}
+	return
+}
+
+// recognizeLine returns the text of a line, the sum of its glyphs similarities and its number of glyphs
+func (ocr *TemplateOCR) recognizeLine(mask inkMask, band lineBand) (text string, similarity float64, nbGlyphs int, unknown []UnknownGlyph) {
+	glyphs := mask.glyphs(band)
+	if len(glyphs) == 0 {
+		return
+	}
+	// Line metrics: the baseline is the most common bottom of the tall glyphs (punctuation is not reliable)
+	tallest := 0
+	for _, glyph := range glyphs {
+		tallest = max(tallest, glyph.bounds.Dy())
+	}
+	bottoms := make(map[int]int, len(glyphs))
+	for _, glyph := range glyphs {
+		if glyph.bounds.Dy()*2 >= tallest {
+			bottoms[glyph.bounds.Max.Y]++
+		}
+	}
+	baseline, count := 0, 0
+	for bottom, nb := range bottoms {
+		if nb > count || (nb == count && bottom < baseline) {
+			baseline, count = bottom, nb
+		}
+	}
+	minSimilarity, spaceRatio := ocr.MinSimilarity, ocr.SpaceRatio
+	if minSimilarity == 0 {
+		minSimilarity = OCRDefaultMinSimilarity
+	}
+	if spaceRatio == 0 {
+		spaceRatio = OCRDefaultSpaceRatio
+	}
+	spaceGap := max(1, float64(tallest)*spaceRatio)
+	// Recognize the glyphs
+	var (
+		builder strings.Builder
+		italic  bool
+		lastX   = glyphs[0].bounds.Min.X
+	)
+	// write writes the glyph text, preceded by a space if needed, opening or closing the italic run outside of the space
+	write := func(text string, glyphItalic, space bool) {
+		if glyphItalic != italic && !glyphItalic {
+			builder.WriteString(ocrItalicClose)
+		}
+		if space {
+			builder.WriteByte(' ')
+		}
+		if glyphItalic != italic && glyphItalic {
+			builder.WriteString(ocrItalicOpen)
+		}
+		italic = glyphItalic
+		builder.WriteString(text)
+	}
+	for index := 0; index < len(glyphs); index++ {
+		glyph := glyphs[index]
+		space := index > 0 && float64(glyph.bounds.Min.X-lastX) >= spaceGap
+		bitmap := glyph.bitmap(mask)
+		offset := glyph.bounds.Max.Y - baseline
+		match, matchSimilarity := ocr.DB.match(bitmap, offset)
+		var withNext *UnknownGlyph
+		if matchSimilarity < minSimilarity && index+1 < len(glyphs) &&
+			float64(glyphs[index+1].bounds.Min.X-glyph.bounds.Max.X) < spaceGap {
+			// try with the next glyph: parts of a single glyph (like '"') or a ligature
+			merged := glyph.merge(glyphs[index+1])
+			withNext = &UnknownGlyph{
+				Bitmap:         merged.bitmap(mask),
+				BaselineOffset: merged.bounds.Max.Y - baseline,
+			}
+			if pairMatch, pairSimilarity := ocr.DB.match(withNext.Bitmap, withNext.BaselineOffset); pairSimilarity >= minSimilarity {
+				match, matchSimilarity, glyph = pairMatch, pairSimilarity, merged
+				index++
+			}
+		}
+		nbGlyphs++
+		lastX = glyph.bounds.Max.X
+		if matchSimilarity < minSimilarity {
+			unknown = append(unknown, UnknownGlyph{
+				Bitmap:         bitmap,
+				BaselineOffset: offset,
+				WithNext:       withNext,
+			})
+			write(OCRUnknownGlyph, italic, space)
+			continue
+		}
+		write(match.Text, match.Italic, space)
+		similarity += matchSimilarity
+	}
+	if italic {
+		builder.WriteString(ocrItalicClose)
+	}
+	text = builder.String()
+	return
+}
+
+/*
+	Segmentation
+*/
+
+// inkMask contains the ink pixels of an image
+type inkMask struct {
+	width, height int
+	ink           []bool
+}
+
+func (ocr *TemplateOCR) inkMask(img image.Image) (mask inkMask) {
+	bounds := img.Bounds()
+	if gray, ok := img.(*image.Gray); !ok {
+		opts := ocr.Binarize
+		opts.Padding, opts.Upscale, opts.Inverse, opts.OneBit = 0, 0, false, false
+		img = Binarize(img, opts)
+	} else if ocr.Binarize.Inverse {
+		// white ink on black
+		inverted := image.NewGray(bounds)
+		for index, value := range gray.Pix {
+			inverted.Pix[index] = 0xff - value
+		}
+		img = inverted
+	}
+	gray := img.(*image.Gray)
+	mask.width, mask.height = bounds.Dx(), bounds.Dy()
+	mask.ink = make([]bool, mask.width*mask.height)
+	for y := range mask.height {
+		for x := range mask.width {
+			mask.ink[y*mask.width+x] = gray.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y < 0x80
+		}
+	}
+	return
+}
+
+type lineBand struct {
+	top, bottom int // bottom excluded
+}
+
+// lines returns the bands of rows containing the text lines
+func (mask inkMask) lines() (bands []lineBand) {
+	// Rows with ink
+	inBand := false
+	for y := range mask.height {
+		if slices.Contains(mask.ink[y*mask.width:(y+1)*mask.width], true) {
+			if !inBand {
+				bands = append(bands, lineBand{top: y})
+				inBand = true
+			}
+			bands[len(bands)-1].bottom = y + 1
+		} else {
+			inBand = false
+		}
+	}
+	// Merge the small bands (accents, dots) with their closest neighbor
+	for merged := true; merged && len(bands) > 1; {
+		merged = false
+		tallest := 0
+		for _, band := range bands {
+			tallest = max(tallest, band.bottom-band.top)
+		}
+		for index, band := range bands {
+			if float64(band.bottom-band.top) >= float64(tallest)*ocrSmallBandRatio {
+				continue
+			}
+			target, gap := -1, tallest/2+1
+			if index > 0 && band.top-bands[index-1].bottom < gap {
+				target, gap = index-1, band.top-bands[index-1].bottom
+			}
+			if index+1 < len(bands) && bands[index+1].top-band.bottom < gap {
+				target = index + 1
+			}
+			if target == -1 {
+				continue
+			}
+			bands[target] = lineBand{top: min(bands[target].top, band.top), bottom: max(bands[target].bottom, band.bottom)}
+			bands = slices.Delete(bands, index, index+1)
+			merged = true
+			break
+		}
+	}
+	return
+}
+
+// glyphPart is a glyph candidate made of one or several connected components
+type glyphPart struct {
+	bounds image.Rectangle
+	pixels []image.Point
+}
+
+func (gp glyphPart) merge(other glyphPart) glyphPart {
+	return glyphPart{
+		bounds: gp.bounds.Union(other.bounds),
+		pixels: append(gp.pixels[:len(gp.pixels):len(gp.pixels)], other.pixels...),
+	}
+}
+
+func (gp glyphPart) bitmap(mask inkMask) (bitmap GlyphBitmap) {
+	bitmap = newGlyphBitmap(gp.bounds.Dx(), gp.bounds.Dy())
+	for _, pixel := range gp.pixels {
+		bitmap.set(pixel.X-gp.bounds.Min.X, pixel.Y-gp.bounds.Min.Y)
+	}
+	return
+}
+
+// glyphs returns the glyphs of a line, from left to right
+func (mask inkMask) glyphs(band lineBand) (glyphs []glyphPart) {
+	// Connected components (8-connectivity) within the band
+	visited := make([]bool, mask.width*(band.bottom-band.top))
+	var stack []image.Point
+	for y := band.top; y < band.bottom; y++ {
+		for x := range mask.width {
+			if !mask.ink[y*mask.width+x] || visited[(y-band.top)*mask.width+x] {
+				continue
+			}
+			part := glyphPart{bounds: image.Rect(x, y, x+1, y+1)}
+			visited[(y-band.top)*mask.width+x] = true
+			stack = append(stack[:0], image.Pt(x, y))
+			for len(stack) > 0 {
+				pixel := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				part.pixels = append(part.pixels, pixel)
+				part.bounds = part.bounds.Union(image.Rect(pixel.X, pixel.Y, pixel.X+1, pixel.Y+1))
+				for ny := max(pixel.Y-1, band.top); ny <= min(pixel.Y+1, band.bottom-1); ny++ {
+					for nx := max(pixel.X-1, 0); nx <= min(pixel.X+1, mask.width-1); nx++ {
+						if mask.ink[ny*mask.width+nx] && !visited[(ny-band.top)*mask.width+nx] {
+							visited[(ny-band.top)*mask.width+nx] = true
+							stack = append(stack, image.Pt(nx, ny))
+						}
+					}
+				}
+			}
+			if len(part.pixels) >= ocrMinGlyphPixels {
+				glyphs = append(glyphs, part)
+			}
+		}
+	}
+	slices.SortFunc(glyphs, func(a, b glyphPart) int { return a.bounds.Min.X - b.bounds.Min.X })
+	// Merge the components stacked vertically
+	for index := 0; index+1 < len(glyphs); {
+		current, next := glyphs[index], glyphs[index+1]
+		overlap := min(current.bounds.Max.X, next.bounds.Max.X) - max(current.bounds.Min.X, next.bounds.Min.X)
+		if float64(overlap) >= float64(min(current.bounds.Dx(), next.bounds.Dx()))*ocrGlyphOverlapRatio {
+			glyphs[index] = current.merge(next)
+			glyphs = slices.Delete(glyphs, index+1, index+2)
+			continue
+		}
+		index++
+	}
+	return
+}
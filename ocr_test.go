@@ -0,0 +1,134 @@
+package vobsub
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// testTextImage returns a binarized image (black ink on white) made of the ink rectangles
+func testTextImage(ink ...image.Rectangle) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 100, 40))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for _, rect := range ink {
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				img.SetGray(x, y, color.Gray{})
+			}
+		}
+	}
+	return img
+}
+
+var (
+	testGlyphI = []image.Rectangle{image.Rect(10, 10, 14, 30)}
+	testGlyphL = []image.Rectangle{image.Rect(20, 10, 24, 30), image.Rect(20, 26, 32, 30)}
+	testGlyphT = []image.Rectangle{image.Rect(44, 10, 56, 14), image.Rect(48, 10, 52, 30)}
+)
+
+// testTrainedDB returns a glyphs database trained with "IL T"
+func testTrainedDB(t *testing.T) (db *GlyphDB, img *image.Gray) {
+	t.Helper()
+	img = testTextImage(append(append(append([]image.Rectangle{}, testGlyphI...), testGlyphL...), testGlyphT...)...)
+	db = NewGlyphDB()
+	ocr := &TemplateOCR{DB: db} // default settings
+	result, err := ocr.Recognize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Unknown) != 3 || result.Text != OCRUnknownGlyph+OCRUnknownGlyph+" "+OCRUnknownGlyph {
+		t.Fatalf("unexpected recognition with an empty database: %q (%d unknown glyphs)", result.Text, len(result.Unknown))
+	}
+	for index, text := range []string{"I", "L", "T"} {
+		if err = db.Train(result.Unknown[index], text, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestTemplateOCRTrained(t *testing.T) {
+	db, img := testTrainedDB(t)
+	result, err := (&TemplateOCR{DB: db}).Recognize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "IL T" || len(result.Unknown) != 0 || result.Confidence != 1 {
+		t.Errorf("got %q (%d unknown glyphs, confidence %f), expected \"IL T\"", result.Text, len(result.Unknown), result.Confidence)
+	}
+}
+
+func TestTemplateOCRUnknownAndPairs(t *testing.T) {
+	db, _ := testTrainedDB(t)
+	ocr := NewTemplateOCR(db)
+	// I, a ring and a double quote made of 2 ticks
+	img := testTextImage(
+		image.Rect(10, 10, 14, 30),
+		image.Rect(24, 16, 36, 18), image.Rect(24, 28, 36, 30), image.Rect(24, 16, 26, 30), image.Rect(34, 16, 36, 30),
+		image.Rect(50, 10, 52, 15), image.Rect(54, 10, 56, 15),
+	)
+	result, err := ocr.Recognize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := OCRUnknownGlyph
+	if expected := "I " + unknown + " " + unknown + unknown; result.Text != expected {
+		t.Fatalf("got %q, expected %q", result.Text, expected)
+	}
+	if len(result.Unknown) != 3 || result.Unknown[0].Context != result.Text || result.Unknown[1].WithNext == nil {
+		t.Fatalf("unexpected unknown glyphs: %+v", result.Unknown)
+	}
+	if result.Confidence != 0.25 {
+		t.Errorf("got confidence %f, expected 0.25", result.Confidence)
+	}
+	// Train the ticks pair: both ticks are then recognized as a single glyph
+	if err = db.Train(*result.Unknown[1].WithNext, `"`, false); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = ocr.Recognize(img); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "I " + unknown + ` "`; result.Text != expected || len(result.Unknown) != 1 {
+		t.Errorf("got %q (%d unknown glyphs), expected %q", result.Text, len(result.Unknown), expected)
+	}
+}
+
+func TestGlyphDBRoundTrip(t *testing.T) {
+	db, img := testTrainedDB(t)
+	if err := db.Add(Glyph{Text: "x", Italic: true, Bitmap: newGlyphBitmap(3, 3), BaselineOffset: 2}); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "glyphs.json")
+	if err := db.Save(file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadGlyphDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var original, reloaded bytes.Buffer
+	if err = db.Write(&original); err != nil {
+		t.Fatal(err)
+	}
+	if err = loaded.Write(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len() != db.Len() || original.String() != reloaded.String() {
+		t.Errorf("loaded database differs:\n%s\nexpected:\n%s", reloaded.String(), original.String())
+	}
+	result, err := NewTemplateOCR(loaded).Recognize(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Text != "IL T" {
+		t.Errorf("got %q with the loaded database, expected \"IL T\"", result.Text)
+	}
+	// Invalid glyphs are rejected
+	if _, err = ReadGlyphDB(bytes.NewReader([]byte(`[{"text":"a","bitmap":{"width":2,"height":2,"bits":"AAAA"}}]`))); err == nil {
+		t.Error("expected an error for a bitmap of the wrong size")
+	}
+}
@@ -0,0 +1,819 @@
+package vobsub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// pgsCode returns the frame rate code of the PGS composition segments
+func (fr FrameRate) pgsCode() (code uint8, err error) {
+	switch fr {
+	case FrameRate23976:
+		code = 0x10
+	case FrameRate24:
+		code = 0x20
+	case FrameRate25:
+		code = 0x30
+	case FrameRate2997:
+		code = 0x40
+	case FrameRate50:
+		code = 0x60
+	case FrameRate5994:
+		code = 0x70
+	default:
+		err = fmt.Errorf("unsupported frame rate: %s", fr)
+	}
+	return
+}
+
+const (
+	pgsMagic               = "PG"
+	pgsSegmentHeaderLength = 13
+	pgsMaxSegmentPayload   = 0xffff
+	pgsMaxPaletteSize      = 256
+	pgsMaxRunLength        = 0x3fff
+	pgsMaxObjectDataLength = 0xffffff
+	// Segment types
+	pgsSegmentPDS = 0x14
+	pgsSegmentODS = 0x15
+	pgsSegmentPCS = 0x16
+	pgsSegmentWDS = 0x17
+	pgsSegmentEND = 0x80
+	// Composition states
+	pgsCompositionNormal           = 0x00
+	pgsCompositionAcquisitionPoint = 0x40
+	pgsCompositionEpochStart       = 0x80
+	// Composition object flags
+	pgsObjectCropped = 0x80
+	pgsObjectForced  = 0x40
+	// Object fragments flags
+	pgsFragmentFirst = 0x80
+	pgsFragmentLast  = 0x40
+	// Length of the ODS payload header (object ID, version and fragment flags)
+	pgsODSHeaderLength = 4
+)
+
+// PGSUpscaleSize is the size of the video frame subtitles are upscaled to (see PGSOptions.Upscale)
+var PGSUpscaleSize = image.Point{X: 1920, Y: 1080}
+
+// PGSOptions defines how subtitles are written as a Blu-ray PGS (Presentation Graphic Stream) .sup file
+type PGSOptions struct {
+	// FrameRate of the video, written within the composition segments
+	FrameRate FrameRate
+	// Upscale scales the subtitles from their video frame (their placement canvas) to a 1920x1080 one, using
+	// UpscaleFilter and the pixel aspect ratio of the source video (see ScaleOptions for details)
+	Upscale          bool
+	UpscaleFilter    ScaleFilter
+	PixelAspectRatio PixelAspectRatio
+}
+
+// WritePGSFile writes the subtitles of a stream as a Blu-ray PGS .sup file. See WritePGS().
+func WritePGSFile(file string, subtitles []Subtitle, opts PGSOptions) (err error) {
+	fd, err := os.Create(file)
+	if err != nil {
+		err = fmt.Errorf("failed to create file: %w", err)
+		return
+	}
+	defer fd.Close()
+	if err = WritePGS(fd, subtitles, opts); err != nil {
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close file: %w", err)
+	}
+	return
+}
+
+// WritePGS writes the subtitles of a stream as a Blu-ray PGS stream (.sup file). Subtitles must share the same canvas
+// (the video size) and are sorted by start time. Images are placed using their Placement, cropped to their visible
+// pixels and quantized to 256 colors if needed. Palettes are written as YCbCr using the BT.709 matrix for HD videos and
+// the BT.601 one for SD videos (576 lines or less).
+// Each subtitle is displayed by a display set starting a new epoch (or an acquisition point when it replaces the
+// previous subtitle without a gap) and removed by an empty display set at its stop time. Subtitles without stop time
+// are displayed until the next one.
+func WritePGS(writer io.Writer, subtitles []Subtitle, opts PGSOptions) (err error) {
+	// Get the video frame
+	canvas, err := commonCanvas(subtitles)
+	if err != nil {
+		return
+	}
+	if len(subtitles) == 0 {
+		return
+	}
+	var scaler *Scaler
+	if opts.Upscale {
+		if scaler, err = NewScaler(canvas.Size(), ScaleOptions{
+			Size:             PGSUpscaleSize,
+			PixelAspectRatio: opts.PixelAspectRatio,
+			Filter:           opts.UpscaleFilter,
+		}); err != nil {
+			err = fmt.Errorf("invalid upscale options: %w", err)
+			return
+		}
+	}
+	pw := pgsWriter{
+		buffer: bufio.NewWriter(writer),
+		video:  canvas,
+	}
+	if scaler != nil {
+		pw.video = scaler.target
+	}
+	if pw.frameRate, err = opts.FrameRate.resolve(pw.video.Dy()).pgsCode(); err != nil {
+		return
+	}
+	pw.space = pgsColorSpace(pw.video.Dy())
+	// Prepare the objects
+	objects := make([]pgsObject, 0, len(subtitles))
+	for index, sub := range subtitles {
+		var object pgsObject
+		if object, err = newPGSObject(sub, scaler); err != nil {
+			err = fmt.Errorf("failed to prepare subtitle #%d: %w", index+1, err)
+			return
+		}
+		if object.rect.Empty() {
+			continue // nothing visible
+		}
+		objects = append(objects, object)
+	}
+	sort.SliceStable(objects, func(i, j int) bool { return objects[i].start < objects[j].start })
+	// Group the subtitles displayed without interruption within epochs
+	for start := 0; start < len(objects); {
+		end := start + 1
+		window := objects[start].rect
+		for end < len(objects) && (objects[end-1].stop <= objects[end-1].start || objects[end].start <= objects[end-1].stop) {
+			window = window.Union(objects[end].rect)
+			end++
+		}
+		if err = pw.writeEpoch(objects[start:end], window); err != nil {
+			return
+		}
+		start = end
+	}
+	if err = pw.buffer.Flush(); err != nil {
+		err = fmt.Errorf("failed to write PGS stream: %w", err)
+	}
+	return
+}
+
+// pgsObject is a subtitle ready to be written as a PGS object
+type pgsObject struct {
+	start, stop int64 // 90 kHz ticks
+	forced      bool
+	rect        image.Rectangle // on the video frame
+	palette     []color.NRGBA
+	rle         []byte
+}
+
+func newPGSObject(sub Subtitle, scaler *Scaler) (object pgsObject, err error) {
+	object.start = pgsTicks(sub.Start)
+	object.stop = pgsTicks(sub.Stop)
+	object.forced = sub.Forced
+	img, err := placedImage(sub, scaler)
+	if err != nil {
+		return
+	}
+	object.rect = img.Bounds()
+	if object.rect.Empty() {
+		return
+	}
+	if object.rect.Dx() > pgsMaxRunLength || object.rect.Dy() > 0xffff {
+		err = fmt.Errorf("subtitle is too large: %v", object.rect.Size())
+		return
+	}
+	// Encode it
+	var pix []uint8
+	object.palette, pix = quantizePGS(img)
+	width := object.rect.Dx()
+	for y := 0; y < object.rect.Dy(); y++ {
+		object.rle = encodePGSLine(object.rle, pix[y*width:(y+1)*width])
+	}
+	if len(object.rle)+4 > pgsMaxObjectDataLength {
+		err = fmt.Errorf("encoded subtitle is too large: %d bytes", len(object.rle))
+	}
+	return
+}
+
+// pgsColorSpace returns the color space of the palettes of a video with the given height: BT.601 for SD videos and
+// BT.709 for HD ones
+func pgsColorSpace(height int) YCbCrSpace {
+	if height <= 576 {
+		return YCbCrSpaceDVD
+	}
+	return YCbCrSpaceBluRay
+}
+
+// pgsTicks converts a timestamp to 90 kHz ticks
+func pgsTicks(timestamp time.Duration) int64 {
+	return int64(timestamp/time.Second)*PTSDTSClockFrequency + int64(timestamp%time.Second)*PTSDTSClockFrequency/int64(time.Second)
+}
+
+// quantizePGS returns the palette (transparent color first) and the palette index of each pixel of img.
+// Images with more than 256 colors have their colors precision reduced until they fit, each reduced color being the
+// average of the colors it replaces.
+func quantizePGS(img image.Image) (palette []color.NRGBA, pix []uint8) {
+	bounds := img.Bounds()
+	pixels := make([]color.NRGBA, 0, bounds.Dx()*bounds.Dy())
+	counts := make(map[color.NRGBA]int)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if pixel.A == 0 {
+				pixel = color.NRGBA{}
+			}
+			pixels = append(pixels, pixel)
+			counts[pixel]++
+		}
+	}
+	// Find the precision keeping the colors (transparent excluded) within the palette
+	reduce := func(c color.NRGBA, shift uint) color.NRGBA {
+		return color.NRGBA{R: c.R >> shift, G: c.G >> shift, B: c.B >> shift, A: c.A >> shift}
+	}
+	var (
+		shift   uint
+		buckets map[color.NRGBA]int
+	)
+	for shift = 0; shift < 8; shift++ {
+		buckets = make(map[color.NRGBA]int)
+		for c := range counts {
+			if c.A != 0 {
+				buckets[reduce(c, shift)] = 0
+			}
+		}
+		if len(buckets) < pgsMaxPaletteSize {
+			break
+		}
+	}
+	// Build the palette, sorted by usage to get stable results
+	keys := make([]color.NRGBA, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	weight := make(map[color.NRGBA]int, len(keys))
+	for c, count := range counts {
+		if c.A != 0 {
+			weight[reduce(c, shift)] += count
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if weight[keys[i]] != weight[keys[j]] {
+			return weight[keys[i]] > weight[keys[j]]
+		}
+		a, b := keys[i], keys[j]
+		return uint32(a.R)<<24|uint32(a.G)<<16|uint32(a.B)<<8|uint32(a.A) < uint32(b.R)<<24|uint32(b.G)<<16|uint32(b.B)<<8|uint32(b.A)
+	})
+	sums := make([][4]int, len(keys)+1)
+	for index, key := range keys {
+		buckets[key] = index + 1
+	}
+	for c, count := range counts {
+		if c.A == 0 {
+			continue
+		}
+		sum := &sums[buckets[reduce(c, shift)]]
+		sum[0] += int(c.R) * count
+		sum[1] += int(c.G) * count
+		sum[2] += int(c.B) * count
+		sum[3] += int(c.A) * count
+	}
+	palette = make([]color.NRGBA, len(keys)+1)
+	for index, key := range keys {
+		total, sum := weight[key], sums[index+1]
+		palette[index+1] = color.NRGBA{
+			R: uint8((sum[0] + total/2) / total),
+			G: uint8((sum[1] + total/2) / total),
+			B: uint8((sum[2] + total/2) / total),
+			A: uint8((sum[3] + total/2) / total),
+		}
+	}
+	// Index the pixels
+	pix = make([]uint8, len(pixels))
+	for index, pixel := range pixels {
+		if pixel.A != 0 {
+			pix[index] = uint8(buckets[reduce(pixel, shift)])
+		}
+	}
+	return
+}
+
+// encodePGSLine appends the PGS RLE encoding of a line of palette indexes to buffer
+func encodePGSLine(buffer []byte, line []uint8) []byte {
+	for x := 0; x < len(line); {
+		index, run := line[x], 1
+		for x+run < len(line) && line[x+run] == index && run < pgsMaxRunLength {
+			run++
+		}
+		switch {
+		case index != 0 && run < 3:
+			for range run {
+				buffer = append(buffer, index)
+			}
+		case index == 0 && run < 64:
+			buffer = append(buffer, 0, byte(run))
+		case index == 0:
+			buffer = append(buffer, 0, 0x40|byte(run>>8), byte(run))
+		case run < 64:
+			buffer = append(buffer, 0, 0x80|byte(run), index)
+		default:
+			buffer = append(buffer, 0, 0xc0|byte(run>>8), byte(run), index)
+		}
+		x += run
+	}
+	// End of line
+	return append(buffer, 0, 0)
+}
+
+/*
+	Segments
+*/
+
+type pgsWriter struct {
+	buffer      *bufio.Writer
+	video       image.Rectangle
+	frameRate   uint8
+	space       YCbCrSpace
+	composition uint16
+	// lastPTS is the presentation time of the previous display set: the next one can not be decoded before
+	lastPTS int64
+}
+
+// writeEpoch writes the display sets of subtitles displayed without interruption within window
+func (pw *pgsWriter) writeEpoch(objects []pgsObject, window image.Rectangle) (err error) {
+	for index, object := range objects {
+		state := uint8(pgsCompositionAcquisitionPoint)
+		if index == 0 {
+			state = pgsCompositionEpochStart
+		}
+		if err = pw.writeDisplaySet(object.start, state, &object, window, uint8(index)); err != nil {
+			return
+		}
+	}
+	last := objects[len(objects)-1]
+	if last.stop <= last.start {
+		return // displayed until the next epoch
+	}
+	return pw.writeDisplaySet(last.stop, pgsCompositionNormal, nil, window, 0)
+}
+
+// writeDisplaySet writes a display set presenting object (or clearing the window if nil) at pts.
+// The palette and the object are updated in place: version is their version number within the epoch.
+// Decoding times follow the HD-DMV graphics model: the graphics plane is initialized at epoch start (256 Mbps),
+// the object is decoded (128 Mbps) and the window is transferred to the screen (256 Mbps).
+func (pw *pgsWriter) writeDisplaySet(pts int64, state uint8, object *pgsObject, window image.Rectangle, version uint8) (err error) {
+	var initDuration, decodeDuration int64
+	transferDuration := ceilDiv(9*int64(window.Dx()*window.Dy()), 3200)
+	if state == pgsCompositionEpochStart {
+		initDuration = ceilDiv(9*int64(pw.video.Dx()*pw.video.Dy()), 3200)
+	}
+	if object != nil {
+		decodeDuration = ceilDiv(9*int64(object.rect.Dx()*object.rect.Dy()), 1600)
+	}
+	dts := max(pts-initDuration-decodeDuration-transferDuration, pw.lastPTS, 0)
+	decodeStart := min(dts+initDuration, pts)
+	decodeEnd := min(decodeStart+decodeDuration, pts)
+	// Presentation composition
+	pcs := binary.BigEndian.AppendUint16(nil, uint16(pw.video.Dx()))
+	pcs = binary.BigEndian.AppendUint16(pcs, uint16(pw.video.Dy()))
+	pcs = append(pcs, pw.frameRate)
+	pcs = binary.BigEndian.AppendUint16(pcs, pw.composition)
+	pcs = append(pcs, state, 0x00, 0) // palette update flag and palette ID: a single palette, updated by each display set
+	if object == nil {
+		pcs = append(pcs, 0)
+	} else {
+		flags := uint8(0)
+		if object.forced {
+			flags |= pgsObjectForced
+		}
+		pcs = append(pcs, 1, 0, 0, 0, flags) // object ID, window ID and flags
+		pcs = binary.BigEndian.AppendUint16(pcs, uint16(object.rect.Min.X))
+		pcs = binary.BigEndian.AppendUint16(pcs, uint16(object.rect.Min.Y))
+	}
+	pw.composition++
+	pw.writeSegment(pgsSegmentPCS, pts, dts, pcs)
+	// Window definition
+	wds := []byte{1, 0}
+	wds = binary.BigEndian.AppendUint16(wds, uint16(window.Min.X))
+	wds = binary.BigEndian.AppendUint16(wds, uint16(window.Min.Y))
+	wds = binary.BigEndian.AppendUint16(wds, uint16(window.Dx()))
+	wds = binary.BigEndian.AppendUint16(wds, uint16(window.Dy()))
+	pw.writeSegment(pgsSegmentWDS, max(pts-transferDuration, dts), dts, wds)
+	if object != nil {
+		// Palette definition
+		pds := []byte{0, version} // palette ID and version
+		ycbcr := NewRGBPalette(nrgbaPalette(object.palette), pw.space)
+		for index := range ycbcr.Len() {
+			c := ycbcr.YCbCrAt(index)
+			pds = append(pds, uint8(index), c.Y, c.Cr, c.Cb, c.A)
+		}
+		pw.writeSegment(pgsSegmentPDS, decodeStart, decodeStart, pds)
+		// Object definition, split across segments if needed
+		data := make([]byte, 0, 7+len(object.rle))
+		data = append(data, byte((len(object.rle)+4)>>16))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(object.rle)+4))
+		data = binary.BigEndian.AppendUint16(data, uint16(object.rect.Dx()))
+		data = binary.BigEndian.AppendUint16(data, uint16(object.rect.Dy()))
+		data = append(data, object.rle...)
+		for offset := 0; offset < len(data); {
+			size := min(len(data)-offset, pgsMaxSegmentPayload-pgsODSHeaderLength)
+			flags := uint8(0)
+			if offset == 0 {
+				flags |= pgsFragmentFirst
+			}
+			if offset+size == len(data) {
+				flags |= pgsFragmentLast
+			}
+			ods := append([]byte{0, 0, version, flags}, data[offset:offset+size]...)
+			pw.writeSegment(pgsSegmentODS, decodeEnd, decodeStart, ods)
+			offset += size
+		}
+	}
+	// End
+	pw.writeSegment(pgsSegmentEND, decodeEnd, decodeEnd, nil)
+	pw.lastPTS = pts
+	return
+}
+
+// writeSegment writes a segment with its header. Errors are reported by the final flush of the buffer.
+func (pw *pgsWriter) writeSegment(kind uint8, pts, dts int64, payload []byte) {
+	header := make([]byte, 0, pgsSegmentHeaderLength)
+	header = append(header, pgsMagic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(pts))
+	header = binary.BigEndian.AppendUint32(header, uint32(dts))
+	header = append(header, kind)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	pw.buffer.Write(header)
+	pw.buffer.Write(payload)
+}
+
+func nrgbaPalette(colors []color.NRGBA) (palette color.Palette) {
+	palette = make(color.Palette, len(colors))
+	for index, c := range colors {
+		palette[index] = c
+	}
+	return
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+/*
+	Reading
+*/
+
+// ReadPGSFile reads a Blu-ray PGS .sup file. See ReadPGS().
+func ReadPGSFile(file string) (subtitles []Subtitle, err error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		err = fmt.Errorf("failed to open file: %w", err)
+		return
+	}
+	defer fd.Close()
+	return ReadPGS(fd)
+}
+
+// ReadPGS reads a Blu-ray PGS stream (.sup file) and returns its subtitles in presentation order.
+// Each display set showing objects gives a subtitle whose image is the composition of its objects (cropped as requested
+// by the composition, each one blended over the previous ones) with image bounds in video coordinates. A subtitle is
+// displayed until the next display set changing what is displayed: identical display sets (acquisition points) do not
+// split subtitles. The last subtitle has no stop time (Stop equals Start) if it is never removed.
+func ReadPGS(reader io.Reader) (subtitles []Subtitle, err error) {
+	pr := pgsReader{
+		buffer:   bufio.NewReader(reader),
+		palettes: make(map[uint8]*[pgsMaxPaletteSize]YCbCrColor),
+		objects:  make(map[uint16]*pgsObjectDefinition),
+	}
+	for {
+		var segment pgsSegment
+		if segment, err = pr.readSegment(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			err = fmt.Errorf("failed to read segment #%d: %w", pr.segments+1, err)
+			return
+		}
+		pr.segments++
+		if err = pr.process(segment); err != nil {
+			err = fmt.Errorf("invalid segment #%d (type 0x%02x at %s): %w", pr.segments, segment.kind, segment.pts, err)
+			return
+		}
+	}
+	return pr.subtitles, nil
+}
+
+type pgsSegment struct {
+	kind    uint8
+	pts     time.Duration
+	payload []byte
+}
+
+// pgsComposition is a parsed presentation composition segment
+type pgsComposition struct {
+	pts       time.Duration
+	video     image.Rectangle
+	paletteID uint8
+	objects   []pgsCompositionObject
+}
+
+type pgsCompositionObject struct {
+	id       uint16
+	forced   bool
+	position image.Point
+	crop     *image.Rectangle // within the object
+}
+
+// pgsObjectDefinition is an object, possibly still being assembled from its fragments
+type pgsObjectDefinition struct {
+	width, height int
+	length        int // expected RLE data length
+	rle           []byte
+}
+
+type pgsReader struct {
+	buffer   *bufio.Reader
+	segments int
+	// Epoch state
+	palettes map[uint8]*[pgsMaxPaletteSize]YCbCrColor
+	objects  map[uint16]*pgsObjectDefinition
+	// Display set state
+	composition *pgsComposition
+	// Output
+	subtitles []Subtitle
+	displayed bool // the last subtitle is currently displayed
+}
+
+func (pr *pgsReader) readSegment() (segment pgsSegment, err error) {
+	header := make([]byte, pgsSegmentHeaderLength)
+	if _, err = io.ReadFull(pr.buffer, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated segment header")
+		}
+		return
+	}
+	if string(header[:len(pgsMagic)]) != pgsMagic {
+		err = fmt.Errorf("invalid magic number: %q", header[:len(pgsMagic)])
+		return
+	}
+	ticks := uint64(binary.BigEndian.Uint32(header[2:6]))
+	segment.pts = time.Duration(ticks * uint64(time.Second) / PTSDTSClockFrequency)
+	segment.kind = header[10]
+	segment.payload = make([]byte, binary.BigEndian.Uint16(header[11:13]))
+	if _, err = io.ReadFull(pr.buffer, segment.payload); err != nil {
+		err = fmt.Errorf("truncated segment payload: %w", err)
+	}
+	return
+}
+
+func (pr *pgsReader) process(segment pgsSegment) (err error) {
+	payload := segment.payload
+	switch segment.kind {
+	case pgsSegmentPCS:
+		if len(payload) < 11 {
+			return fmt.Errorf("composition segment is too short: %d bytes", len(payload))
+		}
+		composition := pgsComposition{
+			pts:       segment.pts,
+			video:     image.Rect(0, 0, int(binary.BigEndian.Uint16(payload[0:2])), int(binary.BigEndian.Uint16(payload[2:4]))),
+			paletteID: payload[9],
+		}
+		if payload[7]&pgsCompositionEpochStart != 0 {
+			clear(pr.palettes)
+			clear(pr.objects)
+		}
+		nbObjects := int(payload[10])
+		for offset, index := 11, 0; index < nbObjects; index++ {
+			if len(payload) < offset+8 {
+				return fmt.Errorf("composition object #%d is truncated", index+1)
+			}
+			object := pgsCompositionObject{
+				id:     binary.BigEndian.Uint16(payload[offset : offset+2]),
+				forced: payload[offset+3]&pgsObjectForced != 0,
+				position: image.Point{
+					X: int(binary.BigEndian.Uint16(payload[offset+4 : offset+6])),
+					Y: int(binary.BigEndian.Uint16(payload[offset+6 : offset+8])),
+				},
+			}
+			cropped := payload[offset+3]&pgsObjectCropped != 0
+			offset += 8
+			if cropped {
+				if len(payload) < offset+8 {
+					return fmt.Errorf("composition object #%d cropping is truncated", index+1)
+				}
+				x, y := int(binary.BigEndian.Uint16(payload[offset:offset+2])), int(binary.BigEndian.Uint16(payload[offset+2:offset+4]))
+				crop := image.Rect(x, y,
+					x+int(binary.BigEndian.Uint16(payload[offset+4:offset+6])),
+					y+int(binary.BigEndian.Uint16(payload[offset+6:offset+8])),
+				)
+				object.crop = &crop
+				offset += 8
+			}
+			composition.objects = append(composition.objects, object)
+		}
+		pr.composition = &composition
+	case pgsSegmentWDS:
+		// windows only restrict the area updated on screen, objects are within them
+	case pgsSegmentPDS:
+		if len(payload) < 2 || (len(payload)-2)%5 != 0 {
+			return fmt.Errorf("invalid palette segment length: %d bytes", len(payload))
+		}
+		palette, found := pr.palettes[payload[0]]
+		if !found {
+			palette = new([pgsMaxPaletteSize]YCbCrColor)
+			pr.palettes[payload[0]] = palette
+		}
+		// entries are kept as YCbCr: their color space is the one of the composition using them
+		for offset := 2; offset < len(payload); offset += 5 {
+			palette[payload[offset]] = YCbCrColor{
+				Y:  payload[offset+1],
+				Cr: payload[offset+2],
+				Cb: payload[offset+3],
+				A:  payload[offset+4],
+			}
+		}
+	case pgsSegmentODS:
+		if len(payload) < pgsODSHeaderLength {
+			return fmt.Errorf("object segment is too short: %d bytes", len(payload))
+		}
+		id, flags := binary.BigEndian.Uint16(payload[0:2]), payload[3]
+		data := payload[pgsODSHeaderLength:]
+		object, found := pr.objects[id]
+		if flags&pgsFragmentFirst != 0 {
+			if len(data) < 7 {
+				return fmt.Errorf("object #%d first fragment is too short: %d bytes", id, len(payload))
+			}
+			object = &pgsObjectDefinition{
+				length: (int(data[0])<<16 | int(binary.BigEndian.Uint16(data[1:3]))) - 4,
+				width:  int(binary.BigEndian.Uint16(data[3:5])),
+				height: int(binary.BigEndian.Uint16(data[5:7])),
+			}
+			pr.objects[id] = object
+			data = data[7:]
+		} else if !found {
+			return fmt.Errorf("object #%d fragment without first fragment", id)
+		}
+		object.rle = append(object.rle, data...)
+	case pgsSegmentEND:
+		if pr.composition == nil {
+			return errors.New("end of display set without composition")
+		}
+		err = pr.display(*pr.composition)
+		pr.composition = nil
+	default:
+		return errors.New("unknown segment type")
+	}
+	return
+}
+
+// display updates the subtitles with the composition of a complete display set
+func (pr *pgsReader) display(composition pgsComposition) (err error) {
+	if len(composition.objects) == 0 {
+		if pr.displayed {
+			pr.subtitles[len(pr.subtitles)-1].Stop = composition.pts
+			pr.displayed = false
+		}
+		return
+	}
+	entries, found := pr.palettes[composition.paletteID]
+	if !found {
+		return fmt.Errorf("unknown palette #%d", composition.paletteID)
+	}
+	ycbcr := NewYCbCrPalette(entries[:], pgsColorSpace(composition.video.Dy()))
+	palette := make([]color.NRGBA, ycbcr.Len())
+	for index := range palette {
+		palette[index] = ycbcr.RGBAt(index)
+	}
+	// Compose the objects
+	var (
+		area    image.Rectangle
+		forced  bool
+		sources = make([]image.Rectangle, len(composition.objects))
+	)
+	for index, compositionObject := range composition.objects {
+		object, found := pr.objects[compositionObject.id]
+		if !found {
+			return fmt.Errorf("unknown object #%d", compositionObject.id)
+		}
+		sources[index] = image.Rect(0, 0, object.width, object.height)
+		if compositionObject.crop != nil {
+			sources[index] = compositionObject.crop.Intersect(sources[index])
+		}
+		area = area.Union(image.Rectangle{Max: sources[index].Size()}.Add(compositionObject.position))
+		forced = forced || compositionObject.forced
+	}
+	img := image.NewNRGBA(area)
+	for index, compositionObject := range composition.objects {
+		object := pr.objects[compositionObject.id]
+		if len(object.rle) < object.length {
+			return fmt.Errorf("object #%d is incomplete: %d bytes out of %d", compositionObject.id, len(object.rle), object.length)
+		}
+		var pix []uint8
+		if pix, err = decodePGSObject(object.rle, object.width, object.height); err != nil {
+			return fmt.Errorf("failed to decode object #%d: %w", compositionObject.id, err)
+		}
+		// Objects are composited over the previous ones
+		objectImg := image.NewNRGBA(image.Rect(0, 0, object.width, object.height))
+		for offset, paletteIndex := range pix {
+			c := palette[paletteIndex]
+			objectImg.Pix[offset*4], objectImg.Pix[offset*4+1], objectImg.Pix[offset*4+2], objectImg.Pix[offset*4+3] = c.R, c.G, c.B, c.A
+		}
+		source := sources[index]
+		draw.Draw(img, image.Rectangle{Max: source.Size()}.Add(compositionObject.position), objectImg, source.Min, draw.Over)
+	}
+	// Identical display sets (acquisition points) keep the current subtitle displayed
+	if pr.displayed {
+		current := &pr.subtitles[len(pr.subtitles)-1]
+		if currentImg, ok := current.Image.(*image.NRGBA); ok && currentImg.Rect == img.Rect && current.Forced == forced &&
+			bytes.Equal(currentImg.Pix, img.Pix) {
+			return
+		}
+		current.Stop = composition.pts
+	}
+	pr.subtitles = append(pr.subtitles, Subtitle{
+		Start:  composition.pts,
+		Stop:   composition.pts,
+		Forced: forced,
+		Image:  img,
+		Placement: Placement{
+			Area:   area,
+			Canvas: composition.video,
+		},
+	})
+	pr.displayed = true
+	return
+}
+
+// decodePGSObject decodes the PGS RLE data of an object into its palette indexes
+func decodePGSObject(rle []byte, width, height int) (pix []uint8, err error) {
+	pix = make([]uint8, width*height)
+	x, y := 0, 0
+	for offset := 0; offset < len(rle) && y < height; {
+		var (
+			index = rle[offset]
+			run   = 1
+		)
+		offset++
+		if index == 0 {
+			if offset >= len(rle) {
+				break
+			}
+			flags := rle[offset]
+			offset++
+			if flags == 0 {
+				// End of line
+				x, y = 0, y+1
+				continue
+			}
+			run = int(flags & 0x3f)
+			if flags&0x40 != 0 {
+				if offset >= len(rle) {
+					break
+				}
+				run = run<<8 | int(rle[offset])
+				offset++
+			}
+			if flags&0x80 != 0 {
+				if offset >= len(rle) {
+					break
+				}
+				index = rle[offset]
+				offset++
+			}
+		}
+		if x+run > width {
+			err = fmt.Errorf("line %d is too long: more than %d pixels", y, width)
+			return
+		}
+		if index != 0 {
+			line := pix[y*width+x : y*width+x+run]
+			for i := range line {
+				line[i] = index
+			}
+		}
+		x += run
+	}
+	return
+}
+
+// ConvertPGS reads a Blu-ray PGS .sup file and writes its subtitles as a new sub/idx pair at subFile (see Encode()).
+// Set opts.Scale to fit HD subtitles within a DVD video frame. It returns the number of subtitles read.
+func ConvertPGS(supFile, subFile string, opts EncodeOptions) (nbSubtitles int, err error) {
+	subtitles, err := ReadPGSFile(supFile)
+	if err != nil {
+		err = fmt.Errorf("failed to read .sup file: %w", err)
+		return
+	}
+	if err = Encode(subFile, subtitles, opts); err != nil {
+		return
+	}
+	return len(subtitles), nil
+}
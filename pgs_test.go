@@ -0,0 +1,366 @@
+package vobsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWritePGSRoundTrip(t *testing.T) {
+	// Subtitles displayed without interruption: a single epoch updating the palette more than 8 times
+	canvas := image.Rect(0, 0, 1920, 1080)
+	subtitles := make([]Subtitle, 10)
+	for index := range subtitles {
+		area := image.Rect(600, 900, 1320, 960)
+		img := image.NewNRGBA(area)
+		fill := color.NRGBA{R: uint8(index * 25), G: 0x80, B: uint8(250 - index*25), A: 0xff}
+		for y := area.Min.Y + 10; y < area.Max.Y-10; y++ {
+			for x := area.Min.X + 10; x < area.Max.X-10; x++ {
+				img.SetNRGBA(x, y, fill)
+			}
+		}
+		subtitles[index] = Subtitle{
+			Start:     time.Duration(index+1) * time.Second,
+			Stop:      time.Duration(index+2) * time.Second,
+			Forced:    index%3 == 0,
+			Image:     img,
+			Placement: Placement{Area: area, Canvas: canvas},
+		}
+	}
+	var stream bytes.Buffer
+	if err := WritePGS(&stream, subtitles, PGSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// Palette IDs are limited to 0-7
+	for data := stream.Bytes(); len(data) >= pgsSegmentHeaderLength; {
+		kind, length := data[10], int(data[11])<<8|int(data[12])
+		payload := data[pgsSegmentHeaderLength : pgsSegmentHeaderLength+length]
+		switch {
+		case kind == pgsSegmentPCS && payload[9] > 7:
+			t.Fatalf("composition uses palette #%d", payload[9])
+		case kind == pgsSegmentPDS && payload[0] > 7:
+			t.Fatalf("palette #%d is defined", payload[0])
+		}
+		data = data[pgsSegmentHeaderLength+length:]
+	}
+	// Read it back
+	read, err := ReadPGS(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(subtitles) {
+		t.Fatalf("read %d subtitles, expected %d", len(read), len(subtitles))
+	}
+	for index, sub := range read {
+		expected := subtitles[index]
+		if sub.Start != expected.Start || sub.Stop != expected.Stop || sub.Forced != expected.Forced {
+			t.Errorf("subtitle #%d: got %s --> %s (forced %v), expected %s --> %s (forced %v)", index+1,
+				sub.Start, sub.Stop, sub.Forced, expected.Start, expected.Stop, expected.Forced)
+		}
+		got := color.NRGBAModel.Convert(sub.Image.At(960, 930)).(color.NRGBA)
+		want := expected.Image.At(960, 930).(color.NRGBA)
+		if absDiff(got.R, want.R) > 2 || absDiff(got.G, want.G) > 2 || absDiff(got.B, want.B) > 2 || got.A != want.A {
+			t.Errorf("subtitle #%d: got color %v, expected %v", index+1, got, want)
+		}
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+/*
+	Hand built PGS streams
+*/
+
+type testPGSObject struct {
+	id       uint16
+	crop     *image.Rectangle
+	forced   bool
+	position image.Point
+}
+
+func testPGSSegment(kind uint8, pts time.Duration, payload []byte) []byte {
+	segment := []byte(pgsMagic)
+	segment = binary.BigEndian.AppendUint32(segment, uint32(pgsTicks(pts)))
+	segment = binary.BigEndian.AppendUint32(segment, 0)
+	segment = append(segment, kind)
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)))
+	return append(segment, payload...)
+}
+
+func testPCS(video image.Point, state uint8, paletteUpdate bool, paletteID uint8, objects ...testPGSObject) []byte {
+	pcs := binary.BigEndian.AppendUint16(nil, uint16(video.X))
+	pcs = binary.BigEndian.AppendUint16(pcs, uint16(video.Y))
+	pcs = append(pcs, 0x10, 0, 0, state)
+	if paletteUpdate {
+		pcs = append(pcs, 0x80)
+	} else {
+		pcs = append(pcs, 0)
+	}
+	pcs = append(pcs, paletteID, uint8(len(objects)))
+	for _, object := range objects {
+		flags := uint8(0)
+		if object.forced {
+			flags |= pgsObjectForced
+		}
+		if object.crop != nil {
+			flags |= pgsObjectCropped
+		}
+		pcs = binary.BigEndian.AppendUint16(pcs, object.id)
+		pcs = append(pcs, 0, flags)
+		pcs = binary.BigEndian.AppendUint16(pcs, uint16(object.position.X))
+		pcs = binary.BigEndian.AppendUint16(pcs, uint16(object.position.Y))
+		if object.crop != nil {
+			for _, value := range []int{object.crop.Min.X, object.crop.Min.Y, object.crop.Dx(), object.crop.Dy()} {
+				pcs = binary.BigEndian.AppendUint16(pcs, uint16(value))
+			}
+		}
+	}
+	return pcs
+}
+
+func testPDS(id, version uint8, entries map[uint8]YCbCrColor) []byte {
+	pds := []byte{id, version}
+	for index := range 256 {
+		if c, found := entries[uint8(index)]; found {
+			pds = append(pds, uint8(index), c.Y, c.Cr, c.Cb, c.A)
+		}
+	}
+	return pds
+}
+
+// testODS encodes the rows of palette indexes: each pixel is written alone (zero ones as a run of 1)
+func testODS(id uint16, version uint8, rows [][]uint8) []byte {
+	var rle []byte
+	for _, row := range rows {
+		for _, index := range row {
+			if index == 0 {
+				rle = append(rle, 0x00, 0x01)
+			} else {
+				rle = append(rle, index)
+			}
+		}
+		rle = append(rle, 0x00, 0x00)
+	}
+	ods := binary.BigEndian.AppendUint16(nil, id)
+	ods = append(ods, version, pgsFragmentFirst|pgsFragmentLast, byte((len(rle)+4)>>16))
+	ods = binary.BigEndian.AppendUint16(ods, uint16(len(rle)+4))
+	ods = binary.BigEndian.AppendUint16(ods, uint16(len(rows[0])))
+	ods = binary.BigEndian.AppendUint16(ods, uint16(len(rows)))
+	return append(ods, rle...)
+}
+
+// testDisplaySet returns the segments of a display set at pts: its composition, its palette (if any) and its objects
+func testDisplaySet(pts time.Duration, pcs, pds []byte, objects ...[]byte) (displaySet []byte) {
+	displaySet = testPGSSegment(pgsSegmentPCS, pts, pcs)
+	if pds != nil {
+		displaySet = append(displaySet, testPGSSegment(pgsSegmentPDS, pts, pds)...)
+	}
+	for _, ods := range objects {
+		displaySet = append(displaySet, testPGSSegment(pgsSegmentODS, pts, ods)...)
+	}
+	return append(displaySet, testPGSSegment(pgsSegmentEND, pts, nil)...)
+}
+
+var (
+	testPGSVideo = image.Pt(720, 576)
+	testPGSWhite = YCbCrColor{Y: 235, Cr: 128, Cb: 128, A: 0xff}
+	testPGSRed   = YCbCrColor{Y: 81, Cr: 240, Cb: 90, A: 0xff}
+	testPGSGreen = YCbCrColor{Y: 145, Cr: 34, Cb: 54, A: 0xff}
+	testPGSBlue  = YCbCrColor{Y: 41, Cr: 110, Cb: 240, A: 0xff}
+)
+
+func testPGSColor(c YCbCrColor) color.NRGBA {
+	return pgsColorSpace(testPGSVideo.Y).ToRGB(c)
+}
+
+func readTestPGS(t *testing.T, stream []byte) []Subtitle {
+	t.Helper()
+	subtitles, err := ReadPGS(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subtitles
+}
+
+func TestReadPGSCropping(t *testing.T) {
+	crop := image.Rect(1, 0, 3, 2)
+	stream := testDisplaySet(time.Second,
+		testPCS(testPGSVideo, pgsCompositionEpochStart, false, 0, testPGSObject{id: 0, crop: &crop, position: image.Pt(10, 20)}),
+		testPDS(0, 0, map[uint8]YCbCrColor{1: testPGSWhite, 2: testPGSRed, 3: testPGSGreen}),
+		testODS(0, 0, [][]uint8{{1, 2, 3, 1}, {3, 2, 1, 2}}),
+	)
+	subtitles := readTestPGS(t, stream)
+	if len(subtitles) != 1 {
+		t.Fatalf("read %d subtitles, expected 1", len(subtitles))
+	}
+	img := subtitles[0].Image.(*image.NRGBA)
+	if img.Rect != image.Rect(10, 20, 12, 22) || subtitles[0].Placement.Area != img.Rect {
+		t.Fatalf("unexpected bounds %v (area %v)", img.Rect, subtitles[0].Placement.Area)
+	}
+	for _, check := range []struct {
+		x, y     int
+		expected YCbCrColor
+	}{
+		{10, 20, testPGSRed}, {11, 20, testPGSGreen}, {10, 21, testPGSRed}, {11, 21, testPGSWhite},
+	} {
+		if c := img.NRGBAAt(check.x, check.y); c != testPGSColor(check.expected) {
+			t.Errorf("pixel (%d, %d): got %v, expected %v", check.x, check.y, c, testPGSColor(check.expected))
+		}
+	}
+}
+
+func TestReadPGSMultipleObjects(t *testing.T) {
+	translucent := testPGSBlue
+	translucent.A = 0x80
+	stream := testDisplaySet(time.Second,
+		testPCS(testPGSVideo, pgsCompositionEpochStart, false, 0,
+			testPGSObject{id: 0, position: image.Pt(100, 400)},
+			testPGSObject{id: 1, position: image.Pt(102, 401), forced: true},
+		),
+		testPDS(0, 0, map[uint8]YCbCrColor{1: testPGSRed, 2: translucent}),
+		testODS(0, 0, [][]uint8{{1, 1, 1, 1}, {1, 1, 1, 1}}),
+		testODS(1, 0, [][]uint8{{2, 2, 2}, {2, 2, 0}}),
+	)
+	subtitles := readTestPGS(t, stream)
+	if len(subtitles) != 1 {
+		t.Fatalf("read %d subtitles, expected 1", len(subtitles))
+	}
+	sub := subtitles[0]
+	img := sub.Image.(*image.NRGBA)
+	if img.Rect != image.Rect(100, 400, 105, 403) || !sub.Forced {
+		t.Fatalf("unexpected bounds %v (forced %v)", img.Rect, sub.Forced)
+	}
+	// The translucent object is blended over the opaque one
+	blended := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	blended.SetNRGBA(0, 0, testPGSColor(testPGSRed))
+	draw.Draw(blended, blended.Rect, image.NewUniform(testPGSColor(translucent)), image.Point{}, draw.Over)
+	for _, check := range []struct {
+		x, y     int
+		expected color.NRGBA
+	}{
+		{100, 400, testPGSColor(testPGSRed)},
+		{102, 400, testPGSColor(testPGSRed)},
+		{102, 401, blended.NRGBAAt(0, 0)},
+		{103, 401, blended.NRGBAAt(0, 0)},
+		{104, 401, testPGSColor(translucent)},
+		{102, 402, testPGSColor(translucent)},
+		{104, 402, color.NRGBA{}},
+		{100, 402, color.NRGBA{}},
+	} {
+		if c := img.NRGBAAt(check.x, check.y); c != check.expected {
+			t.Errorf("pixel (%d, %d): got %v, expected %v", check.x, check.y, c, check.expected)
+		}
+	}
+}
+
+func TestReadPGSPaletteUpdate(t *testing.T) {
+	object := testPGSObject{id: 0, position: image.Pt(100, 400)}
+	var stream []byte
+	stream = append(stream, testDisplaySet(time.Second,
+		testPCS(testPGSVideo, pgsCompositionEpochStart, false, 0, object),
+		testPDS(0, 0, map[uint8]YCbCrColor{1: testPGSWhite}),
+		testODS(0, 0, [][]uint8{{1, 1}, {1, 0}}),
+	)...)
+	// Palette only update: the object is not sent again
+	stream = append(stream, testDisplaySet(2*time.Second,
+		testPCS(testPGSVideo, pgsCompositionNormal, true, 0, object),
+		testPDS(0, 1, map[uint8]YCbCrColor{1: testPGSGreen}),
+	)...)
+	stream = append(stream, testDisplaySet(3*time.Second, testPCS(testPGSVideo, pgsCompositionNormal, false, 0), nil)...)
+	subtitles := readTestPGS(t, stream)
+	if len(subtitles) != 2 {
+		t.Fatalf("read %d subtitles, expected 2", len(subtitles))
+	}
+	for index, expected := range []struct {
+		start, stop time.Duration
+		color       YCbCrColor
+	}{
+		{time.Second, 2 * time.Second, testPGSWhite},
+		{2 * time.Second, 3 * time.Second, testPGSGreen},
+	} {
+		sub := subtitles[index]
+		if sub.Start != expected.start || sub.Stop != expected.stop {
+			t.Errorf("subtitle #%d: got %s --> %s, expected %s --> %s", index+1, sub.Start, sub.Stop, expected.start, expected.stop)
+		}
+		img := sub.Image.(*image.NRGBA)
+		if c := img.NRGBAAt(100, 400); c != testPGSColor(expected.color) {
+			t.Errorf("subtitle #%d: got color %v, expected %v", index+1, c, testPGSColor(expected.color))
+		}
+		if c := img.NRGBAAt(101, 401); c.A != 0 {
+			t.Errorf("subtitle #%d: expected a transparent pixel, got %v", index+1, c)
+		}
+	}
+}
+
+func TestConvertPGS(t *testing.T) {
+	// 2 subtitles of 3 colors each: 6 colors overall
+	var stream []byte
+	colorSets := [][]YCbCrColor{{testPGSWhite, testPGSRed, testPGSGreen}, {testPGSBlue, testPGSRed, {Y: 128, Cr: 128, Cb: 128, A: 0xff}}}
+	for index, colors := range colorSets {
+		pts := time.Duration(index+1) * time.Second
+		rows := make([][]uint8, 6)
+		for y := range rows {
+			rows[y] = make([]uint8, 24)
+			for x := range rows[y] {
+				rows[y][x] = uint8(x/8 + 1)
+			}
+		}
+		stream = append(stream, testDisplaySet(pts,
+			testPCS(testPGSVideo, pgsCompositionEpochStart, false, 0, testPGSObject{id: 0, position: image.Pt(100, 500)}),
+			testPDS(0, 0, map[uint8]YCbCrColor{1: colors[0], 2: colors[1], 3: colors[2]}),
+			testODS(0, 0, rows),
+		)...)
+		stream = append(stream, testDisplaySet(pts+500*time.Millisecond, testPCS(testPGSVideo, pgsCompositionNormal, false, 0), nil)...)
+	}
+	dir := t.TempDir()
+	supFile, subFile := filepath.Join(dir, "subs.sup"), filepath.Join(dir, "subs.sub")
+	if err := os.WriteFile(supFile, stream, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	nbSubtitles, err := ConvertPGS(supFile, subFile, EncodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbSubtitles != 2 {
+		t.Fatalf("converted %d subtitles, expected 2", nbSubtitles)
+	}
+	decoded, _, err := DecodeWithOptions(subFile, DecodeOptions{RenderOptions: RenderOptions{Format: ImageFormatPaletted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := ReadIdxFile(filepath.Join(dir, "subs.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata.Palette) != idxPaletteLen {
+		t.Fatalf("idx palette has %d colors, expected %d", len(metadata.Palette), idxPaletteLen)
+	}
+	if len(decoded[0]) != 2 {
+		t.Fatalf("decoded %d subtitles, expected 2", len(decoded[0]))
+	}
+	for index, sub := range decoded[0] {
+		img := sub.Image.(*image.Paletted)
+		if len(img.Palette) > SubtitleColorSlots {
+			t.Errorf("subtitle #%d uses %d colors", index+1, len(img.Palette))
+		}
+		// Each color keeps its column within the 4 slots (opaque slots are rendered with the 15/16 alpha level)
+		for column, expected := range colorSets[index] {
+			got := color.NRGBAModel.Convert(img.At(100+column*8+4, 502)).(color.NRGBA)
+			want := testPGSColor(expected)
+			if absDiff(got.R, want.R) > 4 || absDiff(got.G, want.G) > 4 || absDiff(got.B, want.B) > 4 || got.A < 0xef {
+				t.Errorf("subtitle #%d column %d: got %v, expected %v", index+1, column+1, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package vobsub
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+)
+
+/*
+	RLE decoding table
+*/
+
+// rleCode is a decoded RLE letter: bits 0-1 are the color, bits 2-9 the repeat count and bits 10-12 the number of nibbles used
+type rleCode uint16
+
+func (code rleCode) color() uint8 {
+	return uint8(code & 0b11)
+}
+
+func (code rleCode) repeat() int {
+	return int(code>>2) & 0xff
+}
+
+func (code rleCode) nibbles() int {
+	return int(code >> 10)
+}
+
+// rleCodes contains the RLE letter found at the beginning of every possible 4 nibbles window
+var rleCodes = buildRLECodes()
+
+func buildRLECodes() (codes []rleCode) {
+	// 1 nibble letters:  rrcc
+	// 2 nibbles letters: 00rr rrcc
+	// 3 nibbles letters: 0000 rrrr rrcc
+	// 4 nibbles letters: 0000 00rr rrrr rrcc
+	codes = make([]rleCode, 1<<16)
+	for window := range len(codes) {
+		first, second, third, fourth := window>>12, window>>8&0b1111, window>>4&0b1111, window&0b1111
+		var repeat, color, nibbles int
+		switch {
+		case first&0b1100 != 0:
+			repeat, color, nibbles = first>>2, first&0b11, 1
+		case first != 0:
+			repeat, color, nibbles = (first&0b11)<<2|second>>2, second&0b11, 2
+		case second&0b1100 != 0:
+			repeat, color, nibbles = second<<2|third>>2, third&0b11, 3
+		default:
+			repeat, color, nibbles = second<<6|third<<2|fourth>>2, fourth&0b11, 4
+		}
+		codes[window] = rleCode(nibbles<<10 | repeat<<2 | color)
+	}
+	return
+}
+
+/*
+	Rasterizer
+*/
+
+// rasterizer draws the RLE encoded fields of a subtitle directly into the pixels of the target image, run by run
+type rasterizer struct {
+	// target
+	pix    []uint8
+	stride int
+	bpp    int             // bytes per pixel: 1 for paletted images (palette index), 4 for RGBA and NRGBA images
+	bounds image.Rectangle // target bounds
+	clip   image.Rectangle // drawable area of the target
+	origin image.Point     // absolute position of the subtitle first pixel within the target
+	screen image.Point     // position of the subtitle first pixel on screen, as set by its coordinates
+	// colors
+	palettes *subtitlePalettes
+	colors   [][4]uint8 // target pixel value of each palette index
+}
+
+var rasterizers = sync.Pool{
+	New: func() any {
+		return &rasterizer{
+			colors: make([][4]uint8, 0, 256),
+		}
+	},
+}
+
+// rasterize draws the subtitle fields into target (which must have been created by newSubtitleImage() or newTransparentImage())
+// with the subtitle first pixel located at origin. Nothing is drawn outside the clip rectangle.
+func rasterize(target image.Image, clip image.Rectangle, origin image.Point, window SubtitlesWindow, data []byte,
+	firstLineOffset, secondLineOffset int, palettes *subtitlePalettes) (err error) {
+	if firstLineOffset < 0 || firstLineOffset > secondLineOffset || secondLineOffset > len(data) {
+		return fmt.Errorf("invalid RLE offsets %d and %d for %d bytes of data", firstLineOffset, secondLineOffset, len(data))
+	}
+	r := rasterizers.Get().(*rasterizer)
+	defer rasterizers.Put(r)
+	r.origin = origin
+	r.screen = window.Point1
+	r.palettes = palettes
+	r.colors = r.colors[:0]
+	switch img := target.(type) {
+	case *image.Paletted:
+		r.pix, r.stride, r.bpp, r.bounds = img.Pix, img.Stride, 1, img.Rect
+		for index := range palettes.colors {
+			r.colors = append(r.colors, [4]uint8{uint8(index)})
+		}
+	case *image.NRGBA:
+		r.pix, r.stride, r.bpp, r.bounds = img.Pix, img.Stride, 4, img.Rect
+		for _, paletteColor := range palettes.colors {
+			c := color.NRGBAModel.Convert(paletteColor).(color.NRGBA)
+			r.colors = append(r.colors, [4]uint8{c.R, c.G, c.B, c.A})
+		}
+	case *image.RGBA:
+		r.pix, r.stride, r.bpp, r.bounds = img.Pix, img.Stride, 4, img.Rect
+		for _, paletteColor := range palettes.colors {
+			c := color.RGBAModel.Convert(paletteColor).(color.RGBA)
+			r.colors = append(r.colors, [4]uint8{c.R, c.G, c.B, c.A})
+		}
+	default:
+		return fmt.Errorf("unsupported target image type: %T", target)
+	}
+	defer func() { r.pix, r.palettes = nil, nil }() // do not retain images within the pool
+	r.clip = clip.Intersect(r.bounds)
+	width, height := window.Size()
+	if err = r.field(data[firstLineOffset:secondLineOffset], width, height, 0); err != nil {
+		return fmt.Errorf("failed to draw top field: %w", err)
+	}
+	if err = r.field(data[secondLineOffset:], width, height, 1); err != nil {
+		return fmt.Errorf("failed to draw bottom field: %w", err)
+	}
+	return
+}
+
+// field decodes and draws one of the 2 interlaced fields (firstLine 0 for the top field, 1 for the bottom one)
+func (r *rasterizer) field(data []byte, width, height, firstLine int) error {
+	var (
+		totalNibbles = len(data) * 2
+		position     int // in nibbles
+		x            int
+		code         rleCode
+		window       int
+		index        int
+	)
+	for line := firstLine; line < height && position < totalNibbles; {
+		// Read the next 4 nibbles window (missing data is read as zeros)
+		index = position >> 1
+		window = int(data[index]) << 16
+		if index+1 < len(data) {
+			window |= int(data[index+1]) << 8
+			if index+2 < len(data) {
+				window |= int(data[index+2])
+			}
+		}
+		if position&1 == 1 {
+			window <<= 4
+		}
+		window = window >> 8 & 0xffff
+		// Decode the letter
+		code = rleCodes[window]
+		if position+code.nibbles() > totalNibbles && window != 0 {
+			return fmt.Errorf("truncated RLE letter at the end of the data: 0x%04x", window)
+		}
+		position += code.nibbles()
+		// Draw it
+		if repeat := code.repeat(); repeat != 0 && x+repeat < width {
+			r.fill(line, x, x+repeat, code.color())
+			x += repeat
+			continue
+		}
+		// until the end of the line (discarding any repetition remaining): next line starts byte aligned
+		r.fill(line, x, width, code.color())
+		x = 0
+		line += 2
+		position = (position + 1) &^ 1
+	}
+	return nil
+}
+
+// fill draws a run of pixels of the same color slot on a line of the subtitle, from x0 (included) to x1 (excluded)
+func (r *rasterizer) fill(line, x0, x1 int, slot uint8) {
+	absY := r.origin.Y + line
+	if absY < r.clip.Min.Y || absY >= r.clip.Max.Y {
+		return
+	}
+	absX0, absX1 := max(r.origin.X+x0, r.clip.Min.X), min(r.origin.X+x1, r.clip.Max.X)
+	if absX0 >= absX1 {
+		return
+	}
+	rowOffset := (absY-r.bounds.Min.Y)*r.stride - r.bounds.Min.X*r.bpp
+	if len(r.palettes.regions) != 0 {
+		// slow path: the palette can change within the run
+		for absX := absX0; absX < absX1; absX++ {
+			pixel := r.colors[r.palettes.OffsetAt(r.screen.X+absX-r.origin.X, r.screen.Y+line)+slot]
+			copy(r.pix[rowOffset+absX*r.bpp:rowOffset+(absX+1)*r.bpp], pixel[:r.bpp])
+		}
+		return
+	}
+	// fast path: write the first pixel then duplicate it
+	run := r.pix[rowOffset+absX0*r.bpp : rowOffset+absX1*r.bpp]
+	pixel := r.colors[slot]
+	copy(run, pixel[:r.bpp])
+	for filled := r.bpp; filled < len(run); filled *= 2 {
+		copy(run[filled:], run[:filled])
+	}
+}
@@ -0,0 +1,319 @@
+package vobsub
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+/*
+	Rasterizer against the legacy per pixel path
+*/
+
+func TestRasterize(t *testing.T) {
+	palette := testPalette()
+	metadata := testMetadata(palette)
+	rng := rand.New(rand.NewSource(7))
+	var subtitles []SubtitleRaw
+	// Encoded SPUs: odd and even sizes (unbalanced fields), short runs, long runs and end of line fills
+	for _, size := range []image.Point{{1, 1}, {2, 3}, {7, 5}, {31, 2}, {64, 9}, {255, 4}, {256, 7}, {301, 11}, {719, 40}} {
+		img := image.NewPaletted(image.Rect(13, 200, 13+size.X, 200+size.Y), color.Palette{color.Transparent, color.White, color.Black, color.Gray{Y: 0x80}})
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; {
+				run := 1 + rng.Intn([]int{3, 15, 63, 300}[rng.Intn(4)])
+				slot := uint8(rng.Intn(SubtitleColorSlots))
+				for ; run > 0 && x < img.Rect.Max.X; run-- {
+					img.SetColorIndex(x, y, slot)
+					x++
+				}
+			}
+		}
+		raw, err := NewSubtitleRaw(img, palette, EncodeParams{
+			Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+			Alphas: [SubtitleColorSlots]uint8{0, 15, 9, 15},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		subtitles = append(subtitles, raw)
+	}
+	// Hand crafted SPU: runs overflowing the line end and explicit end of line fills
+	raw, err := NewSubtitleRaw(image.NewPaletted(image.Rect(0, 0, 10, 3), color.Palette{color.Transparent}), palette, EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{15, 15, 15, 15},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Data = []byte{
+		0x3d,             // top field line 0: 15 pixels of slot 1 (overflowing)
+		0x9e, 0x00, 0x02, // top field line 2: 2 pixels of slot 1, 3 pixels of slot 2, then slot 2 until the end of line
+		0xe0, 0x00, 0x30, // bottom field line 1: 3 pixels of slot 2, then slot 3 until the end of line
+	}
+	rleOffsets := NewControlSequenceRLEOffsets(0, 4)
+	raw.ControlSequences[0].RLEOffsets = &rleOffsets
+	subtitles = append(subtitles, raw)
+	// Compare
+	for index, raw := range subtitles {
+		legacy, err := legacyRender(raw, metadata)
+		if err != nil {
+			t.Fatalf("SPU #%d: legacy render failed: %v", index+1, err)
+		}
+		for _, format := range []ImageFormat{ImageFormatRGBA, ImageFormatPaletted} {
+			img, _, _, err := raw.DecodeWithOptions(metadata, RenderOptions{Format: format})
+			if err != nil {
+				t.Fatalf("SPU #%d: %s render failed: %v", index+1, format, err)
+			}
+			// The legacy path used the coordinates second corner as an exclusive bound, missing the last column and line
+			bounds := legacy.Bounds()
+			if !bounds.In(img.Bounds()) || img.Bounds().Dx() != bounds.Dx()+1 || img.Bounds().Dy() != bounds.Dy()+1 {
+				t.Fatalf("SPU #%d: %s bounds %v do not match legacy bounds %v", index+1, format, img.Bounds(), bounds)
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					expected := color.RGBAModel.Convert(legacy.At(x, y))
+					if got := color.RGBAModel.Convert(img.At(x, y)); got != expected {
+						t.Fatalf("SPU #%d: %s pixel (%d, %d): expected %v, got %v", index+1, format, x, y, expected, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkRasterize(b *testing.B) {
+	raw, metadata := benchmarkSubtitle(b)
+	for _, format := range []ImageFormat{ImageFormatRGBA, ImageFormatNRGBA, ImageFormatPaletted} {
+		b.Run(format.String(), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, _, err := raw.DecodeWithOptions(metadata, RenderOptions{Format: format}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("FullSize", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, _, _, err := raw.DecodeWithOptions(metadata, RenderOptions{FullSize: true}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRasterizeLegacy(b *testing.B) {
+	raw, metadata := benchmarkSubtitle(b)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := legacyRender(raw, metadata); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkSubtitle generates a subtitle looking like 2 lines of outlined text
+func benchmarkSubtitle(b testing.TB) (raw SubtitleRaw, metadata IdxMetadata) {
+	metadata = IdxMetadata{
+		Width:      720,
+		Height:     576,
+		AlphaRatio: 1,
+		Palette:    make(color.Palette, idxPaletteLen),
+	}
+	for index := range metadata.Palette {
+		metadata.Palette[index] = color.NRGBA{R: uint8(index * 16), G: uint8(index * 8), B: uint8(255 - index*16), A: 0xff}
+	}
+	rng := rand.New(rand.NewSource(42))
+	img := image.NewPaletted(image.Rect(60, 460, 660, 540), color.Palette{color.Transparent, color.White, color.Black, color.Gray{Y: 0x80}})
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		if (y-img.Rect.Min.Y)%40 < 6 {
+			continue // interline
+		}
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; {
+			// glyph then space
+			glyph := 4 + rng.Intn(12)
+			for i := 0; i < glyph && x < img.Rect.Max.X; i++ {
+				img.SetColorIndex(x, y, uint8(1+rng.Intn(3)))
+				x += 1 + rng.Intn(3)
+			}
+			x += 2 + rng.Intn(6)
+		}
+	}
+	raw, err := NewSubtitleRaw(img, metadata.Palette, EncodeParams{
+		Colors: [4]uint8{0, 1, 2, 3},
+		Alphas: [4]uint8{0, 15, 15, 15},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return
+}
+
+/*
+	Legacy path: nibble by nibble decoding and per pixel drawing through the image.Image interface
+*/
+
+func legacyRender(raw SubtitleRaw, metadata IdxMetadata) (img image.Image, err error) {
+	var state spuDisplayState
+	for _, cs := range raw.ControlSequences {
+		state.apply(cs)
+	}
+	palette, err := buildSubtitlePalette(metadata.Palette, *state.paletteColors, *state.alphaChannels, nil)
+	if err != nil {
+		return
+	}
+	legacyPalette := make(color.Palette, len(palette))
+	for index, paletteColor := range palette {
+		legacyPalette[index] = paletteColor
+	}
+	coord := state.coordinates.Get()
+	rgbaImg := image.NewRGBA(image.Rect(coord.Point1.X, coord.Point1.Y, coord.Point2.X, coord.Point2.Y))
+	firstLineOffset, secondLineOffset := state.RLEOffsets.Get()
+	if err = legacyDrawOddOrEvenLines(rgbaImg, legacyPalette, &legacyNibbleIterator{data: raw.Data[firstLineOffset:secondLineOffset]}, false); err != nil {
+		return
+	}
+	if err = legacyDrawOddOrEvenLines(rgbaImg, legacyPalette, &legacyNibbleIterator{data: raw.Data[secondLineOffset:]}, true); err != nil {
+		return
+	}
+	img = rgbaImg
+	return
+}
+
+func legacyDrawOddOrEvenLines(rgbaImg *image.RGBA, palette color.Palette, iter *legacyNibbleIterator, evenLines bool) (err error) {
+	bounds := rgbaImg.Bounds()
+	var (
+		relativeX, relativeY int
+		absoluteX, absoluteY int
+		length               int
+		pixel                legacyRLEPixel
+	)
+	if evenLines {
+		relativeY = 1
+	}
+	absoluteY = bounds.Min.Y + relativeY
+	for !iter.Ended() {
+		if pixel, err = legacyDecodeRLE(iter); err != nil {
+			return
+		}
+		if length = int(pixel.repeat); length == 0 {
+			// going until the end of line
+			length = bounds.Max.X - (bounds.Min.X + relativeX) + 1
+		}
+		for range length {
+			absoluteX = bounds.Min.X + relativeX
+			rgbaImg.Set(absoluteX, absoluteY, palette[pixel.color])
+			if absoluteX == bounds.Max.X {
+				// Need a new line for next pixel
+				relativeX = 0
+				relativeY += 2
+				absoluteY = bounds.Min.Y + relativeY
+				if absoluteY > bounds.Max.Y {
+					return
+				}
+				iter.Align() // align decoder if needed for new line
+				break        // discard any repetition remaining (cause we reached the end of the line)
+			}
+			relativeX++
+		}
+	}
+	return
+}
+
+func legacyDecodeRLE(nibbles *legacyNibbleIterator) (p legacyRLEPixel, err error) {
+	// 1 nibble letters:  rrcc
+	// 2 nibbles letters: 00rr rrcc
+	// 3 nibbles letters: 0000 rrrr rrcc
+	// 4 nibbles letters: 0000 00rr rrrr rrcc
+	var firstNibble, secondNibble, thirdNibble, fourthNibble byte
+	var ok bool
+	if firstNibble, ok = nibbles.Next(); !ok {
+		err = errors.New("no more data")
+		return
+	}
+	if firstNibble&0b1100 != 0 {
+		// 1 nibble letter
+		p.repeat = (firstNibble & 0b1100) >> 2
+		p.color = firstNibble & 0b0011
+		return
+	}
+	// 3 possibilities left, all requiring a second nibble
+	if secondNibble, ok = nibbles.Next(); !ok {
+		if firstNibble != 0 {
+			err = fmt.Errorf("missing second nibble after 0b%04b", firstNibble)
+		}
+		return
+	}
+	if firstNibble != 0 {
+		// 2 nibbles letter
+		p.repeat = (firstNibble&0b0011)<<2 | (secondNibble&0b1100)>>2
+		p.color = secondNibble & 0b0011
+		return
+	}
+	// 2 possibilities left, both requiring a third nibble
+	if thirdNibble, ok = nibbles.Next(); !ok {
+		if firstNibble != 0 || secondNibble != 0 {
+			err = fmt.Errorf("missing third nibble after 0b%04b 0b%04b", firstNibble, secondNibble)
+		}
+		return
+	}
+	if secondNibble&0b1100 != 0 {
+		// 3 nibbles letter
+		p.repeat = secondNibble<<2 | (thirdNibble&0b1100)>>2
+		p.color = thirdNibble & 0b0011
+		return
+	}
+	// 4 nibbles letter
+	if fourthNibble, ok = nibbles.Next(); !ok {
+		if firstNibble != 0 || secondNibble != 0 || thirdNibble != 0 {
+			err = fmt.Errorf("missing fourth nibble after 0b%04b 0b%04b 0b%04b", firstNibble, secondNibble, thirdNibble)
+		}
+		return
+	}
+	p.repeat = secondNibble<<6 | thirdNibble<<2 | (fourthNibble&0b1100)>>2
+	p.color = fourthNibble & 0b0011
+	return
+}
+
+type legacyNibbleIterator struct {
+	data []byte
+	// instructions for next read
+	index   int
+	readLow bool
+}
+
+func (ni *legacyNibbleIterator) Next() (nibble byte, ok bool) {
+	if ni.Ended() {
+		return
+	}
+	ok = true
+	if !ni.readLow {
+		// First read at index
+		nibble = (ni.data[ni.index] & 0b11110000) >> 4
+	} else {
+		// Second read at index
+		nibble = (ni.data[ni.index] & 0b00001111)
+		ni.index++
+	}
+	ni.readLow = !ni.readLow
+	return
+}
+
+func (ni *legacyNibbleIterator) Align() {
+	if ni.readLow {
+		ni.index++
+		ni.readLow = false
+	}
+}
+
+func (ni *legacyNibbleIterator) Ended() bool {
+	return ni.index >= len(ni.data)
+}
+
+type legacyRLEPixel struct {
+	color  uint8 // only 4 values are used: 0x00, 0x01, 0x02, 0x03
+	repeat uint8
+}
@@ -0,0 +1,450 @@
+package vobsub
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// ScaleFilter selects the resampling algorithm used to scale subtitles images
+type ScaleFilter int
+
+const (
+	// ScaleFilterNearest uses the nearest source pixel: sharp and fast, paletted images stay paletted
+	ScaleFilterNearest ScaleFilter = iota
+	// ScaleFilterBilinear interpolates linearly between the source pixels (averaging them when downscaling)
+	ScaleFilterBilinear
+	// ScaleFilterLanczos uses a 3 lobes Lanczos kernel: the sharpest smooth filter
+	ScaleFilterLanczos
+	// ScaleFilterScale2x applies the Scale2x (EPX) edge-directed pixel-art scaler as many times as needed,
+	// then fits the result with ScaleFilterNearest. Diagonal edges are smoothed without adding colors: paletted images stay paletted.
+	ScaleFilterScale2x
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (sf ScaleFilter) String() string {
+	switch sf {
+	case ScaleFilterNearest:
+		return "Nearest"
+	case ScaleFilterBilinear:
+		return "Bilinear"
+	case ScaleFilterLanczos:
+		return "Lanczos"
+	case ScaleFilterScale2x:
+		return "Scale2x"
+	default:
+		return "Unknown"
+	}
+}
+
+// PixelAspectRatio is the shape of a pixel: its width relative to its height
+type PixelAspectRatio struct {
+	Width, Height int
+}
+
+// Pixel aspect ratios of DVD video (720 pixels wide frames)
+var (
+	PixelAspectRatioSquare    = PixelAspectRatio{Width: 1, Height: 1}
+	PixelAspectRatioNTSC4by3  = PixelAspectRatio{Width: 10, Height: 11}
+	PixelAspectRatioNTSC16by9 = PixelAspectRatio{Width: 40, Height: 33}
+	PixelAspectRatioPAL4by3   = PixelAspectRatio{Width: 12, Height: 11}
+	PixelAspectRatioPAL16by9  = PixelAspectRatio{Width: 16, Height: 11}
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (par PixelAspectRatio) String() string {
+	return fmt.Sprintf("%d:%d", par.Width, par.Height)
+}
+
+// ScaleOptions defines how the subtitles video frame (the canvas) is mapped onto the target video frame
+type ScaleOptions struct {
+	// Size of the target video frame (for example 1920x1080)
+	Size image.Point
+	// PixelAspectRatio of the source video. If zero, the source frame is stretched to fill the target frame.
+	// Otherwise the source frame is scaled to the target frame height with square pixels and centered horizontally
+	// (a 720 pixels wide DVD frame overflows a 16:9 HD frame a little, just like the DVD video does).
+	PixelAspectRatio PixelAspectRatio
+	Filter           ScaleFilter
+}
+
+// Scaler scales subtitles images (and their coordinates) from a source video frame to a target one
+type Scaler struct {
+	source, target image.Rectangle
+	filter         ScaleFilter
+	// target = source * factor + offset
+	factorX, factorY float64
+	offsetX, offsetY float64
+}
+
+// NewScaler returns a scaler mapping the source video frame of size canvas to the target frame defined by opts.
+func NewScaler(canvas image.Point, opts ScaleOptions) (scaler *Scaler, err error) {
+	if canvas.X <= 0 || canvas.Y <= 0 {
+		err = fmt.Errorf("invalid source frame size: %v", canvas)
+		return
+	}
+	if opts.Size.X <= 0 || opts.Size.Y <= 0 {
+		err = fmt.Errorf("invalid target frame size: %v", opts.Size)
+		return
+	}
+	if opts.Filter < ScaleFilterNearest || opts.Filter > ScaleFilterScale2x {
+		err = fmt.Errorf("unknown scale filter: %d", opts.Filter)
+		return
+	}
+	scaler = &Scaler{
+		source:  image.Rectangle{Max: canvas},
+		target:  image.Rectangle{Max: opts.Size},
+		filter:  opts.Filter,
+		factorX: float64(opts.Size.X) / float64(canvas.X),
+		factorY: float64(opts.Size.Y) / float64(canvas.Y),
+	}
+	switch {
+	case opts.PixelAspectRatio == PixelAspectRatio{}:
+		// stretch
+	case opts.PixelAspectRatio.Width <= 0 || opts.PixelAspectRatio.Height <= 0:
+		err = fmt.Errorf("invalid pixel aspect ratio: %s", opts.PixelAspectRatio)
+		scaler = nil
+		return
+	default:
+		scaler.factorX = scaler.factorY * float64(opts.PixelAspectRatio.Width) / float64(opts.PixelAspectRatio.Height)
+		scaler.offsetX = (float64(opts.Size.X) - float64(canvas.X)*scaler.factorX) / 2
+	}
+	return
+}
+
+// Rect returns the rectangle covering r once scaled.
+func (s *Scaler) Rect(r image.Rectangle) image.Rectangle {
+	return image.Rect(
+		int(math.Floor(float64(r.Min.X)*s.factorX+s.offsetX)),
+		int(math.Floor(float64(r.Min.Y)*s.factorY+s.offsetY)),
+		int(math.Ceil(float64(r.Max.X)*s.factorX+s.offsetX)),
+		int(math.Ceil(float64(r.Max.Y)*s.factorY+s.offsetY)),
+	)
+}
+
+// Placement returns the placement of a subtitle once scaled: its area is scaled and the canvas becomes the target frame.
+// The offset matches the bounds of the scaled images of the subtitle.
+func (s *Scaler) Placement(placement Placement) Placement {
+	scaled := Placement{
+		Area:   s.Rect(placement.Area),
+		Canvas: s.target,
+	}
+	if placement.Offset != (image.Point{}) {
+		scaled.Offset = scaled.Area.Min.Sub(s.Rect(placement.Area.Sub(placement.Offset)).Min)
+	}
+	return scaled
+}
+
+// Scale scales the image. The bounds of img are scaled with Rect(), except for full size images (bounds equal to the
+// source frame) which become the whole target frame. Paletted images stay paletted with the nearest and Scale2x filters,
+// other images are scaled as *image.RGBA.
+func (s *Scaler) Scale(img image.Image) image.Image {
+	bounds := img.Bounds()
+	output := s.Rect(bounds)
+	if bounds == s.source {
+		output = s.target
+	}
+	if bounds.Empty() || output.Empty() {
+		return image.NewRGBA(output)
+	}
+	switch s.filter {
+	case ScaleFilterBilinear:
+		return s.resample(toRGBA(img), output, 1, triangleKernel)
+	case ScaleFilterLanczos:
+		return s.resample(toRGBA(img), output, lanczosLobes, lanczosKernel)
+	case ScaleFilterScale2x:
+		grid := newPixelGrid(img)
+		for grid.factor < max(s.factorX, s.factorY) {
+			grid = grid.scale2x()
+		}
+		return s.nearest(grid, output)
+	default:
+		return s.nearest(newPixelGrid(img), output)
+	}
+}
+
+// sourceX returns the source frame position of the center of the target pixel column x
+func (s *Scaler) sourceX(x int) float64 {
+	return (float64(x) + 0.5 - s.offsetX) / s.factorX
+}
+
+// sourceY returns the source frame position of the center of the target pixel row y
+func (s *Scaler) sourceY(y int) float64 {
+	return (float64(y) + 0.5 - s.offsetY) / s.factorY
+}
+
+/*
+	Nearest and Scale2x
+*/
+
+// pixelGrid holds the pixels of an image (palette indexes or packed RGBA colors) magnified by factor
+type pixelGrid struct {
+	pixels  []uint32
+	width   int
+	height  int
+	bounds  image.Rectangle // bounds of the original image
+	factor  float64
+	palette color.Palette // nil if pixels are packed RGBA colors
+}
+
+func newPixelGrid(img image.Image) (grid pixelGrid) {
+	grid.bounds = img.Bounds()
+	grid.width, grid.height = grid.bounds.Dx(), grid.bounds.Dy()
+	grid.pixels = make([]uint32, grid.width*grid.height)
+	grid.factor = 1
+	if paletted, ok := img.(*image.Paletted); ok {
+		grid.palette = paletted.Palette
+		for y := range grid.height {
+			offset := paletted.PixOffset(grid.bounds.Min.X, grid.bounds.Min.Y+y)
+			for x := range grid.width {
+				grid.pixels[y*grid.width+x] = uint32(paletted.Pix[offset+x])
+			}
+		}
+		return
+	}
+	rgba := toRGBA(img)
+	for y := range grid.height {
+		offset := rgba.PixOffset(grid.bounds.Min.X, grid.bounds.Min.Y+y)
+		for x := range grid.width {
+			pix := rgba.Pix[offset+x*4 : offset+x*4+4]
+			grid.pixels[y*grid.width+x] = uint32(pix[0])<<24 | uint32(pix[1])<<16 | uint32(pix[2])<<8 | uint32(pix[3])
+		}
+	}
+	return
+}
+
+func (grid pixelGrid) at(x, y int) uint32 {
+	x = min(max(x, 0), grid.width-1)
+	y = min(max(y, 0), grid.height-1)
+	return grid.pixels[y*grid.width+x]
+}
+
+// scale2x returns the grid magnified 2 times with the Scale2x (EPX) algorithm
+func (grid pixelGrid) scale2x() (scaled pixelGrid) {
+	scaled = grid
+	scaled.width, scaled.height = grid.width*2, grid.height*2
+	scaled.factor = grid.factor * 2
+	scaled.pixels = make([]uint32, scaled.width*scaled.height)
+	for y := range grid.height {
+		for x := range grid.width {
+			//   A
+			// C P B
+			//   D
+			p := grid.at(x, y)
+			a, b, c, d := grid.at(x, y-1), grid.at(x+1, y), grid.at(x-1, y), grid.at(x, y+1)
+			e0, e1, e2, e3 := p, p, p, p
+			if c == a && c != d && a != b {
+				e0 = a
+			}
+			if a == b && a != c && b != d {
+				e1 = b
+			}
+			if d == c && d != b && c != a {
+				e2 = c
+			}
+			if b == d && b != a && d != c {
+				e3 = d
+			}
+			offset := y*2*scaled.width + x*2
+			scaled.pixels[offset], scaled.pixels[offset+1] = e0, e1
+			scaled.pixels[offset+scaled.width], scaled.pixels[offset+scaled.width+1] = e2, e3
+		}
+	}
+	return
+}
+
+func (s *Scaler) nearest(grid pixelGrid, output image.Rectangle) image.Image {
+	// Source grid column and row of each target column and row (-1 if outside of the source)
+	columns := make([]int, output.Dx())
+	for x := range columns {
+		columns[x] = gridIndex(s.sourceX(output.Min.X+x), grid.bounds.Min.X, grid.width, grid.factor)
+	}
+	rows := make([]int, output.Dy())
+	for y := range rows {
+		rows[y] = gridIndex(s.sourceY(output.Min.Y+y), grid.bounds.Min.Y, grid.height, grid.factor)
+	}
+	// Draw
+	if grid.palette != nil {
+		paletted := image.NewPaletted(output, grid.palette)
+		transparent := transparentIndex(&grid.palette)
+		paletted.Palette = grid.palette
+		for y, row := range rows {
+			line := paletted.Pix[y*paletted.Stride : y*paletted.Stride+output.Dx()]
+			for x, column := range columns {
+				if row < 0 || column < 0 {
+					line[x] = transparent
+				} else {
+					line[x] = uint8(grid.pixels[row*grid.width+column])
+				}
+			}
+		}
+		return paletted
+	}
+	rgba := image.NewRGBA(output)
+	for y, row := range rows {
+		if row < 0 {
+			continue
+		}
+		line := rgba.Pix[y*rgba.Stride : y*rgba.Stride+output.Dx()*4]
+		for x, column := range columns {
+			if column < 0 {
+				continue
+			}
+			pixel := grid.pixels[row*grid.width+column]
+			line[x*4], line[x*4+1], line[x*4+2], line[x*4+3] = uint8(pixel>>24), uint8(pixel>>16), uint8(pixel>>8), uint8(pixel)
+		}
+	}
+	return rgba
+}
+
+func gridIndex(position float64, min, size int, factor float64) int {
+	index := int(math.Floor((position - float64(min)) * factor))
+	if index < 0 || index >= size {
+		return -1
+	}
+	return index
+}
+
+// transparentIndex returns the index of the first transparent color of the palette, adding one if needed (and possible)
+func transparentIndex(palette *color.Palette) uint8 {
+	for index, paletteColor := range *palette {
+		if _, _, _, a := paletteColor.RGBA(); a == 0 {
+			return uint8(index)
+		}
+	}
+	if len(*palette) < 256 {
+		*palette = append((*palette)[:len(*palette):len(*palette)], color.NRGBA{})
+		return uint8(len(*palette) - 1)
+	}
+	return 0
+}
+
+/*
+	Bilinear and Lanczos
+*/
+
+const (
+	lanczosLobes = 3
+)
+
+func triangleKernel(x float64) float64 {
+	return max(0, 1-math.Abs(x))
+}
+
+func lanczosKernel(x float64) float64 {
+	switch {
+	case x == 0:
+		return 1
+	case math.Abs(x) >= lanczosLobes:
+		return 0
+	default:
+		return lanczosLobes * math.Sin(math.Pi*x) * math.Sin(math.Pi*x/lanczosLobes) / (math.Pi * math.Pi * x * x)
+	}
+}
+
+// resampleTaps are the source pixels (and their weights) contributing to a target pixel
+type resampleTaps struct {
+	first   int // index of the first source pixel, relative to the source bounds
+	weights []float64
+}
+
+// computeTaps computes the taps of each target pixel. Source pixels outside of the source are transparent:
+// their weights are dropped but still count in the normalization, fading the edges.
+func computeTaps(count int, toSource func(int) float64, sourceMin, sourceSize int, factor, support float64, kernel func(float64) float64) (taps []resampleTaps) {
+	scale := max(1, 1/factor) // widen the kernel when downscaling
+	radius := support * scale
+	taps = make([]resampleTaps, count)
+	for index := range taps {
+		center := toSource(index) - float64(sourceMin) - 0.5
+		first, last := int(math.Floor(center-radius))+1, int(math.Floor(center+radius))
+		var total float64
+		weights := make([]float64, 0, last-first+1)
+		for source := first; source <= last; source++ {
+			weight := kernel((float64(source) - center) / scale)
+			total += weight
+			weights = append(weights, weight)
+		}
+		if total != 0 {
+			for i := range weights {
+				weights[i] /= total
+			}
+		}
+		// Drop the taps outside of the source
+		if first < 0 {
+			weights = weights[min(-first, len(weights)):]
+			first = 0
+		}
+		if overflow := first + len(weights) - sourceSize; overflow > 0 {
+			weights = weights[:len(weights)-min(overflow, len(weights))]
+		}
+		taps[index] = resampleTaps{first: first, weights: weights}
+	}
+	return
+}
+
+// resample scales src into output with a separable kernel, working on premultiplied colors
+func (s *Scaler) resample(src *image.RGBA, output image.Rectangle, support float64, kernel func(float64) float64) *image.RGBA {
+	bounds := src.Bounds()
+	columns := computeTaps(output.Dx(), func(x int) float64 { return s.sourceX(output.Min.X + x) },
+		bounds.Min.X, bounds.Dx(), s.factorX, support, kernel)
+	rows := computeTaps(output.Dy(), func(y int) float64 { return s.sourceY(output.Min.Y + y) },
+		bounds.Min.Y, bounds.Dy(), s.factorY, support, kernel)
+	// Horizontal pass: every source row, target columns
+	horizontal := make([]float64, bounds.Dy()*output.Dx()*4)
+	for y := range bounds.Dy() {
+		srcLine := src.Pix[y*src.Stride:]
+		line := horizontal[y*output.Dx()*4:]
+		for x, taps := range columns {
+			var r, g, b, a float64
+			for i, weight := range taps.weights {
+				pix := srcLine[(taps.first+i)*4:]
+				r += weight * float64(pix[0])
+				g += weight * float64(pix[1])
+				b += weight * float64(pix[2])
+				a += weight * float64(pix[3])
+			}
+			line[x*4], line[x*4+1], line[x*4+2], line[x*4+3] = r, g, b, a
+		}
+	}
+	// Vertical pass
+	dst := image.NewRGBA(output)
+	for y, taps := range rows {
+		dstLine := dst.Pix[y*dst.Stride:]
+		for x := range output.Dx() {
+			var r, g, b, a float64
+			for i, weight := range taps.weights {
+				pix := horizontal[((taps.first+i)*output.Dx()+x)*4:]
+				r += weight * pix[0]
+				g += weight * pix[1]
+				b += weight * pix[2]
+				a += weight * pix[3]
+			}
+			// Lanczos can overshoot: keep valid premultiplied values
+			alpha := clampChannel(a, 0xff)
+			dstLine[x*4] = clampChannel(r, alpha)
+			dstLine[x*4+1] = clampChannel(g, alpha)
+			dstLine[x*4+2] = clampChannel(b, alpha)
+			dstLine[x*4+3] = alpha
+		}
+	}
+	return dst
+}
+
+func clampChannel(value float64, maxValue uint8) uint8 {
+	return uint8(min(max(math.Round(value), 0), float64(maxValue)))
+}
+
+// toRGBA returns img as an *image.RGBA with the same bounds (img itself if it already is one)
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Rect, img, rgba.Rect.Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,81 @@
+package vobsub
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestScaleImageFormat(t *testing.T) {
+	palette := testPalette()
+	metadata := testMetadata(palette)
+	img := image.NewPaletted(image.Rect(100, 480, 300, 510), color.Palette{color.Transparent, color.White, color.Black})
+	for x := img.Rect.Min.X + 4; x < img.Rect.Max.X-4; x++ {
+		img.SetColorIndex(x, 490, 1)
+		img.SetColorIndex(x, 491, 2)
+	}
+	raw, err := NewSubtitleRaw(img, palette, EncodeParams{
+		Colors: [SubtitleColorSlots]uint8{0, 1, 2, 3},
+		Alphas: [SubtitleColorSlots]uint8{0, 15, 15, 15},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []ScaleFilter{ScaleFilterNearest, ScaleFilterBilinear, ScaleFilterLanczos, ScaleFilterScale2x} {
+		for _, format := range []ImageFormat{ImageFormatRGBA, ImageFormatNRGBA, ImageFormatPaletted} {
+			opts := RenderOptions{
+				Format: format,
+				Scale:  &ScaleOptions{Size: image.Pt(1920, 1080), Filter: filter},
+			}
+			scaled, _, _, err := raw.DecodeWithOptions(metadata, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected color.Model
+			switch typed := scaled.(type) {
+			case *image.RGBA:
+				if format == ImageFormatRGBA {
+					expected = color.RGBAModel
+				}
+			case *image.NRGBA:
+				if format == ImageFormatNRGBA {
+					expected = color.NRGBAModel
+				}
+			case *image.Paletted:
+				if format == ImageFormatPaletted {
+					expected = typed.Palette
+				}
+			}
+			if expected == nil {
+				t.Errorf("%s filter, %s format: got a %T image", filter, format, scaled)
+				continue
+			}
+			// Lazy images must report the model of their pixels
+			opts.Lazy = true
+			lazy, _, _, err := raw.DecodeWithOptions(metadata, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameColorModel(lazy.ColorModel(), expected) {
+				t.Errorf("%s filter, %s format: lazy image color model does not match its pixels", filter, format)
+			}
+		}
+	}
+}
+
+func sameColorModel(a, b color.Model) bool {
+	paletteA, okA := a.(color.Palette)
+	paletteB, okB := b.(color.Palette)
+	if !okA || !okB {
+		return a == b
+	}
+	if len(paletteA) != len(paletteB) {
+		return false
+	}
+	for index := range paletteA {
+		if paletteA[index] != paletteB[index] {
+			return false
+		}
+	}
+	return true
+}
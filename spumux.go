@@ -0,0 +1,411 @@
+package vobsub
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	spumuxFormatPAL  = "PAL"
+	spumuxFormatNTSC = "NTSC"
+	spumuxYes        = "yes"
+)
+
+// Video frame sizes of the spumux formats
+var (
+	spumuxSizePAL  = image.Point{X: 720, Y: 576}
+	spumuxSizeNTSC = image.Point{X: 720, Y: 480}
+)
+
+// spumux XML project, as read by dvdauthor spumux
+type spumuxDocument struct {
+	XMLName xml.Name       `xml:"subpictures"`
+	Format  string         `xml:"format,attr,omitempty"`
+	Streams []spumuxStream `xml:"stream"`
+}
+
+type spumuxStream struct {
+	SPUs []spumuxSPU `xml:"spu"`
+	// Other elements (textsub) are not supported when reading
+	Others []spumuxElement `xml:",any"`
+}
+
+type spumuxElement struct {
+	XMLName xml.Name
+}
+
+type spumuxSPU struct {
+	Start       string `xml:"start,attr"`
+	End         string `xml:"end,attr,omitempty"`
+	Image       string `xml:"image,attr,omitempty"`
+	Highlight   string `xml:"highlight,attr,omitempty"`
+	Select      string `xml:"select,attr,omitempty"`
+	Transparent string `xml:"transparent,attr,omitempty"`
+	Force       string `xml:"force,attr,omitempty"`
+	XOffset     int    `xml:"xoffset,attr"`
+	YOffset     int    `xml:"yoffset,attr"`
+}
+
+// SpumuxOptions defines how subtitles are written as a dvdauthor spumux XML project and its PNG images
+type SpumuxOptions struct {
+	// Scale optionally scales the subtitles from their canvas to a DVD video frame (720x576 for PAL, 720x480 for NTSC).
+	// The canvas (once scaled) must be one of them.
+	Scale *ScaleOptions
+	// ForcedOnly only writes the forced subtitles
+	ForcedOnly bool
+}
+
+// WriteSpumux writes the subtitles of a stream as a dvdauthor spumux XML project at xmlFile, along with one PNG image per
+// subtitle written next to it (named after the XML file and numbered from 1). Subtitles must share the same canvas.
+// Images are placed using their Placement and cropped to their visible pixels, their position on the video becoming
+// the spu offsets. Just like within a SPU, each image is reduced to 4 colors (see Encode()) and written as a paletted PNG
+// whose first color is the transparent one, declared by the spu transparent attribute.
+// Subtitles without stop time get no end time. It returns the number of subtitles written.
+func WriteSpumux(xmlFile string, subtitles []Subtitle, opts SpumuxOptions) (nbSubtitles int, err error) {
+	// Get the video format
+	canvas, err := commonCanvas(subtitles)
+	if err != nil {
+		return
+	}
+	var scaler *Scaler
+	if opts.Scale != nil {
+		if scaler, err = NewScaler(canvas.Size(), *opts.Scale); err != nil {
+			err = fmt.Errorf("invalid scale options: %w", err)
+			return
+		}
+		canvas = scaler.target
+	}
+	document := spumuxDocument{Streams: make([]spumuxStream, 1)}
+	switch {
+	case len(subtitles) == 0:
+	case canvas.Size() == spumuxSizePAL:
+		document.Format = spumuxFormatPAL
+	case canvas.Size() == spumuxSizeNTSC:
+		document.Format = spumuxFormatNTSC
+	default:
+		err = fmt.Errorf("%v canvas is not a DVD video frame: scale the subtitles to %v (PAL) or %v (NTSC)",
+			canvas.Size(), spumuxSizePAL, spumuxSizeNTSC)
+		return
+	}
+	// Place the images and reduce their colors (errors report the subtitles by their index within subtitles)
+	order := make([]int, 0, len(subtitles))
+	for index, sub := range subtitles {
+		if !opts.ForcedOnly || sub.Forced {
+			order = append(order, index)
+		}
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(subtitles[a].Start, subtitles[b].Start) })
+	images := make([]image.Image, len(order))
+	for position, index := range order {
+		if images[position], err = placedImage(subtitles[index], scaler); err != nil {
+			err = fmt.Errorf("failed to place subtitle #%d: %w", index+1, err)
+			return
+		}
+	}
+	palette := buildPalette(images, idxPaletteLen)
+	// Write the images
+	var (
+		base       = strings.TrimSuffix(filepath.Base(xmlFile), filepath.Ext(xmlFile))
+		imagesPath = filepath.Dir(xmlFile)
+		paletted   *image.Paletted
+	)
+	for position, index := range order {
+		sub := subtitles[index]
+		if images[position].Bounds().Empty() {
+			continue // nothing visible
+		}
+		if paletted, err = reduceToSlots(images[position], palette); err != nil {
+			err = fmt.Errorf("failed to reduce subtitle #%d colors: %w", index+1, err)
+			return
+		}
+		nbSubtitles++
+		transparent := paletted.Palette[0].(color.NRGBA)
+		spu := spumuxSPU{
+			Start:       formatSpumuxTimestamp(sub.Start),
+			Image:       numberedImageFile(base, nbSubtitles),
+			Transparent: hex.EncodeToString([]byte{transparent.R, transparent.G, transparent.B}),
+			XOffset:     paletted.Rect.Min.X,
+			YOffset:     paletted.Rect.Min.Y,
+		}
+		if sub.Stop > sub.Start {
+			spu.End = formatSpumuxTimestamp(sub.Stop)
+		}
+		if sub.Forced {
+			spu.Force = spumuxYes
+		}
+		if err = writePNG(filepath.Join(imagesPath, spu.Image), paletted); err != nil {
+			err = fmt.Errorf("failed to write subtitle #%d image: %w", index+1, err)
+			return
+		}
+		document.Streams[0].SPUs = append(document.Streams[0].SPUs, spu)
+	}
+	// Write the project
+	fd, err := os.Create(xmlFile)
+	if err != nil {
+		err = fmt.Errorf("failed to create XML file: %w", err)
+		return
+	}
+	defer fd.Close()
+	encoder := xml.NewEncoder(fd)
+	encoder.Indent("", "  ")
+	if err = encoder.Encode(document); err != nil {
+		err = fmt.Errorf("failed to write XML file: %w", err)
+		return
+	}
+	if _, err = fd.WriteString("\n"); err != nil {
+		err = fmt.Errorf("failed to write XML file: %w", err)
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close XML file: %w", err)
+	}
+	return
+}
+
+// reduceToSlots returns the image reduced to the 4 colors a SPU would display it with (see chooseSlots()), as a paletted
+// image whose first color is the transparent background. Its RGB value differs from the other colors ones.
+func reduceToSlots(img image.Image, palette color.Palette) (paletted *image.Paletted, err error) {
+	params := chooseSlots(img, palette)
+	slots, err := quantizeToSlots(img, palette, params)
+	if err != nil {
+		return
+	}
+	colors := make(color.Palette, SubtitleColorSlots)
+	for slot := 1; slot < SubtitleColorSlots; slot++ {
+		slotColor := color.NRGBAModel.Convert(palette[params.Colors[slot]]).(color.NRGBA)
+		slotColor.A = uint8(float64(slotColor.A) * float64(params.Alphas[slot]) * subtitleCTRLSeqCmdAlphaChannelRatio)
+		colors[slot] = slotColor
+	}
+	// Find an RGB value for the transparent color unused by the visible ones (unused slots become transparent too)
+	transparent := color.NRGBA{}
+	for slices.ContainsFunc(colors[1:], func(c color.Color) bool {
+		nrgba := c.(color.NRGBA)
+		return nrgba.A != 0 && nrgba.R == transparent.R && nrgba.G == transparent.G && nrgba.B == transparent.B
+	}) {
+		transparent.R++
+		transparent.G++
+		transparent.B++
+	}
+	for slot, slotColor := range colors {
+		if slot == 0 || slotColor.(color.NRGBA).A == 0 {
+			colors[slot] = transparent
+		}
+	}
+	paletted = image.NewPaletted(img.Bounds(), colors)
+	copy(paletted.Pix, slots)
+	return
+}
+
+// formatSpumuxTimestamp formats a timestamp as expected by spumux: hh:mm:ss.cc
+func formatSpumuxTimestamp(timestamp time.Duration) string {
+	return formatTimestamp(timestamp, 2, '.', 2)
+}
+
+/*
+	Reading
+*/
+
+// SpumuxPicture selects which picture of the spumux spu elements becomes the subtitle image
+type SpumuxPicture int
+
+const (
+	// SpumuxPictureImage uses the image picture: what is displayed while no button is highlighted. Elements without
+	// image use their highlight picture, or their select picture if they have none.
+	SpumuxPictureImage SpumuxPicture = iota
+	// SpumuxPictureHighlight uses the highlight picture (the image one if missing): what is displayed while all
+	// buttons are highlighted
+	SpumuxPictureHighlight
+	// SpumuxPictureSelect uses the select picture (the image one if missing): what is displayed while all buttons
+	// are activated
+	SpumuxPictureSelect
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (sp SpumuxPicture) String() string {
+	switch sp {
+	case SpumuxPictureImage:
+		return "image"
+	case SpumuxPictureHighlight:
+		return "highlight"
+	case SpumuxPictureSelect:
+		return "select"
+	default:
+		return "Unknown"
+	}
+}
+
+// files returns the picture files of a spu element to use, in order of preference
+func (sp SpumuxPicture) files(spu spumuxSPU) []string {
+	switch sp {
+	case SpumuxPictureHighlight:
+		return []string{spu.Highlight, spu.Image, spu.Select}
+	case SpumuxPictureSelect:
+		return []string{spu.Select, spu.Image, spu.Highlight}
+	default:
+		return []string{spu.Image, spu.Highlight, spu.Select}
+	}
+}
+
+// ReadSpumux reads a single stream dvdauthor spumux XML project and its PNG images (relative to the XML file directory)
+// and returns its subtitles in presentation order. Streams without spu data (textsub) are not supported. picture selects which picture of each spu element becomes
+// the subtitle image: highlight and select pictures are displayed by DVD players over the image one when menu buttons
+// are highlighted or activated, which a subtitle can not do. Pixels of the spu transparent color are made transparent
+// and images are placed at the spu offsets on the video frame of the project format (NTSC if not set).
+// Elements without end time have no stop time.
+func ReadSpumux(xmlFile string, picture SpumuxPicture) (subtitles []Subtitle, err error) {
+	data, err := os.ReadFile(xmlFile)
+	if err != nil {
+		err = fmt.Errorf("failed to read XML file: %w", err)
+		return
+	}
+	var document spumuxDocument
+	if err = xml.Unmarshal(data, &document); err != nil {
+		err = fmt.Errorf("failed to parse XML file: %w", err)
+		return
+	}
+	canvas := image.Rectangle{Max: spumuxSizeNTSC}
+	switch strings.ToUpper(strings.TrimSpace(document.Format)) {
+	case "", spumuxFormatNTSC:
+	case spumuxFormatPAL:
+		canvas = image.Rectangle{Max: spumuxSizePAL}
+	default:
+		err = fmt.Errorf("unknown format: %q (expected %s or %s)", document.Format, spumuxFormatPAL, spumuxFormatNTSC)
+		return
+	}
+	if len(document.Streams) > 1 {
+		err = fmt.Errorf("project contains %d streams: only single stream projects are supported", len(document.Streams))
+		return
+	}
+	imagesPath := filepath.Dir(xmlFile)
+	number := 0
+	for _, stream := range document.Streams {
+		if len(stream.Others) > 0 {
+			err = fmt.Errorf("unsupported <%s> element: only spu elements can be read", stream.Others[0].XMLName.Local)
+			return
+		}
+		for _, spu := range stream.SPUs {
+			number++
+			sub := Subtitle{
+				Forced: strings.EqualFold(spu.Force, spumuxYes),
+				Placement: Placement{
+					Canvas: canvas,
+					Offset: image.Point{X: spu.XOffset, Y: spu.YOffset},
+				},
+			}
+			if sub.Start, err = parseSpumuxTimestamp(spu.Start); err != nil {
+				err = fmt.Errorf("spu #%d: invalid start: %w", number, err)
+				return
+			}
+			sub.Stop = sub.Start
+			if spu.End != "" {
+				if sub.Stop, err = parseSpumuxTimestamp(spu.End); err != nil {
+					err = fmt.Errorf("spu #%d: invalid end: %w", number, err)
+					return
+				}
+			}
+			// Get the picture
+			index := slices.IndexFunc(picture.files(spu), func(file string) bool { return strings.TrimSpace(file) != "" })
+			if index < 0 {
+				err = fmt.Errorf("spu #%d has no picture", number)
+				return
+			}
+			file := strings.TrimSpace(picture.files(spu)[index])
+			var img image.Image
+			if img, err = readPNG(filepath.Join(imagesPath, file)); err != nil {
+				err = fmt.Errorf("spu #%d: failed to read picture %q: %w", number, file, err)
+				return
+			}
+			var transparent *color.NRGBA
+			if spu.Transparent != "" {
+				if transparent, err = parseSpumuxColor(spu.Transparent); err != nil {
+					err = fmt.Errorf("spu #%d: invalid transparent color: %w", number, err)
+					return
+				}
+			}
+			sub.Image = spumuxImage(img, transparent)
+			sub.Placement.Area = sub.Image.Bounds().Add(sub.Placement.Offset)
+			subtitles = append(subtitles, sub)
+		}
+	}
+	return sortedByStart(subtitles), nil
+}
+
+// ConvertSpumux reads a dvdauthor spumux XML project (see ReadSpumux()) and writes its subtitles as a new sub/idx pair at
+// subFile (see Encode()). It returns the number of subtitles read.
+func ConvertSpumux(xmlFile, subFile string, picture SpumuxPicture, opts EncodeOptions) (nbSubtitles int, err error) {
+	subtitles, err := ReadSpumux(xmlFile, picture)
+	if err != nil {
+		err = fmt.Errorf("failed to read spumux XML: %w", err)
+		return
+	}
+	if err = Encode(subFile, subtitles, opts); err != nil {
+		return
+	}
+	return len(subtitles), nil
+}
+
+// spumuxImage returns the picture with its bounds starting at (0, 0) and the pixels of the transparent color (if any)
+// made transparent
+func spumuxImage(picture image.Image, transparent *color.NRGBA) *image.NRGBA {
+	bounds := picture.Bounds()
+	img := image.NewNRGBA(image.Rectangle{Max: bounds.Size()})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			pixel := color.NRGBAModel.Convert(picture.At(x, y)).(color.NRGBA)
+			if transparent != nil && pixel.R == transparent.R && pixel.G == transparent.G && pixel.B == transparent.B {
+				continue
+			}
+			img.SetNRGBA(x-bounds.Min.X, y-bounds.Min.Y, pixel)
+		}
+	}
+	return img
+}
+
+// parseSpumuxColor parses a rrggbb color (optionally prefixed by #)
+func parseSpumuxColor(value string) (c *color.NRGBA, err error) {
+	decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(value), "#"))
+	if err != nil || len(decoded) != 3 {
+		err = fmt.Errorf("expected rrggbb hexadecimal color: got %q", value)
+		return
+	}
+	return &color.NRGBA{R: decoded[0], G: decoded[1], B: decoded[2], A: 0xff}, nil
+}
+
+// parseSpumuxTimestamp parses a spumux timestamp: [[hh:]mm:]ss[.fraction]
+func parseSpumuxTimestamp(value string) (timestamp time.Duration, err error) {
+	fields := strings.Split(strings.TrimSpace(value), ":")
+	if len(fields) > 3 {
+		err = fmt.Errorf("invalid timestamp %q: expected [[hh:]mm:]ss[.fraction]", value)
+		return
+	}
+	seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil || seconds < 0 {
+		err = fmt.Errorf("invalid timestamp %q: invalid seconds", value)
+		return
+	}
+	timestamp = time.Duration(math.Round(seconds * float64(time.Second)))
+	unit := time.Minute
+	for index := len(fields) - 2; index >= 0; index-- {
+		var count int
+		if count, err = strconv.Atoi(fields[index]); err != nil || count < 0 {
+			err = fmt.Errorf("invalid timestamp %q: invalid field %q", value, fields[index])
+			return
+		}
+		timestamp += time.Duration(count) * unit
+		unit = time.Hour
+	}
+	return
+}
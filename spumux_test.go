@@ -0,0 +1,176 @@
+package vobsub
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSpumuxForcedOnlyErrorIndex(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	subtitles := []Subtitle{
+		{Start: time.Second, Image: image.NewNRGBA(image.Rect(0, 0, 8, 8)), Placement: Placement{Canvas: canvas}},
+		{Start: 2 * time.Second, Forced: true, Placement: Placement{Canvas: canvas}}, // no image
+	}
+	_, err := WriteSpumux(filepath.Join(t.TempDir(), "subs.xml"), subtitles, SpumuxOptions{ForcedOnly: true})
+	if err == nil || !strings.Contains(err.Error(), "subtitle #2") {
+		t.Errorf("expected an error about subtitle #2, got: %v", err)
+	}
+}
+
+func TestReadSpumuxUnsupported(t *testing.T) {
+	for _, test := range []struct {
+		name, xml, expected string
+	}{
+		{"multiple streams", `<subpictures><stream></stream><stream></stream></subpictures>`, "2 streams"},
+		{"textsub", `<subpictures><stream><textsub filename="subs.srt"/></stream></subpictures>`, "<textsub>"},
+	} {
+		file := filepath.Join(t.TempDir(), "subs.xml")
+		if err := os.WriteFile(file, []byte(test.xml), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadSpumux(file, SpumuxPictureImage); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got: %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestSpumuxRoundTrip(t *testing.T) {
+	subtitles, rect := testWebSubtitles()
+	file := filepath.Join(t.TempDir(), "subs.xml")
+	nbSubtitles, err := WriteSpumux(file, subtitles, SpumuxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbSubtitles != 2 {
+		t.Fatalf("expected 2 subtitles written, got %d", nbSubtitles)
+	}
+	read, err := ReadSpumux(file, SpumuxPictureImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("expected 2 subtitles read, got %d", len(read))
+	}
+	source := subtitles[0].Image.(*image.NRGBA)
+	for index, expected := range []Subtitle{subtitles[1], subtitles[0]} {
+		sub := read[index]
+		if sub.Start != expected.Start || sub.Stop != expected.Stop || sub.Forced != expected.Forced {
+			t.Errorf("subtitle #%d: expected %v-%v forced %v, got %v-%v forced %v", index+1,
+				expected.Start, expected.Stop, expected.Forced, sub.Start, sub.Stop, sub.Forced)
+		}
+		if sub.Placement.Canvas != expected.Placement.Canvas || sub.Placement.Area != rect {
+			t.Errorf("subtitle #%d: expected area %v in %v, got %v in %v", index+1,
+				rect, expected.Placement.Canvas, sub.Placement.Area, sub.Placement.Canvas)
+			continue
+		}
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				got := color.NRGBAModel.Convert(sub.Image.At(x-sub.Placement.Offset.X, y-sub.Placement.Offset.Y)).(color.NRGBA)
+				if visible := source.NRGBAAt(x, y).A != 0; visible != (got.A != 0) || visible && (got.R != 0xff || got.G != 0xff || got.B != 0xff) {
+					t.Fatalf("subtitle #%d: expected %v at (%d,%d), got %v", index+1, source.NRGBAAt(x, y), x, y, got)
+				}
+			}
+		}
+	}
+}
+
+func TestReadSpumuxPictures(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		red  = color.NRGBA{R: 0xff, A: 0xff}
+		blue = color.NRGBA{B: 0xff, A: 0xff}
+	)
+	// Pictures are told apart by their width, and their first pixel is red
+	for file, width := range map[string]int{"image.png": 4, "highlight.png": 6, "select.png": 8} {
+		img := image.NewNRGBA(image.Rect(0, 0, width, 2))
+		draw.Draw(img, img.Rect, image.NewUniform(blue), image.Point{}, draw.Src)
+		img.SetNRGBA(0, 0, red)
+		if err := writePNG(filepath.Join(dir, file), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "subs.xml")
+	document := `<subpictures format="PAL"><stream>
+<spu start="1" end="1:02.5" highlight="highlight.png" select="select.png" xoffset="10" yoffset="20" transparent="#ff0000"/>
+<spu start="00:01:05.25" image="image.png" select="select.png" force="yes"/>
+</stream></subpictures>`
+	if err := os.WriteFile(file, []byte(document), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		picture SpumuxPicture
+		widths  [2]int
+	}{
+		{SpumuxPictureImage, [2]int{6, 4}},
+		{SpumuxPictureHighlight, [2]int{6, 4}},
+		{SpumuxPictureSelect, [2]int{8, 8}},
+	} {
+		subtitles, err := ReadSpumux(file, test.picture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subtitles) != 2 {
+			t.Fatalf("%s: expected 2 subtitles, got %d", test.picture, len(subtitles))
+		}
+		for index, sub := range subtitles {
+			if width := sub.Image.Bounds().Dx(); width != test.widths[index] {
+				t.Errorf("%s: subtitle #%d: expected a %d pixels wide picture, got %d", test.picture, index+1, test.widths[index], width)
+			}
+		}
+	}
+	subtitles, err := ReadSpumux(file, SpumuxPictureImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := subtitles[0], subtitles[1]
+	if first.Start != time.Second || first.Stop != 62500*time.Millisecond || first.Forced {
+		t.Errorf("expected a 1s-1m2.5s subtitle, got %v-%v forced %v", first.Start, first.Stop, first.Forced)
+	}
+	if second.Start != 65250*time.Millisecond || second.Stop != second.Start || !second.Forced {
+		t.Errorf("expected a forced 1m5.25s subtitle without stop time, got %v-%v forced %v", second.Start, second.Stop, second.Forced)
+	}
+	if area := image.Rect(10, 20, 16, 22); first.Placement.Area != area || first.Placement.Canvas.Size() != spumuxSizePAL {
+		t.Errorf("expected area %v in a PAL canvas, got %v in %v", area, first.Placement.Area, first.Placement.Canvas)
+	}
+	// The transparent color only applies to the element declaring it
+	if got := color.NRGBAModel.Convert(first.Image.At(0, 0)); got != (color.NRGBA{}) {
+		t.Errorf("expected the transparent color to be transparent, got %v", got)
+	}
+	if got := color.NRGBAModel.Convert(first.Image.At(1, 0)); got != blue {
+		t.Errorf("expected %v, got %v", blue, got)
+	}
+	if got := color.NRGBAModel.Convert(second.Image.At(0, 0)); got != red {
+		t.Errorf("expected %v, got %v", red, got)
+	}
+}
+
+func TestParseSpumuxTimestamp(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"5":          5 * time.Second,
+		"2.5":        2500 * time.Millisecond,
+		"1:05":       65 * time.Second,
+		"01:05.25":   65250 * time.Millisecond,
+		"1:02:03.04": time.Hour + 2*time.Minute + 3040*time.Millisecond,
+		" 00:00:01 ": time.Second,
+	} {
+		if timestamp, err := parseSpumuxTimestamp(value); err != nil || timestamp != expected {
+			t.Errorf("%q: expected %v, got %v (%v)", value, expected, timestamp, err)
+		}
+	}
+	for _, value := range []string{"", "a", "-1", "1:-2:03", "1:2:3:4"} {
+		if _, err := parseSpumuxTimestamp(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+	for _, value := range []string{"ff00", "red", "#ff000000"} {
+		if _, err := parseSpumuxColor(value); err == nil {
+			t.Errorf("%q: expected an invalid color error", value)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // StreamParsePacket try to read a packet from the stream at the given position and returns any underlying privatestream1 packets found.
 // Test the return stream id as it might also encounter a padding stream. Any other streamid will end with an error.
 // If no error, nextAt indicate the next packet position to read.
+// Scrambled (CSS) packets are returned as is: check their status with the packet Scrambled() method.
 func StreamParsePacket(stream io.ReaderAt, currentPosition int64) (packet PESPacket, nextAt int64, err error) {
 	// Read Start code and verify it is a pack header
 	var (
@@ -173,3 +175,55 @@ func streamParsePaddingStream(stream io.ReaderAt, currentPosition int64, mph MPE
 	// fmt.Println()
 	return
 }
+
+// StreamSummary gives an overview of a subtitle stream contained within a .sub file
+type StreamSummary struct {
+	Packets          int                       // number of private stream 1 packets
+	Subtitles        int                       // number of packets starting a new subtitle (the ones carrying a PTS)
+	ScrambledPackets int                       // number of packets with a scrambled payload
+	Scrambling       map[ScramblingControl]int // number of scrambled packets for each scrambling control
+}
+
+// SummarizeStreams computes a summary for each subtitle stream found within the private stream 1 packets.
+// The returned map contains all streams with their ID as key.
+func SummarizeStreams(privateStream1Packets []PESPacket) (summaries map[int]StreamSummary) {
+	summaries = make(map[int]StreamSummary, 1)
+	for _, pkt := range privateStream1Packets {
+		streamID := pkt.Header.SubStreamID.SubtitleID()
+		summary := summaries[streamID]
+		summary.Packets++
+		if pkt.HasPTS() {
+			summary.Subtitles++
+		}
+		if pkt.Scrambled() {
+			summary.ScrambledPackets++
+			if summary.Scrambling == nil {
+				summary.Scrambling = make(map[ScramblingControl]int, 2)
+			}
+			summary.Scrambling[pkt.ScramblingControl()]++
+		}
+		summaries[streamID] = summary
+	}
+	return
+}
+
+// Scrambled returns true if at least one packet of the stream is scrambled
+func (ss StreamSummary) Scrambled() bool {
+	return ss.ScrambledPackets > 0
+}
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (ss StreamSummary) String() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("StreamSummary{Packets: %d, Subtitles: %d, ScrambledPackets: %d",
+		ss.Packets, ss.Subtitles, ss.ScrambledPackets))
+	for _, sc := range []ScramblingControl{ScramblingControlReserved, ScramblingControlEvenKey, ScramblingControlOddKey} {
+		if count := ss.Scrambling[sc]; count > 0 {
+			builder.WriteString(fmt.Sprintf(", %s: %d", sc, count))
+		}
+	}
+	builder.WriteString("}")
+	return builder.String()
+}
@@ -0,0 +1,265 @@
+package vobsub
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TextFormat selects the text subtitles format written by WriteText()
+type TextFormat int
+
+const (
+	// TextFormatSRT is SubRip. It has no forced flag: use TextExportOptions.ForcedOnly to write a forced only file.
+	TextFormatSRT TextFormat = iota
+	// TextFormatWebVTT is WebVTT. Forced subtitles text is within a "forced" class: <c.forced>...</c>
+	TextFormatWebVTT
+	// TextFormatASS is Advanced SubStation Alpha. Forced subtitles use the "Forced" style.
+	TextFormatASS
+)
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (tf TextFormat) String() string {
+	switch tf {
+	case TextFormatSRT:
+		return "SRT"
+	case TextFormatWebVTT:
+		return "WebVTT"
+	case TextFormatASS:
+		return "ASS"
+	default:
+		return "Unknown"
+	}
+}
+
+// Extension returns the usual file extension of the format.
+func (tf TextFormat) Extension() string {
+	switch tf {
+	case TextFormatWebVTT:
+		return ".vtt"
+	case TextFormatASS:
+		return ".ass"
+	default:
+		return ".srt"
+	}
+}
+
+const (
+	// TextDefaultMinConfidence is the default confidence under which cues are reported
+	TextDefaultMinConfidence = 0.9
+
+	textReportSuffix   = ".low-confidence.txt"
+	textASSStyle       = "Default"
+	textASSForcedStyle = "Forced"
+)
+
+// textVTTEscaper escapes the cue text special characters (and "-->" with them), keeping the italic tags
+var textVTTEscaper = strings.NewReplacer(ocrItalicOpen, ocrItalicOpen, ocrItalicClose, ocrItalicClose,
+	"&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// textASSEscaper escapes the override block and escape sequence characters of the dialogue text and turns its new lines
+// and italic tags into ASS ones (a single pass: the inserted tags are not escaped)
+var textASSEscaper = strings.NewReplacer(`\`, `\\`, "{", `\{`, "}", `\}`,
+	"\n", `\N`, ocrItalicOpen, `{\i1}`, ocrItalicClose, `{\i0}`)
+
+// TextExportOptions defines how recognized subtitles (see DecodeOptions.OCR) are written as text subtitles
+type TextExportOptions struct {
+	Format TextFormat
+	// ForcedOnly only writes the forced subtitles
+	ForcedOnly bool
+	// MinConfidence is the confidence (0 to 1) under which cues are reported, TextDefaultMinConfidence if zero
+	// (a negative value disables the reports). Subtitles without OCR result (text set by the caller) are trusted.
+	MinConfidence float64
+	// NoPosition disables the top position hints, written for subtitles displayed in the upper half of the video
+	// ({\an8} for SRT and ASS, line:0 for WebVTT)
+	NoPosition bool
+}
+
+// LowConfidenceCue is a written cue whose text may be wrong
+type LowConfidenceCue struct {
+	Number     int // number of the cue within the written file, starting at 1
+	Start      time.Duration
+	Stop       time.Duration
+	Text       string
+	Confidence float64
+}
+
+// String implements the fmt.Stringer interface.
+// It returns a string that represents the value of the receiver in a form suitable for printing.
+// See https://pkg.go.dev/fmt#Stringer
+func (lcc LowConfidenceCue) String() string {
+	return fmt.Sprintf("#%d %s --> %s (confidence %.0f%%)\n%s",
+		lcc.Number, formatSRTTimestamp(lcc.Start), formatSRTTimestamp(lcc.Stop), lcc.Confidence*100, lcc.Text)
+}
+
+// WriteTextFile writes the subtitles of a stream as a text subtitles file. Low confidence cues, if any,
+// are reported within a sidecar file named after file with the ".low-confidence.txt" suffix.
+func WriteTextFile(file string, subtitles []Subtitle, opts TextExportOptions) (lowConfidence []LowConfidenceCue, err error) {
+	fd, err := os.Create(file)
+	if err != nil {
+		err = fmt.Errorf("failed to create file: %w", err)
+		return
+	}
+	defer fd.Close()
+	if lowConfidence, err = WriteText(fd, subtitles, opts); err != nil {
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close file: %w", err)
+		return
+	}
+	if len(lowConfidence) == 0 {
+		return
+	}
+	report, err := os.Create(strings.TrimSuffix(file, filepath.Ext(file)) + textReportSuffix)
+	if err != nil {
+		err = fmt.Errorf("failed to create low confidence report file: %w", err)
+		return
+	}
+	defer report.Close()
+	if err = WriteLowConfidenceReport(report, lowConfidence); err != nil {
+		err = fmt.Errorf("failed to write low confidence report: %w", err)
+	}
+	return
+}
+
+// WriteText writes the subtitles of a stream (in presentation order) as text subtitles.
+// Subtitles without text are skipped and reported with a 0 confidence. It returns the cues with a low confidence.
+func WriteText(writer io.Writer, subtitles []Subtitle, opts TextExportOptions) (lowConfidence []LowConfidenceCue, err error) {
+	buffer := bufio.NewWriter(writer)
+	switch opts.Format {
+	case TextFormatSRT:
+	case TextFormatWebVTT:
+		buffer.WriteString("WEBVTT\n\n")
+	case TextFormatASS:
+		writeASSHeader(buffer, subtitles)
+	default:
+		err = fmt.Errorf("unknown text format: %d", opts.Format)
+		return
+	}
+	minConfidence := opts.MinConfidence
+	if minConfidence == 0 {
+		minConfidence = TextDefaultMinConfidence
+	}
+	number := 0
+	for _, sub := range subtitles {
+		if opts.ForcedOnly && !sub.Forced {
+			continue
+		}
+		confidence := 1.0
+		if sub.OCR != nil {
+			confidence = sub.OCR.Confidence
+		}
+		text := strings.TrimSpace(sub.Text)
+		if text == "" {
+			lowConfidence = append(lowConfidence, LowConfidenceCue{Start: sub.Start, Stop: sub.Stop})
+			continue
+		}
+		number++
+		if confidence < minConfidence {
+			lowConfidence = append(lowConfidence, LowConfidenceCue{
+				Number:     number,
+				Start:      sub.Start,
+				Stop:       sub.Stop,
+				Text:       text,
+				Confidence: confidence,
+			})
+		}
+		top := !opts.NoPosition && isTopPlaced(sub.Placement)
+		switch opts.Format {
+		case TextFormatSRT:
+			if top {
+				text = `{\an8}` + text
+			}
+			fmt.Fprintf(buffer, "%d\n%s --> %s\n%s\n\n", number, formatSRTTimestamp(sub.Start), formatSRTTimestamp(sub.Stop), text)
+		case TextFormatWebVTT:
+			settings := ""
+			if top {
+				settings = " line:0"
+			}
+			text = textVTTEscaper.Replace(text)
+			if sub.Forced {
+				text = "<c.forced>" + text + "</c>"
+			}
+			fmt.Fprintf(buffer, "%d\n%s --> %s%s\n%s\n\n", number, formatVTTTimestamp(sub.Start), formatVTTTimestamp(sub.Stop), settings, text)
+		case TextFormatASS:
+			style := textASSStyle
+			if sub.Forced {
+				style = textASSForcedStyle
+			}
+			text = textASSEscaper.Replace(text)
+			if top {
+				text = `{\an8}` + text
+			}
+			fmt.Fprintf(buffer, "Dialogue: 0,%s,%s,%s,,0,0,0,,%s\n", formatASSTimestamp(sub.Start), formatASSTimestamp(sub.Stop), style, text)
+		}
+	}
+	if err = buffer.Flush(); err != nil {
+		err = fmt.Errorf("failed to write subtitles: %w", err)
+	}
+	return
+}
+
+// WriteLowConfidenceReport writes the low confidence cues as a human readable report.
+func WriteLowConfidenceReport(writer io.Writer, lowConfidence []LowConfidenceCue) (err error) {
+	buffer := bufio.NewWriter(writer)
+	for _, cue := range lowConfidence {
+		if cue.Number == 0 {
+			fmt.Fprintf(buffer, "not written: %s --> %s (no text)\n\n", formatSRTTimestamp(cue.Start), formatSRTTimestamp(cue.Stop))
+			continue
+		}
+		fmt.Fprintf(buffer, "%s\n\n", cue)
+	}
+	return buffer.Flush()
+}
+
+// isTopPlaced returns true if the subtitle is displayed within the upper half of the video
+func isTopPlaced(placement Placement) bool {
+	if placement.Canvas.Empty() || placement.Area.Empty() {
+		return false
+	}
+	return placement.Area.Min.Y+placement.Area.Max.Y < placement.Canvas.Min.Y+placement.Canvas.Max.Y
+}
+
+func writeASSHeader(buffer *bufio.Writer, subtitles []Subtitle) {
+	// Use the video size as script resolution
+	width, height := 0, 0
+	for _, sub := range subtitles {
+		if !sub.Placement.Canvas.Empty() {
+			width, height = sub.Placement.Canvas.Dx(), sub.Placement.Canvas.Dy()
+			break
+		}
+	}
+	buffer.WriteString("[Script Info]\nScriptType: v4.00+\nWrapStyle: 0\nScaledBorderAndShadow: yes\n")
+	if width > 0 {
+		fmt.Fprintf(buffer, "PlayResX: %d\nPlayResY: %d\n", width, height)
+	}
+	fontSize := max(16, height/14)
+	buffer.WriteString("\n[V4+ Styles]\n")
+	buffer.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	for _, style := range []string{textASSStyle, textASSForcedStyle} {
+		fmt.Fprintf(buffer, "Style: %s,Arial,%d,&H00FFFFFF,&H000000FF,&H00000000,&H00000000,0,0,0,0,100,100,0,0,1,2,0,2,10,10,10,1\n", style, fontSize)
+	}
+	buffer.WriteString("\n[Events]\nFormat: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+}
+
+// formatSRTTimestamp formats a timestamp as hh:mm:ss,mmm
+func formatSRTTimestamp(timestamp time.Duration) string {
+	return formatTimestamp(timestamp, 2, ',', 3)
+}
+
+// formatVTTTimestamp formats a timestamp as hh:mm:ss.mmm
+func formatVTTTimestamp(timestamp time.Duration) string {
+	return formatTimestamp(timestamp, 2, '.', 3)
+}
+
+// formatASSTimestamp formats a timestamp as h:mm:ss.cc
+func formatASSTimestamp(timestamp time.Duration) string {
+	return formatTimestamp(timestamp, 1, '.', 2)
+}
@@ -0,0 +1,64 @@
+package vobsub
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTextWebVTT(t *testing.T) {
+	subtitles := []Subtitle{
+		{Start: time.Second, Stop: 2 * time.Second, Text: "<i>Tom & Jerry</i> <3 --> fin", OCR: &OCRResult{Confidence: 0.95}},
+		{Start: 3 * time.Second, Stop: 4 * time.Second, Text: "Hello", OCR: &OCRResult{Confidence: 0.5}},
+	}
+	var output strings.Builder
+	lowConfidence, err := WriteText(&output, subtitles, TextExportOptions{Format: TextFormatWebVTT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "WEBVTT\n\n" +
+		"1\n00:00:01.000 --> 00:00:02.000\n<i>Tom &amp; Jerry</i> &lt;3 --&gt; fin\n\n" +
+		"2\n00:00:03.000 --> 00:00:04.000\nHello\n\n"
+	if output.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", output.String(), expected)
+	}
+	// the default minimum confidence applies when none is set
+	if len(lowConfidence) != 1 || lowConfidence[0].Number != 2 {
+		t.Errorf("unexpected low confidence cues: %v", lowConfidence)
+	}
+}
+
+func TestWriteTextASS(t *testing.T) {
+	subtitles := []Subtitle{
+		{Start: time.Second, Stop: 2 * time.Second, Text: "<i>{\\an8}</i> C:\\Temp\nfin", Forced: true},
+	}
+	var output strings.Builder
+	if _, err := WriteText(&output, subtitles, TextExportOptions{Format: TextFormatASS}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `Dialogue: 0,0:00:01.00,0:00:02.00,Forced,,0,0,0,,{\i1}\{\\an8\}{\i0} C:\\Temp\Nfin` + "\n"
+	if !strings.HasSuffix(output.String(), expected) {
+		t.Errorf("unexpected output:\n%s\nexpected to end with:\n%s", output.String(), expected)
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	timestamp := 1*time.Hour + 2*time.Minute + 3*time.Second + 456789*time.Microsecond
+	for _, test := range []struct {
+		format   func(time.Duration) string
+		expected string
+	}{
+		{formatIdxTimestamp, "01:02:03:456"},
+		{formatSpumuxTimestamp, "01:02:03.45"},
+		{formatSRTTimestamp, "01:02:03,456"},
+		{formatVTTTimestamp, "01:02:03.456"},
+		{formatASSTimestamp, "1:02:03.45"},
+	} {
+		if formatted := test.format(timestamp); formatted != test.expected {
+			t.Errorf("got %q, expected %q", formatted, test.expected)
+		}
+	}
+	if formatted := formatSRTTimestamp(-time.Second); formatted != "00:00:00,000" {
+		t.Errorf("got %q for a negative timestamp, expected 00:00:00,000", formatted)
+	}
+}
@@ -1,17 +1,52 @@
 package vobsub
 
 import (
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DecodeOptions allows to fine tune the decoding of a sub file
+type DecodeOptions struct {
+	RenderOptions
+	// States yields a subtitle for each display state of each SPU (color changes, blinking, etc...) instead of
+	// a single subtitle per SPU using its last display state. See SubtitleRaw.DecodeStates().
+	States bool
+	// ForcedOnly only keeps forced subtitles. The idx "forced subs" flag is not applied automatically: read it with
+	// ReadIdxFile() (IdxMetadata.ForcedSubs) to decide.
+	ForcedOnly bool
+	// OCR optionally recognizes the text of each subtitle image (see Subtitle.Text)
+	OCR Recognizer
+	// Workers is the number of subtitles images rendered concurrently. 0 or 1 renders them sequentially.
+	// Results (order within each stream and returned error) do not depend on it.
+	Workers int
+}
+
 // Decode reads a sub file and its associated idx file to extract and generate its embedded subtitles images.
 // As .sub files can contains multilples streams, the returned map contains all streams with their ID as key.
 // Most of sub files only contains one stream (ID 0).
+// Streams whose payloads are scrambled (CSS) are skipped and reported within skippedBadSub by a *ScrambledError each.
+// If all streams are scrambled, they are returned as the error instead.
+// Subtitles extending beyond the video are reported by their Placement (see Placement.Clipped()).
+// Images cover the SPU display area with both its corners included (see SubtitleRaw.Decode()).
 func Decode(subFile string, fullSizeImages bool) (subtitles map[int][]Subtitle, skippedBadSub []error, err error) {
+	return DecodeWithOptions(subFile, DecodeOptions{
+		RenderOptions: RenderOptions{
+			FullSize: fullSizeImages,
+		},
+	})
+}
+
+// DecodeWithOptions works as Decode() but allows to fine tune the decoding with opts.
+func DecodeWithOptions(subFile string, opts DecodeOptions) (subtitles map[int][]Subtitle, skippedBadSub []error, err error) {
 	// Verify and prepare files path
 	extension := filepath.Ext(subFile)
 	if extension != ".sub" {
@@ -31,57 +66,58 @@ func Decode(subFile string, fullSizeImages bool) (subtitles map[int][]Subtitle,
 		err = fmt.Errorf("failed to read .sub file: %w", err)
 		return
 	}
+	// Scrambled payloads can not be decoded, skip their streams before they fail with garbage data
+	if privateStream1Packets, skippedBadSub = skipScrambled(privateStream1Packets); len(privateStream1Packets) == 0 && len(skippedBadSub) > 0 {
+		err = errors.Join(skippedBadSub...)
+		return
+	}
 	// Concat splitted packets
-	subtitlesPackets := make([]PESPacket, 0, len(privateStream1Packets))
-	for _, pkt := range privateStream1Packets {
-		if pkt.Header.Extension.Data.ComputePTS() != 0 {
-			// New subtitle
-			subtitlesPackets = append(subtitlesPackets, pkt)
-		} else {
-			// Subtitle has been split in multiples packets, concat to current sub
-			currentSub := subtitlesPackets[len(subtitlesPackets)-1]
-			currentSub.Payload = append(currentSub.Payload, pkt.Payload...)
-			subtitlesPackets[len(subtitlesPackets)-1] = currentSub
-		}
+	subtitlesPackets, err := reassemblePackets(privateStream1Packets)
+	if err != nil {
+		err = fmt.Errorf("failed to reassemble subtitles packets: %w", err)
+		return
 	}
-	// Decode raw subtitles to final subtitles
-	subtitles = make(map[int][]Subtitle, 1)
-	var (
-		rawSub     SubtitleRaw
-		pts        time.Duration
-		streamSubs []Subtitle
-		found      bool
-		startDelay time.Duration
-		stopDelay  time.Duration
-		subImg     image.Image
-	)
+	// Extract raw subtitles from packets
+	jobs := make([]decodeJob, 0, len(subtitlesPackets))
 	for index, subPkt := range subtitlesPackets {
-		// Recover the current stream subs slice
-		if streamSubs, found = subtitles[subPkt.Header.SubStreamID.SubtitleID()]; !found {
-			streamSubs = make([]Subtitle, 0, len(subtitlesPackets))
+		job := decodeJob{
+			subtitleID: subPkt.Header.SubStreamID.SubtitleID(),
+			pts:        subPkt.Header.Extension.Data.ComputePTS(),
 		}
-		// Extract raw subtitle from packet
-		if rawSub, err = subPkt.ExtractSubtitle(); err != nil {
+		if job.rawSub, err = subPkt.ExtractSubtitle(); err != nil {
 			// Encountered some bad packets in the wild: discarding them
 			// I compared with Subtitle Edit nothing was missing, it seems SE did skip them too
 			skippedBadSub = append(skippedBadSub, fmt.Errorf("packet #%d: %w", index+1, err))
 			err = nil
 			continue
 		}
-		// Generate the image
-		if subImg, startDelay, stopDelay, err = rawSub.Decode(metadata, fullSizeImages); err != nil {
-			err = fmt.Errorf("failed to decode subtitle: %w", err)
-			return
+		// Skip non forced subtitles if requested
+		if opts.ForcedOnly && !job.rawSub.Forced() {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	// Generate the image(s)
+	if err = runDecodeJobs(jobs, metadata, opts); err != nil {
+		return
+	}
+	// Create the final subtitles, in packets order
+	subtitles = make(map[int][]Subtitle, 1)
+	for _, job := range jobs {
+		for index, state := range job.states {
+			sub := Subtitle{
+				Start:     metadata.TimeOffset + job.pts + state.StartDelay,
+				Stop:      metadata.TimeOffset + job.pts + state.StopDelay,
+				Forced:    state.Forced,
+				Image:     state.Image,
+				Placement: state.Placement,
+			}
+			if job.texts != nil {
+				sub.OCR = job.texts[index]
+				sub.Text = sub.OCR.Text
+			}
+			subtitles[job.subtitleID] = append(subtitles[job.subtitleID], sub)
 		}
-		// Create the final subtitle
-		pts = subPkt.Header.Extension.Data.ComputePTS()
-		streamSubs = append(streamSubs, Subtitle{
-			Start: metadata.TimeOffset + pts + startDelay,
-			Stop:  metadata.TimeOffset + pts + stopDelay,
-			Image: subImg,
-		})
-		// Save the slice with the new sub batch to its stream
-		subtitles[subPkt.Header.SubStreamID.SubtitleID()] = streamSubs
 	}
 	// Security check: some (rare) subtitles do not have stopDate, resulting in a stopDelay at 0 and so a 0 duration
 	// To fix this we will be using the next subtitle start date and remove 100 milliseconds to compute a stop value
@@ -89,7 +125,7 @@ func Decode(subFile string, fullSizeImages bool) (subtitles map[int][]Subtitle,
 	for _, streamSubs := range subtitles {
 		for index, sub := range streamSubs {
 			if sub.Start == sub.Stop {
-				if index+1 < len(subtitles) {
+				if index+1 < len(streamSubs) {
 					potentialStop := streamSubs[index+1].Start - 100*time.Millisecond
 					if potentialStop > sub.Start {
 						sub.Stop = potentialStop
@@ -102,6 +138,93 @@ func Decode(subFile string, fullSizeImages bool) (subtitles map[int][]Subtitle,
 	return
 }
 
+type decodeJob struct {
+	subtitleID int
+	pts        time.Duration
+	rawSub     SubtitleRaw
+	// results
+	states []SubtitleState
+	texts  []*OCRResult // for each state if OCR is requested
+	err    error
+}
+
+// runDecodeJobs renders the jobs states using opts.Workers goroutines.
+// The returned error is the one of the first failed job (in jobs order), regardless of the number of workers.
+func runDecodeJobs(jobs []decodeJob, metadata IdxMetadata, opts DecodeOptions) error {
+	var (
+		next   atomic.Int64 // index of the next job to pick
+		failed atomic.Bool  // stop picking new jobs once one has failed
+		wg     sync.WaitGroup
+	)
+	worker := func() {
+		defer wg.Done()
+		for !failed.Load() {
+			index := int(next.Add(1) - 1)
+			if index >= len(jobs) {
+				return
+			}
+			job := &jobs[index]
+			if job.states, job.err = decodeStates(job.rawSub, metadata, opts); job.err == nil && opts.OCR != nil {
+				job.texts, job.err = recognizeStates(job.states, opts.OCR)
+			}
+			if job.err != nil {
+				failed.Store(true)
+			}
+		}
+	}
+	// Jobs are picked in order: when a job fails, all the previous ones have been picked and will complete
+	workers := max(1, min(opts.Workers, len(jobs)))
+	wg.Add(workers)
+	for range workers - 1 {
+		go worker()
+	}
+	worker()
+	wg.Wait()
+	for _, job := range jobs {
+		if job.err != nil {
+			return fmt.Errorf("failed to decode subtitle: %w", job.err)
+		}
+	}
+	return nil
+}
+
+// recognizeStates recognizes the text of each state (states sharing the same image are recognized once)
+func recognizeStates(states []SubtitleState, ocr Recognizer) (texts []*OCRResult, err error) {
+	texts = make([]*OCRResult, len(states))
+	recognized := make(map[image.Image]*OCRResult, len(states))
+	for index, state := range states {
+		result, found := recognized[state.Image]
+		if !found {
+			result = new(OCRResult)
+			if *result, err = ocr.Recognize(state.Image); err != nil {
+				err = fmt.Errorf("failed to recognize text: %w", err)
+				return
+			}
+			recognized[state.Image] = result
+		}
+		texts[index] = result
+	}
+	return
+}
+
+// decodeStates decodes the raw subtitle either as a single state or as all its display states depending on opts
+func decodeStates(rawSub SubtitleRaw, metadata IdxMetadata, opts DecodeOptions) (states []SubtitleState, err error) {
+	if opts.States {
+		return rawSub.DecodeStates(metadata, opts.RenderOptions)
+	}
+	state := SubtitleState{
+		Forced: rawSub.Forced(),
+	}
+	if state.Image, state.StartDelay, state.StopDelay, err = rawSub.DecodeWithOptions(metadata, opts.RenderOptions); err != nil {
+		return
+	}
+	if state.Placement, err = rawSub.Placement(metadata, opts.RenderOptions); err != nil {
+		return
+	}
+	states = []SubtitleState{state}
+	return
+}
+
 // ReadIdxFile reads the idx file and returns its metadata.
 func ReadIdxFile(Idxfile string) (metadata IdxMetadata, err error) {
 	// Open the binary sub file
@@ -144,3 +267,303 @@ func ReadSubFile(subFile string) (privateStream1Packets []PESPacket, err error)
 	}
 	return
 }
+
+// WriteForcedOnly reads a sub file and its associated idx file and writes a new sub/idx pair at forcedSubFile
+// containing only the forced subtitles ("foreign parts only" track). Subtitles are copied as is, without being re-encoded.
+// Scrambled streams and bad packets are skipped and reported within skippedBadSub as Decode() does.
+// It returns the number of forced subtitles written.
+func WriteForcedOnly(subFile, forcedSubFile string) (nbForced int, skippedBadSub []error, err error) {
+	// Verify and prepare files path
+	extension := filepath.Ext(subFile)
+	if extension != ".sub" {
+		err = fmt.Errorf("expected .sub file extension: got %q", extension)
+		return
+	}
+	forcedExtension := filepath.Ext(forcedSubFile)
+	if forcedExtension != ".sub" {
+		err = fmt.Errorf("expected .sub file extension for the forced subtitles file: got %q", forcedExtension)
+		return
+	}
+	// Read source
+	metadata, err := ReadIdxFile(subFile[:len(subFile)-len(extension)] + ".idx")
+	if err != nil {
+		err = fmt.Errorf("failed to read .idx file: %w", err)
+		return
+	}
+	privateStream1Packets, err := ReadSubFile(subFile)
+	if err != nil {
+		err = fmt.Errorf("failed to read .sub file: %w", err)
+		return
+	}
+	if privateStream1Packets, skippedBadSub = skipScrambled(privateStream1Packets); len(privateStream1Packets) == 0 && len(skippedBadSub) > 0 {
+		err = errors.Join(skippedBadSub...)
+		return
+	}
+	subtitlesPackets, err := reassemblePackets(privateStream1Packets)
+	if err != nil {
+		err = fmt.Errorf("failed to reassemble subtitles packets: %w", err)
+		return
+	}
+	// Write the forced subtitles
+	fd, err := os.Create(forcedSubFile)
+	if err != nil {
+		err = fmt.Errorf("failed to create forced .sub file: %w", err)
+		return
+	}
+	defer fd.Close()
+	writer := NewSubWriter(fd)
+	var (
+		streams = make(map[int]*IdxStream, 1)
+		rawSub  SubtitleRaw
+		pts     time.Duration
+		filepos int64
+	)
+	for index, subPkt := range subtitlesPackets {
+		if rawSub, err = subPkt.ExtractSubtitle(); err != nil {
+			// bad packets are skipped, just like Decode() does
+			skippedBadSub = append(skippedBadSub, fmt.Errorf("packet #%d: %w", index+1, err))
+			err = nil
+			continue
+		}
+		if !rawSub.Forced() {
+			continue
+		}
+		streamID := subPkt.Header.SubStreamID.SubtitleID()
+		pts = subPkt.Header.Extension.Data.ComputePTS()
+		if filepos, err = writer.WriteSubtitle(streamID, pts, subPkt.Payload); err != nil {
+			err = fmt.Errorf("failed to write forced subtitle: %w", err)
+			return
+		}
+		stream, found := streams[streamID]
+		if !found {
+			stream = &IdxStream{
+				Language: metadata.Languages[streamID],
+				ID:       streamID,
+			}
+			streams[streamID] = stream
+		}
+		stream.Entries = append(stream.Entries, IdxEntry{
+			Timestamp: pts,
+			FilePos:   filepos,
+		})
+		nbForced++
+	}
+	if err = writer.Close(); err != nil {
+		err = fmt.Errorf("failed to close forced .sub file: %w", err)
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close forced .sub file: %w", err)
+		return
+	}
+	// Write the matching idx
+	idxStreams := make([]IdxStream, 0, len(streams))
+	for _, streamID := range slices.Sorted(maps.Keys(streams)) {
+		idxStreams = append(idxStreams, *streams[streamID])
+	}
+	metadata.ForcedSubs = true
+	idxFd, err := os.Create(forcedSubFile[:len(forcedSubFile)-len(forcedExtension)] + ".idx")
+	if err != nil {
+		err = fmt.Errorf("failed to create forced .idx file: %w", err)
+		return
+	}
+	defer idxFd.Close()
+	if err = WriteIdx(idxFd, metadata, idxStreams); err != nil {
+		err = fmt.Errorf("failed to write forced .idx file: %w", err)
+		return
+	}
+	if err = idxFd.Close(); err != nil {
+		err = fmt.Errorf("failed to close forced .idx file: %w", err)
+	}
+	return
+}
+
+// EncodeOptions allows to fine tune the encoding of subtitles images into a sub file
+type EncodeOptions struct {
+	// StreamID is the ID of the written subtitles stream (0 to 31)
+	StreamID int
+	// Language is the 2 letters language code of the stream ("en" if empty)
+	Language string
+	// Palette optionally sets the 16 colors of the idx palette. Otherwise it is computed from the subtitles colors.
+	Palette color.Palette
+	// Scale optionally scales the subtitles from their canvas to another video frame, for example to 720x576 to convert
+	// HD subtitles for a PAL DVD
+	Scale *ScaleOptions
+}
+
+// Encode writes subtitles images as a new sub/idx pair at subFile (the .idx file is written next to it).
+// Subtitles must share the same canvas, which becomes the idx video size (unless scaled), and are placed using their
+// Placement. Each image is reduced to the 4 colors of a SPU: a transparent background and the 3 colors (with alpha
+// levels) of the 16 colors palette best matching its pixels. Subtitles without stop time (Stop equals Start) get none.
+func Encode(subFile string, subtitles []Subtitle, opts EncodeOptions) (err error) {
+	// Verify and prepare files path
+	extension := filepath.Ext(subFile)
+	if extension != ".sub" {
+		err = fmt.Errorf("expected .sub file extension: got %q", extension)
+		return
+	}
+	if opts.StreamID < 0 || opts.StreamID > subStreamIDMaxValue {
+		err = fmt.Errorf("invalid stream ID: %d (0 to %d)", opts.StreamID, subStreamIDMaxValue)
+		return
+	}
+	if opts.Palette != nil && len(opts.Palette) != idxPaletteLen {
+		err = fmt.Errorf("palette should have %d colors, currently %d", idxPaletteLen, len(opts.Palette))
+		return
+	}
+	// Place the images on the video frame
+	canvas, err := commonCanvas(subtitles)
+	if err != nil {
+		return
+	}
+	var scaler *Scaler
+	if opts.Scale != nil {
+		if scaler, err = NewScaler(canvas.Size(), *opts.Scale); err != nil {
+			err = fmt.Errorf("invalid scale options: %w", err)
+			return
+		}
+		canvas = scaler.target
+	}
+	ordered := sortedByStart(subtitles)
+	images := make([]image.Image, len(ordered))
+	for index, sub := range ordered {
+		if images[index], err = placedImage(sub, scaler); err != nil {
+			err = fmt.Errorf("failed to place subtitle #%d: %w", index+1, err)
+			return
+		}
+	}
+	palette := opts.Palette
+	if palette == nil {
+		palette = buildPalette(images, idxPaletteLen)
+	}
+	// Write the subtitles
+	fd, err := os.Create(subFile)
+	if err != nil {
+		err = fmt.Errorf("failed to create .sub file: %w", err)
+		return
+	}
+	defer fd.Close()
+	writer := NewSubWriter(fd)
+	stream := IdxStream{
+		Language: opts.Language,
+		ID:       opts.StreamID,
+	}
+	if stream.Language == "" {
+		stream.Language = "en"
+	}
+	var (
+		spu     []byte
+		filepos int64
+	)
+	for index, sub := range ordered {
+		if images[index].Bounds().Empty() {
+			continue // nothing visible
+		}
+		params := chooseSlots(images[index], palette)
+		params.Forced = sub.Forced
+		if sub.Stop > sub.Start {
+			params.StopDelay = sub.Stop - sub.Start
+		}
+		if spu, err = EncodeSubtitle(images[index], palette, params); err != nil {
+			err = fmt.Errorf("failed to encode subtitle #%d: %w", index+1, err)
+			return
+		}
+		if filepos, err = writer.WriteSubtitle(opts.StreamID, sub.Start, spu); err != nil {
+			err = fmt.Errorf("failed to write subtitle #%d: %w", index+1, err)
+			return
+		}
+		stream.Entries = append(stream.Entries, IdxEntry{
+			Timestamp: sub.Start,
+			FilePos:   filepos,
+		})
+	}
+	if err = writer.Close(); err != nil {
+		err = fmt.Errorf("failed to close .sub file: %w", err)
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close .sub file: %w", err)
+		return
+	}
+	// Write the matching idx
+	idxFd, err := os.Create(subFile[:len(subFile)-len(extension)] + ".idx")
+	if err != nil {
+		err = fmt.Errorf("failed to create .idx file: %w", err)
+		return
+	}
+	defer idxFd.Close()
+	metadata := IdxMetadata{
+		Width:      canvas.Dx(),
+		Height:     canvas.Dy(),
+		AlphaRatio: 1,
+		Palette:    palette,
+	}
+	if err = WriteIdx(idxFd, metadata, []IdxStream{stream}); err != nil {
+		err = fmt.Errorf("failed to write .idx file: %w", err)
+		return
+	}
+	if err = idxFd.Close(); err != nil {
+		err = fmt.Errorf("failed to close .idx file: %w", err)
+	}
+	return
+}
+
+// reassemblePackets concats the packets of subtitles split across several packets. Each returned packet contains a whole subtitle.
+// Only the first packet of a subtitle carries a PTS (which can be 0): the following ones are appended to the current subtitle of their stream.
+func reassemblePackets(privateStream1Packets []PESPacket) (subtitlesPackets []PESPacket, err error) {
+	subtitlesPackets = make([]PESPacket, 0, len(privateStream1Packets))
+	current := make(map[int]int, 1) // index of the current subtitle of each stream
+	for index, pkt := range privateStream1Packets {
+		streamID := pkt.Header.SubStreamID.SubtitleID()
+		if pkt.HasPTS() {
+			// New subtitle
+			current[streamID] = len(subtitlesPackets)
+			subtitlesPackets = append(subtitlesPackets, pkt)
+			continue
+		}
+		// Subtitle has been split in multiples packets, concat to current sub
+		subIndex, found := current[streamID]
+		if !found {
+			err = fmt.Errorf("packet #%d of stream #%d continues a subtitle but no subtitle has been started", index+1, streamID)
+			return
+		}
+		currentSub := subtitlesPackets[subIndex]
+		currentSub.Payload = append(currentSub.Payload, pkt.Payload...)
+		subtitlesPackets[subIndex] = currentSub
+	}
+	return
+}
+
+// skipScrambled removes the packets of the streams having scrambled packets and returns a *ScrambledError for each of
+// these streams, by stream ID
+func skipScrambled(privateStream1Packets []PESPacket) (cleanPackets []PESPacket, scrambled []error) {
+	scrambledStreams := make(map[int]*ScrambledError)
+	for _, pkt := range privateStream1Packets {
+		if !pkt.Scrambled() {
+			continue
+		}
+		streamID := pkt.Header.SubStreamID.SubtitleID()
+		scrambledErr, found := scrambledStreams[streamID]
+		if !found {
+			scrambledErr = &ScrambledError{
+				SubtitleID: streamID,
+				Control:    pkt.ScramblingControl(),
+			}
+			scrambledStreams[streamID] = scrambledErr
+		}
+		scrambledErr.Packets++
+	}
+	if len(scrambledStreams) == 0 {
+		return privateStream1Packets, nil
+	}
+	cleanPackets = make([]PESPacket, 0, len(privateStream1Packets))
+	for _, pkt := range privateStream1Packets {
+		if _, found := scrambledStreams[pkt.Header.SubStreamID.SubtitleID()]; !found {
+			cleanPackets = append(cleanPackets, pkt)
+		}
+	}
+	scrambled = make([]error, 0, len(scrambledStreams))
+	for _, streamID := range slices.Sorted(maps.Keys(scrambledStreams)) {
+		scrambled = append(scrambled, scrambledStreams[streamID])
+	}
+	return
+}
@@ -0,0 +1,244 @@
+package vobsub
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	// Small image and large image (split across several packs)
+	small := testSubtitleImage(image.Rect(100, 480, 300, 510), 4)
+	large := testSubtitleImage(image.Rect(0, 400, 720, 500), 1)
+	subtitles := []Subtitle{
+		{Start: 0, Stop: 2 * time.Second, Image: large, Placement: Placement{Area: large.Rect, Canvas: canvas}},
+		{Start: 3 * time.Second, Stop: 4500 * time.Millisecond, Forced: true, Image: small, Placement: Placement{Area: small.Rect, Canvas: canvas}},
+		{Start: 5 * time.Second, Stop: 6 * time.Second, Image: small, Placement: Placement{Area: small.Rect, Canvas: canvas}},
+	}
+	subFile := filepath.Join(t.TempDir(), "roundtrip.sub")
+	if err := Encode(subFile, subtitles, EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, skipped, err := Decode(subFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		t.Fatalf("unexpected skipped subtitles: %v", skipped)
+	}
+	stream := decoded[0]
+	if len(decoded) != 1 || len(stream) != len(subtitles) {
+		t.Fatalf("expected 1 stream of %d subtitles, got %d streams and %d subtitles", len(subtitles), len(decoded), len(stream))
+	}
+	for index, sub := range stream {
+		expected := subtitles[index]
+		if sub.Start != expected.Start || sub.Stop != expected.Stop || sub.Forced != expected.Forced {
+			t.Errorf("subtitle #%d: expected %s --> %s (forced %v), got %s --> %s (forced %v)", index+1,
+				expected.Start, expected.Stop, expected.Forced, sub.Start, sub.Stop, sub.Forced)
+		}
+		if sub.Placement.Area != expected.Placement.Area {
+			t.Errorf("subtitle #%d: expected area %v, got %v", index+1, expected.Placement.Area, sub.Placement.Area)
+		}
+	}
+}
+
+func TestDecodeMissingStop(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	img := testSubtitleImage(image.Rect(100, 480, 300, 510), 4)
+	placement := Placement{Area: img.Rect, Canvas: canvas}
+	// Subtitles without stop time (Stop equals Start) are encoded without stop date
+	subtitles := []Subtitle{
+		{Start: time.Second, Stop: time.Second, Image: img, Placement: placement},
+		{Start: 4 * time.Second, Stop: 4 * time.Second, Image: img, Placement: placement},
+		{Start: 4050 * time.Millisecond, Stop: 5 * time.Second, Image: img, Placement: placement},
+		{Start: 7 * time.Second, Stop: 7 * time.Second, Image: img, Placement: placement},
+	}
+	subFile := filepath.Join(t.TempDir(), "nostop.sub")
+	if err := Encode(subFile, subtitles, EncodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := Decode(subFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop 100ms before the next subtitle, unless too close or last one
+	expectedStops := []time.Duration{3900 * time.Millisecond, 4 * time.Second, 5 * time.Second, 7 * time.Second}
+	if len(decoded[0]) != len(expectedStops) {
+		t.Fatalf("expected %d subtitles, got %d", len(expectedStops), len(decoded[0]))
+	}
+	for index, sub := range decoded[0] {
+		if sub.Stop != expectedStops[index] {
+			t.Errorf("subtitle #%d: expected stop %s, got %s", index+1, expectedStops[index], sub.Stop)
+		}
+	}
+}
+
+func TestDecodeSplitPackets(t *testing.T) {
+	// A large subtitle at PTS 0 (split across several packs) and a small one
+	large := testSPUImage(image.Rect(0, 400, 720, 420))
+	subFile := filepath.Join(t.TempDir(), "split.sub")
+	writeTestSub(t, subFile, testMetadata(testPalette()),
+		testSPU{img: large, stop: 2 * time.Second},
+		testSPU{img: large.SubImage(image.Rect(100, 400, 300, 410)), pts: 3 * time.Second, stop: time.Second},
+	)
+	decoded, skipped, err := Decode(subFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) > 0 {
+		t.Fatalf("unexpected skipped subtitles: %v", skipped)
+	}
+	if len(decoded) != 1 || len(decoded[0]) != 2 {
+		t.Fatalf("expected 1 stream of 2 subtitles, got %d streams and %d subtitles", len(decoded), len(decoded[0]))
+	}
+	for index, expected := range [][2]time.Duration{{0, 2 * time.Second}, {3 * time.Second, 4 * time.Second}} {
+		if sub := decoded[0][index]; sub.Start != expected[0] || sub.Stop != expected[1] {
+			t.Errorf("subtitle #%d: expected %s --> %s, got %s --> %s", index+1, expected[0], expected[1], sub.Start, sub.Stop)
+		}
+	}
+}
+
+func TestDecodeForcedOnly(t *testing.T) {
+	img := testSPUImage(image.Rect(100, 480, 300, 510))
+	// Mark the idx as forced subs only: decoding must not filter by itself
+	metadata := testMetadata(testPalette())
+	metadata.ForcedSubs = true
+	subFile := filepath.Join(t.TempDir(), "mixed.sub")
+	writeTestSub(t, subFile, metadata,
+		testSPU{img: img, pts: time.Second, stop: time.Second},
+		testSPU{img: img, pts: 3 * time.Second, stop: time.Second, forced: true},
+	)
+	for _, forcedOnly := range []bool{false, true} {
+		decoded, _, err := DecodeWithOptions(subFile, DecodeOptions{ForcedOnly: forcedOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 2
+		if forcedOnly {
+			expected = 1
+		}
+		if len(decoded[0]) != expected {
+			t.Errorf("forced only %v: expected %d subtitles, got %d", forcedOnly, expected, len(decoded[0]))
+		}
+	}
+}
+
+func TestWriteForcedOnly(t *testing.T) {
+	img := testSPUImage(image.Rect(100, 480, 300, 510))
+	dir := t.TempDir()
+	subFile := filepath.Join(dir, "mixed.sub")
+	writeTestSub(t, subFile, testMetadata(testPalette()),
+		testSPU{img: img, pts: time.Second, stop: time.Second},
+		testSPU{img: img, pts: 3 * time.Second, stop: time.Second, forced: true},
+	)
+	// Append a bad subtitle (its size header does not match its length) before the program end code
+	sub, err := os.ReadFile(subFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bad bytes.Buffer
+	if _, err = NewSubWriter(&bad).WriteSubtitle(0, 10*time.Second, []byte{0x00, 0x09, 0x00, 0x04}); err != nil {
+		t.Fatal(err)
+	}
+	sub = append(sub[:len(sub)-4:len(sub)-4], bad.Bytes()...)
+	if err = os.WriteFile(subFile, append(sub, 0x00, 0x00, 0x01, StreamIDProgramEnd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	forcedSubFile := filepath.Join(dir, "forced.sub")
+	nbForced, skipped, err := WriteForcedOnly(subFile, forcedSubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbForced != 1 {
+		t.Errorf("expected 1 forced subtitle, got %d", nbForced)
+	}
+	if len(skipped) != 1 {
+		t.Errorf("expected the bad packet to be reported, got: %v", skipped)
+	}
+	decoded, _, err := Decode(forcedSubFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded[0]) != 1 || !decoded[0][0].Forced || decoded[0][0].Start != 3*time.Second {
+		t.Errorf("unexpected forced track: %v", decoded[0])
+	}
+}
+
+/*
+	Helpers
+*/
+
+// testSPU is a subtitle image to encode at pts, displayed for stop
+type testSPU struct {
+	img       image.Image
+	pts, stop time.Duration
+	forced    bool
+}
+
+// testSubtitleImage returns an image with opaque white stripes of stripe pixels on a transparent background
+func testSubtitleImage(bounds image.Rectangle, stripe int) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if (x/stripe+y)%2 == 0 {
+				img.SetNRGBA(x, y, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+			}
+		}
+	}
+	return img
+}
+
+// testSPUImage returns a paletted image alternating the pattern and first emphasis slots
+func testSPUImage(bounds image.Rectangle) *image.Paletted {
+	img := image.NewPaletted(bounds, color.Palette{color.Transparent, color.White, color.Black})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetColorIndex(x, y, uint8(x%2+1))
+		}
+	}
+	return img
+}
+
+// writeTestSub encodes the subtitles of stream 0 as a sub/idx pair
+func writeTestSub(t *testing.T, subFile string, metadata IdxMetadata, spus ...testSPU) {
+	t.Helper()
+	fd, err := os.Create(subFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	writer := NewSubWriter(fd)
+	stream := IdxStream{Language: "en"}
+	for _, sub := range spus {
+		spu, err := EncodeSubtitle(sub.img, metadata.Palette, EncodeParams{
+			Colors:    [SubtitleColorSlots]uint8{0, 1, 2, 3},
+			Alphas:    [SubtitleColorSlots]uint8{0, 15, 15, 15},
+			StopDelay: sub.stop,
+			Forced:    sub.forced,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		filepos, err := writer.WriteSubtitle(0, sub.pts, spu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Entries = append(stream.Entries, IdxEntry{Timestamp: sub.pts, FilePos: filepos})
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	idxFd, err := os.Create(subFile[:len(subFile)-len(filepath.Ext(subFile))] + ".idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idxFd.Close()
+	if err = WriteIdx(idxFd, metadata, []IdxStream{stream}); err != nil {
+		t.Fatal(err)
+	}
+}
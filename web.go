@@ -0,0 +1,221 @@
+package vobsub
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	webDefaultLanguage = "en"
+	webVTTForcedSuffix = "-forced"
+	webDataURLPrefix   = "data:image/png;base64,"
+	// TTML namespaces and profile
+	ttmlNamespace          = "http://www.w3.org/ns/ttml"
+	ttmlParameterNamespace = "http://www.w3.org/ns/ttml#parameter"
+	ttmlStylingNamespace   = "http://www.w3.org/ns/ttml#styling"
+	ttmlSMPTENamespace     = "http://www.smpte-ra.org/schemas/2052-1/2010/smpte-tt"
+	ttmlIMSCNamespace      = "http://www.w3.org/ns/ttml/profile/imsc1#styling"
+	ttmlIMSCImageProfile   = "http://www.w3.org/ns/ttml/profile/imsc1/image"
+)
+
+// WebExportOptions defines how subtitles images are written as web documents (IMSC1 TTML and WebVTT)
+type WebExportOptions struct {
+	// EmbedImages embeds the PNG images as base64 data within the document instead of writing them next to it
+	// (named after the document and numbered from 1)
+	EmbedImages bool
+	// ForcedOnly only writes the forced subtitles
+	ForcedOnly bool
+	// Language is the BCP 47 language tag of the document ("en" if empty), only used by TTML
+	Language string
+}
+
+// webCue is a subtitle image ready to be referenced by a web document
+type webCue struct {
+	number      int
+	start, stop time.Duration
+	forced      bool
+	rect        image.Rectangle // on the video frame
+	file        string          // image file name, if not embedded
+	data        []byte          // PNG image, if embedded
+}
+
+// prepareWebCues places the images of the subtitles and writes them next to document unless they are embedded
+func prepareWebCues(document string, subtitles []Subtitle, opts WebExportOptions) (cues []webCue, canvas image.Rectangle, err error) {
+	if canvas, err = commonCanvas(subtitles); err != nil {
+		return
+	}
+	// Errors report the subtitles by their index within subtitles
+	var (
+		order   = startOrder(subtitles)
+		ordered = make([]Subtitle, len(order))
+		base    = strings.TrimSuffix(filepath.Base(document), filepath.Ext(document))
+		img     image.Image
+	)
+	for position, index := range order {
+		ordered[position] = subtitles[index]
+	}
+	cues = make([]webCue, 0, len(ordered))
+	for position, sub := range ordered {
+		if opts.ForcedOnly && !sub.Forced {
+			continue
+		}
+		if img, err = placedImage(sub, nil); err != nil {
+			err = fmt.Errorf("failed to place subtitle #%d: %w", order[position]+1, err)
+			return
+		}
+		if img.Bounds().Empty() {
+			continue // nothing visible
+		}
+		cue := webCue{
+			number: len(cues) + 1,
+			start:  sub.Start,
+			stop:   displayStop(ordered, position),
+			forced: sub.Forced,
+			rect:   img.Bounds(),
+		}
+		if opts.EmbedImages {
+			cue.data, err = encodePNG(img)
+		} else {
+			cue.file = numberedImageFile(base, cue.number)
+			err = writePNG(filepath.Join(filepath.Dir(document), cue.file), img)
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to write subtitle #%d image: %w", order[position]+1, err)
+			return
+		}
+		cues = append(cues, cue)
+	}
+	return
+}
+
+// createWebDocument creates the document file and writes it with write
+func createWebDocument(file string, write func(writer *bufio.Writer)) (err error) {
+	fd, err := os.Create(file)
+	if err != nil {
+		err = fmt.Errorf("failed to create file: %w", err)
+		return
+	}
+	defer fd.Close()
+	buffer := bufio.NewWriter(fd)
+	write(buffer)
+	if err = buffer.Flush(); err != nil {
+		err = fmt.Errorf("failed to write file: %w", err)
+		return
+	}
+	if err = fd.Close(); err != nil {
+		err = fmt.Errorf("failed to close file: %w", err)
+	}
+	return
+}
+
+/*
+	IMSC1 TTML
+*/
+
+// WriteIMSC writes the subtitles of a stream as an IMSC1 image profile TTML document at ttmlFile. Each subtitle is a div
+// displaying its PNG image as smpte:backgroundImage within its own region, located at the subtitle position on the video
+// (whose size is the root container extent, omitted without subtitles). Forced subtitles have the itts:forcedDisplay attribute set.
+// Subtitles without stop time are displayed until the next one (5 seconds at most). It returns the number of subtitles written.
+func WriteIMSC(ttmlFile string, subtitles []Subtitle, opts WebExportOptions) (nbCues int, err error) {
+	cues, canvas, err := prepareWebCues(ttmlFile, subtitles, opts)
+	if err != nil {
+		return
+	}
+	language := opts.Language
+	if language == "" {
+		language = webDefaultLanguage
+	}
+	// The root container extent is only required by the pixel lengths of the regions
+	extent := ""
+	if !canvas.Empty() {
+		extent = fmt.Sprintf(` tts:extent="%dpx %dpx"`, canvas.Dx(), canvas.Dy())
+	}
+	err = createWebDocument(ttmlFile, func(buffer *bufio.Writer) {
+		buffer.WriteString(xml.Header)
+		fmt.Fprintf(buffer, `<tt xmlns="%s" xmlns:ttp="%s" xmlns:tts="%s" xmlns:smpte="%s" xmlns:itts="%s" ttp:profile="%s"%s xml:lang="%s">`+"\n",
+			ttmlNamespace, ttmlParameterNamespace, ttmlStylingNamespace, ttmlSMPTENamespace, ttmlIMSCNamespace, ttmlIMSCImageProfile,
+			extent, xmlEscape(language))
+		buffer.WriteString("  <head>\n")
+		if opts.EmbedImages && len(cues) > 0 {
+			buffer.WriteString("    <metadata>\n")
+			for _, cue := range cues {
+				fmt.Fprintf(buffer, `      <smpte:image xml:id="image_%d" imageType="PNG" encoding="Base64">%s</smpte:image>`+"\n",
+					cue.number, base64.StdEncoding.EncodeToString(cue.data))
+			}
+			buffer.WriteString("    </metadata>\n")
+		}
+		buffer.WriteString("    <layout>\n")
+		for _, cue := range cues {
+			fmt.Fprintf(buffer, `      <region xml:id="region_%d" tts:origin="%dpx %dpx" tts:extent="%dpx %dpx"/>`+"\n",
+				cue.number, cue.rect.Min.X, cue.rect.Min.Y, cue.rect.Dx(), cue.rect.Dy())
+		}
+		buffer.WriteString("    </layout>\n")
+		buffer.WriteString("  </head>\n")
+		buffer.WriteString("  <body>\n")
+		for _, cue := range cues {
+			source := fmt.Sprintf("#image_%d", cue.number)
+			if !opts.EmbedImages {
+				source = cue.file
+			}
+			forced := ""
+			if cue.forced {
+				forced = ` itts:forcedDisplay="true"`
+			}
+			// TTML clock times use the same format as WebVTT timestamps
+			fmt.Fprintf(buffer, `    <div region="region_%d" begin="%s" end="%s" smpte:backgroundImage="%s"%s/>`+"\n",
+				cue.number, formatVTTTimestamp(cue.start), formatVTTTimestamp(cue.stop), xmlEscape(source), forced)
+		}
+		buffer.WriteString("  </body>\n")
+		buffer.WriteString("</tt>\n")
+	})
+	return len(cues), err
+}
+
+func xmlEscape(value string) string {
+	var builder strings.Builder
+	xml.EscapeText(&builder, []byte(value))
+	return builder.String()
+}
+
+/*
+	WebVTT
+*/
+
+// WriteImageVTT writes the subtitles of a stream as a WebVTT document at vttFile whose cues payload is the URL of their
+// PNG image (a data URL if the images are embedded). Cue settings place the image at the subtitle position, in percents
+// of the video size. Forced cues identifiers end with "-forced".
+// Subtitles without stop time are displayed until the next one (5 seconds at most). It returns the number of cues written.
+func WriteImageVTT(vttFile string, subtitles []Subtitle, opts WebExportOptions) (nbCues int, err error) {
+	cues, canvas, err := prepareWebCues(vttFile, subtitles, opts)
+	if err != nil {
+		return
+	}
+	percent := func(value, total int) string {
+		return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.2f", float64(value)*100/float64(total)), "0"), ".") + "%"
+	}
+	err = createWebDocument(vttFile, func(buffer *bufio.Writer) {
+		buffer.WriteString("WEBVTT\n\n")
+		for _, cue := range cues {
+			identifier := fmt.Sprint(cue.number)
+			if cue.forced {
+				identifier += webVTTForcedSuffix
+			}
+			source := cue.file
+			if opts.EmbedImages {
+				source = webDataURLPrefix + base64.StdEncoding.EncodeToString(cue.data)
+			}
+			fmt.Fprintf(buffer, "%s\n%s --> %s position:%s,line-left line:%s,start size:%s align:left\n%s\n\n",
+				identifier, formatVTTTimestamp(cue.start), formatVTTTimestamp(cue.stop),
+				percent(cue.rect.Min.X, canvas.Dx()), percent(cue.rect.Min.Y, canvas.Dy()), percent(cue.rect.Dx(), canvas.Dx()),
+				source)
+		}
+	})
+	return len(cues), err
+}
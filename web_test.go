@@ -0,0 +1,145 @@
+package vobsub
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWebSubtitles returns a subtitle at 1s and a forced one at 3s (first in the slice) on a PAL canvas
+func testWebSubtitles() (subtitles []Subtitle, rect image.Rectangle) {
+	img := testSubtitleImage(image.Rect(100, 480, 300, 510), 4)
+	placement := Placement{Area: img.Rect, Canvas: image.Rect(0, 0, 720, 576)}
+	subtitles = []Subtitle{
+		{Start: 3 * time.Second, Stop: 4 * time.Second, Forced: true, Image: img, Placement: placement},
+		{Start: time.Second, Stop: 2 * time.Second, Image: img, Placement: placement},
+	}
+	return subtitles, img.Rect
+}
+
+// checkTestWebImage decodes a base64 PNG image and checks its size
+func checkTestWebImage(t *testing.T, data string, size image.Point) {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Size() != size {
+		t.Errorf("expected a %v embedded image, got %v", size, img.Bounds().Size())
+	}
+}
+
+func readTestWebDocument(t *testing.T, file string) string {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteIMSC(t *testing.T) {
+	subtitles, rect := testWebSubtitles()
+	file := filepath.Join(t.TempDir(), "subs.ttml")
+	nbCues, err := WriteIMSC(file, subtitles, WebExportOptions{EmbedImages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbCues != 2 {
+		t.Fatalf("expected 2 cues, got %d", nbCues)
+	}
+	document := readTestWebDocument(t, file)
+	for _, expected := range []string{
+		`ttp:profile="http://www.w3.org/ns/ttml/profile/imsc1/image" tts:extent="720px 576px"`,
+		`<region xml:id="region_1" tts:origin="100px 480px" tts:extent="200px 30px"/>`,
+		`<region xml:id="region_2" tts:origin="100px 480px" tts:extent="200px 30px"/>`,
+		`<div region="region_1" begin="00:00:01.000" end="00:00:02.000" smpte:backgroundImage="#image_1"/>`,
+		`<div region="region_2" begin="00:00:03.000" end="00:00:04.000" smpte:backgroundImage="#image_2" itts:forcedDisplay="true"/>`,
+	} {
+		if !strings.Contains(document, expected) {
+			t.Errorf("expected %s in the document:\n%s", expected, document)
+		}
+	}
+	images := regexp.MustCompile(`<smpte:image xml:id="image_\d" imageType="PNG" encoding="Base64">([^<]+)</smpte:image>`).
+		FindAllStringSubmatch(document, -1)
+	if len(images) != 2 {
+		t.Fatalf("expected 2 embedded images, got %d", len(images))
+	}
+	for _, match := range images {
+		checkTestWebImage(t, match[1], rect.Size())
+	}
+	// Images written next to the document
+	if _, err = WriteIMSC(file, subtitles, WebExportOptions{ForcedOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	document = readTestWebDocument(t, file)
+	if !strings.Contains(document, `smpte:backgroundImage="subs_0001.png" itts:forcedDisplay="true"`) ||
+		strings.Contains(document, "region_2") {
+		t.Errorf("expected only the forced subtitle with its image file:\n%s", document)
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(file), "subs_0001.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteIMSCEmpty(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subs.ttml")
+	if _, err := WriteIMSC(file, nil, WebExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if document := readTestWebDocument(t, file); strings.Contains(document, "extent") {
+		t.Errorf("expected no extent without subtitles:\n%s", document)
+	}
+}
+
+func TestWriteImageVTT(t *testing.T) {
+	subtitles, rect := testWebSubtitles()
+	file := filepath.Join(t.TempDir(), "subs.vtt")
+	nbCues, err := WriteImageVTT(file, subtitles, WebExportOptions{EmbedImages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nbCues != 2 {
+		t.Fatalf("expected 2 cues, got %d", nbCues)
+	}
+	document := readTestWebDocument(t, file)
+	settings := " position:13.89%,line-left line:83.33%,start size:27.78% align:left\n"
+	for _, expected := range []string{
+		"WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.000" + settings + webDataURLPrefix,
+		"\n\n2-forced\n00:00:03.000 --> 00:00:04.000" + settings + webDataURLPrefix,
+	} {
+		if !strings.Contains(document, expected) {
+			t.Errorf("expected %q in the document:\n%s", expected, document)
+		}
+	}
+	images := regexp.MustCompile(regexp.QuoteMeta(webDataURLPrefix)+`(\S+)`).FindAllStringSubmatch(document, -1)
+	if len(images) != 2 {
+		t.Fatalf("expected 2 embedded images, got %d", len(images))
+	}
+	for _, match := range images {
+		checkTestWebImage(t, match[1], rect.Size())
+	}
+}
+
+func TestWriteWebErrorIndex(t *testing.T) {
+	canvas := image.Rect(0, 0, 720, 576)
+	subtitles := []Subtitle{
+		{Start: 2 * time.Second, Placement: Placement{Canvas: canvas}}, // no image
+		{Start: time.Second, Image: image.NewNRGBA(image.Rect(0, 0, 8, 8)), Placement: Placement{Canvas: canvas}},
+	}
+	_, err := WriteImageVTT(filepath.Join(t.TempDir(), "subs.vtt"), subtitles, WebExportOptions{})
+	if err == nil || !strings.Contains(err.Error(), "subtitle #1") {
+		t.Errorf("expected an error about subtitle #1, got: %v", err)
+	}
+}